@@ -5,9 +5,11 @@
 package cgroups
 
 import (
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 
 	com "github.com/linuxdeepin/deepin-network-proxy/com"
 	define "github.com/linuxdeepin/deepin-network-proxy/define"
@@ -381,6 +383,24 @@ func (c *Controller) GetCGroupPath() string {
 	return filepath.Join(cgroup2Path, c.GetName())
 }
 
+// pids of processes in cgroup and its children
+func (c *Controller) GetPids() ([]string, error) {
+	// not nil even if empty, as caller search all processes if nil
+	pids := []string{}
+	err := filepath.Walk(c.GetCGroupPath(), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || info.Name() != procsPath {
+			return err
+		}
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		pids = append(pids, strings.Fields(string(buf))...)
+		return nil
+	})
+	return pids, err
+}
+
 // App.slice
 func (c *Controller) GetName() string {
 	return c.Name.String() + suffix
@@ -7,9 +7,11 @@ package cgroups
 import (
 	"errors"
 	"os/exec"
+	"path/filepath"
 	"strings"
 
 	"github.com/linuxdeepin/deepin-network-proxy/com"
+	"github.com/linuxdeepin/deepin-network-proxy/define"
 )
 
 // Attach pid to cgroups path
@@ -29,3 +31,9 @@ func Attach(pid string, path string) error {
 	logger.Debugf("echo pid %s to cgroups %s success", pid, path)
 	return nil
 }
+
+// GuaranteeCGroup make sure cgroup of scope exist, iptables cgroup match need path exist
+func GuaranteeCGroup(scope define.Scope) error {
+	// /sys/fs/cgroup/App.slice/cgroup.procs
+	return com.GuaranteeDir(filepath.Join(cgroup2Path, scope.String()+suffix, procsPath))
+}
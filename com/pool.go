@@ -0,0 +1,37 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package com
+
+import "sync"
+
+// buffer pool of fixed size, pointer is stored to avoid allocation when put back
+type BufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+func NewBufferPool(size int) *BufferPool {
+	bp := &BufferPool{size: size}
+	bp.pool.New = func() interface{} {
+		buf := make([]byte, size)
+		return &buf
+	}
+	return bp
+}
+
+// get buffer, length is always pool size
+func (bp *BufferPool) Get() *[]byte {
+	return bp.pool.Get().(*[]byte)
+}
+
+// put buffer back, buffer must not be used after put
+func (bp *BufferPool) Put(buf *[]byte) {
+	// buffer resliced by caller is restored
+	if cap(*buf) < bp.size {
+		return
+	}
+	*buf = (*buf)[:bp.size]
+	bp.pool.Put(buf)
+}
@@ -0,0 +1,171 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package com
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// processes own sockets recently, searched first, as connections usually come from a few processes
+var recentOwners []string
+var recentOwnersLock sync.Mutex
+
+const recentOwnersSize = 16
+
+// get pid and executable of process which own the local socket, fds are searched only if match executable,
+// pids are candidates as processes in cgroup, all processes are searched if pids is nil
+func GetSocketOwner(addr net.Addr, pids []string, match func(exe string) bool) (int, string, error) {
+	inode, err := getSocketInode(addr)
+	if err != nil {
+		return 0, "", err
+	}
+	link := fmt.Sprintf("socket:[%d]", inode)
+	recentOwnersLock.Lock()
+	recent := append([]string(nil), recentOwners...)
+	recentOwnersLock.Unlock()
+	for _, pid := range recent {
+		if exe, ok := procOwnSocket(pid, link, match); ok {
+			pidNum, _ := strconv.Atoi(pid)
+			return pidNum, exe, nil
+		}
+	}
+	if pids == nil {
+		dirs, err := ioutil.ReadDir("/proc")
+		if err != nil {
+			return 0, "", err
+		}
+		for _, dir := range dirs {
+			if IsPid(dir.Name()) {
+				pids = append(pids, dir.Name())
+			}
+		}
+	}
+	for _, pid := range pids {
+		exe, ok := procOwnSocket(pid, link, match)
+		if !ok {
+			continue
+		}
+		addRecentOwner(pid)
+		pidNum, _ := strconv.Atoi(pid)
+		return pidNum, exe, nil
+	}
+	return 0, "", fmt.Errorf("owner of socket [%s] not found", addr)
+}
+
+// check if process has socket in fds, return executable
+func procOwnSocket(pid string, link string, match func(exe string) bool) (string, bool) {
+	procPath := filepath.Join("/proc", pid)
+	exe, err := os.Readlink(filepath.Join(procPath, "exe"))
+	if err != nil || (match != nil && !match(exe)) {
+		return "", false
+	}
+	fds, err := ioutil.ReadDir(filepath.Join(procPath, "fd"))
+	if err != nil {
+		return "", false
+	}
+	for _, fd := range fds {
+		target, err := os.Readlink(filepath.Join(procPath, "fd", fd.Name()))
+		if err == nil && target == link {
+			return exe, true
+		}
+	}
+	return "", false
+}
+
+// remember owner, the oldest one is dropped if full
+func addRecentOwner(pid string) {
+	recentOwnersLock.Lock()
+	defer recentOwnersLock.Unlock()
+	for _, elem := range recentOwners {
+		if elem == pid {
+			return
+		}
+	}
+	recentOwners = append(recentOwners, pid)
+	if len(recentOwners) > recentOwnersSize {
+		recentOwners = recentOwners[1:]
+	}
+}
+
+// get inode of local socket from /proc/net
+func getSocketInode(addr net.Addr) (uint64, error) {
+	var files []string
+	var ip net.IP
+	var port int
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		files = []string{"/proc/net/tcp", "/proc/net/tcp6"}
+		ip, port = addr.IP, addr.Port
+	case *net.UDPAddr:
+		files = []string{"/proc/net/udp", "/proc/net/udp6"}
+		ip, port = addr.IP, addr.Port
+	default:
+		return 0, errors.New("addr type is not tcp or udp")
+	}
+	for _, file := range files {
+		inode, err := findSocketInode(file, ip, port)
+		if err == nil {
+			return inode, nil
+		}
+	}
+	return 0, fmt.Errorf("socket [%s] not found", addr)
+}
+
+// find socket in table, as
+// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+func findSocketInode(file string, ip net.IP, port int) (uint64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	// skip title
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		localIP, localPort, err := parseProcNetAddr(fields[1])
+		if err != nil || localPort != port || !localIP.Equal(ip) {
+			continue
+		}
+		return strconv.ParseUint(fields[9], 10, 64)
+	}
+	return 0, errors.New("socket not found")
+}
+
+// addr as 0100007F:1F90, ip is printed as 32 bits words in host byte order
+func parseProcNetAddr(s string) (net.IP, int, error) {
+	index := strings.IndexByte(s, ':')
+	if index < 0 {
+		return nil, 0, errors.New("addr format is invalid")
+	}
+	buf, err := hex.DecodeString(s[:index])
+	if err != nil || (len(buf) != net.IPv4len && len(buf) != net.IPv6len) {
+		return nil, 0, errors.New("ip format is invalid")
+	}
+	port, err := strconv.ParseUint(s[index+1:], 16, 16)
+	if err != nil {
+		return nil, 0, err
+	}
+	ip := make(net.IP, len(buf))
+	for i := 0; i < len(buf); i += 4 {
+		binary.NativeEndian.PutUint32(ip[i:], binary.BigEndian.Uint32(buf[i:]))
+	}
+	return ip, int(port), nil
+}
@@ -0,0 +1,97 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package com
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// append only log file, rotate to path.1 ... path.N when larger than max size,
+// path.N is dropped at next rotation, file is opened at first write
+type RotateWriter struct {
+	path    string
+	maxSize int64
+	backups int
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+}
+
+func NewRotateWriter(path string, maxSize int64, backups int) *RotateWriter {
+	return &RotateWriter{
+		path:    path,
+		maxSize: maxSize,
+		backups: backups,
+	}
+}
+
+// write buf in one piece, so that line is never split between files
+func (writer *RotateWriter) Write(buf []byte) (int, error) {
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+	if writer.file != nil && writer.size+int64(len(buf)) > writer.maxSize {
+		err := writer.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if writer.file == nil {
+		err := writer.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := writer.file.Write(buf)
+	writer.size += int64(n)
+	return n, err
+}
+
+// open file to append, only root can read
+func (writer *RotateWriter) open() error {
+	err := GuaranteeDir(writer.path)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(writer.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	writer.file = file
+	writer.size = info.Size()
+	return nil
+}
+
+// shift backups and move current file to path.1, oldest is dropped
+func (writer *RotateWriter) rotate() error {
+	_ = writer.file.Close()
+	writer.file = nil
+	for index := writer.backups - 1; index > 0; index-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", writer.path, index), fmt.Sprintf("%s.%d", writer.path, index+1))
+	}
+	if writer.backups == 0 {
+		return os.Remove(writer.path)
+	}
+	return os.Rename(writer.path, writer.path+".1")
+}
+
+// close file, reopened at next write
+func (writer *RotateWriter) Close() error {
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+	if writer.file == nil {
+		return nil
+	}
+	err := writer.file.Close()
+	writer.file = nil
+	return err
+}
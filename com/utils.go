@@ -7,6 +7,7 @@ package com
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
@@ -22,8 +23,10 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/godbus/dbus/v5"
+	"github.com/linuxdeepin/deepin-network-proxy/define"
 	polkit "github.com/linuxdeepin/go-dbus-factory/system/org.freedesktop.policykit1"
 	"golang.org/x/sys/unix"
 )
@@ -121,6 +124,74 @@ func SetSockOptTrn(fd int) error {
 	return nil
 }
 
+// set socket mark, use to recognize connection created by proxy self
+func SetSockOptMark(fd int, mark int) error {
+	return syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+}
+
+// create dialer which mark all socket, in case connection of proxy self captured again
+func NewMarkDialer(timeout time.Duration, mark int) *net.Dialer {
+	return &net.Dialer{
+		Timeout: timeout,
+		Control: markControl(mark),
+		// domain is resolved with marked dns query too
+		Resolver: NewMarkResolver(timeout, mark),
+	}
+}
+
+// create resolver which mark dns query, in case answered by fake dns of proxy self
+func NewMarkResolver(timeout time.Duration, mark int) *net.Resolver {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: markControl(mark),
+	}
+	// go resolver is needed, cgo resolver dont use dialer
+	return &net.Resolver{PreferGo: true, Dial: dialer.DialContext}
+}
+
+// resolve udp addr as net.ResolveUDPAddr, dns query is marked
+func ResolveMarkUDPAddr(address string, mark int) (*net.UDPAddr, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	resolver := NewMarkResolver(0, mark)
+	port, err := resolver.LookupPort(context.Background(), "udp", portStr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return &net.UDPAddr{IP: ip, Port: port}, nil
+	}
+	ips, err := resolver.LookupIP(context.Background(), "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	// prefer ipv4 as net.ResolveUDPAddr
+	ip := ips[0]
+	for _, elem := range ips {
+		if elem.To4() != nil {
+			ip = elem
+			break
+		}
+	}
+	return &net.UDPAddr{IP: ip, Port: port}, nil
+}
+
+// set mark on socket before connect
+func markControl(mark int) func(network, address string, conn syscall.RawConn) error {
+	return func(network, address string, conn syscall.RawConn) error {
+		var err error
+		ctlErr := conn.Control(func(fd uintptr) {
+			err = SetSockOptMark(int(fd), mark)
+		})
+		if ctlErr != nil {
+			return ctlErr
+		}
+		return err
+	}
+}
+
 // addr type for udp and tcp
 type BaseAddr struct {
 	IP   net.IP
@@ -276,42 +347,44 @@ func MarshalPackage(pkg DataPackage, proto string) []byte {
 		   +----+------+--------+----------+----------+------+
 		   |RSV | FRAG |  ATYP  | DST.ADDR | DST.PORT | DATA |
 		   +----+------+--------+------+----------+----------+
-		   | 1  |  0   |    1   | Variable | Variable | Data |
+		   | 2  |  1   |    1   | Variable |    2     | Data |
 		   +----+------+--------+----------+----------+------+
 	*/
-	// message
+	// only udp is valid
+	if proto != "udp" {
+		return nil
+	}
+	// message, addr may be udp addr or domain addr
 	addr := pkg.Addr
 	valuePtr := reflect.ValueOf(addr)
 	value := reflect.Indirect(valuePtr)
-	var ip net.IP = value.FieldByName("IP").Bytes()
 	netPort := value.FieldByName("Port").Int()
 	data := pkg.Data
 	// udp message protocol
-	buf := make([]byte, 4)
+	buf := make([]byte, 4, 4+net.IPv6len+2+len(data))
 	buf[0] = 0
-	// only udp is valid
-	switch proto {
-	case "tcp":
-		return nil
-	case "udp":
-		buf[1] = 0
-	default:
-		return nil
-	}
 	buf[1] = 0
 	buf[2] = 0
-	if ip.To4() != nil {
-		buf[3] = 1
-		buf = append(buf, ip.To4()...)
-	} else if ip.To16() != nil {
-		buf[3] = 1
-		buf = append(buf, ip.To16()...)
-	} else {
+	if domain := value.FieldByName("Domain"); domain.IsValid() {
+		if domain.Len() > 255 {
+			return nil
+		}
 		buf[3] = 3
-		buf = append(buf, ip...)
+		buf = append(buf, byte(domain.Len()))
+		buf = append(buf, domain.String()...)
+	} else {
+		var ip net.IP = value.FieldByName("IP").Bytes()
+		if ip.To4() != nil {
+			buf[3] = 1
+			buf = append(buf, ip.To4()...)
+		} else if ip.To16() != nil {
+			buf[3] = 4
+			buf = append(buf, ip.To16()...)
+		} else {
+			return nil
+		}
 	}
 	// convert port 2 byte
-
 	port := make([]byte, 2)
 	binary.BigEndian.PutUint16(port, uint16(netPort))
 	buf = append(buf, port...)
@@ -321,18 +394,51 @@ func MarshalPackage(pkg DataPackage, proto string) []byte {
 }
 
 // unmarshal data
-func UnMarshalPackage(msg []byte) DataPackage {
-	addr := msg[4:8]
-	port := binary.BigEndian.Uint16(msg[8:10])
-	data := msg[10:]
-
-	return DataPackage{
-		Addr: &net.UDPAddr{
-			IP:   addr[:],
-			Port: int(port),
-		},
-		Data: data,
+func UnMarshalPackage(msg []byte) (DataPackage, error) {
+	var pkg DataPackage
+	if len(msg) < 4 {
+		return pkg, errors.New("udp package is too short")
+	}
+	// fragment is not supported, drop it
+	if msg[2] != 0 {
+		return pkg, fmt.Errorf("udp package fragment %v is not supported", msg[2])
+	}
+	var host []byte
+	var index int
+	switch msg[3] {
+	case 1:
+		index = 4 + net.IPv4len
+	case 4:
+		index = 4 + net.IPv6len
+	case 3:
+		if len(msg) < 5 {
+			return pkg, errors.New("udp package is too short")
+		}
+		index = 5 + int(msg[4])
+	default:
+		return pkg, fmt.Errorf("udp package addr type %v is invalid", msg[3])
+	}
+	if len(msg) < index+2 {
+		return pkg, errors.New("udp package is too short")
+	}
+	host = msg[4:index]
+	port := binary.BigEndian.Uint16(msg[index : index+2])
+	pkg.Data = msg[index+2:]
+	// domain addr must be resolved, reply should be sent from ip
+	if msg[3] == 3 {
+		addr, err := ResolveMarkUDPAddr(net.JoinHostPort(string(host[1:]), strconv.Itoa(int(port))), define.ProxyMark)
+		if err != nil {
+			return pkg, err
+		}
+		pkg.Addr = addr
+		return pkg, nil
+	}
+	// copy ip, msg buffer may be reused
+	pkg.Addr = &net.UDPAddr{
+		IP:   append(net.IP(nil), host...),
+		Port: int(port),
 	}
+	return pkg, nil
 }
 
 // get home dir
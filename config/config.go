@@ -93,7 +93,7 @@ app:
 // proxy type
 type Proxy struct {
 	// proxy proto type
-	ProtoType string `json:"type"` // http sock4 sock5
+	ProtoType string `json:"type"` // http sock4 sock5 shadowsocks ssh trojan wireguard
 
 	// [proto]&[name] as ident
 	Name string `yaml:"name"`
@@ -105,6 +105,92 @@ type Proxy struct {
 	// auth message
 	UserName string `yaml:"username"`
 	Password string `yaml:"password"`
+	// http only, basic digest ntlm, choose from proxy challenge if empty
+	AuthScheme string `yaml:"auth-scheme"`
+	// http only, forward plain http of port 80 as proxy request instead of connect
+	HttpForward bool `yaml:"http-forward"`
+
+	// sock5 only, max pre-authenticated connections kept for new tunnel, 0 to disable
+	PoolSize int `yaml:"pool-size"`
+
+	// sock4 only, send domain to proxy server and resolve remotely as socks4a
+	Sock4a bool `yaml:"sock4a"`
+
+	// shadowsocks only, aes-128-gcm aes-256-gcm chacha20-ietf-poly1305 or 2022-blake3-* aead method
+	Method string `yaml:"method"`
+	// shadowsocks only, base64 key, required by 2022 methods, derived from password if empty
+	Key string `yaml:"key"`
+
+	// ssh only, host key is verified by known hosts file, password key file and agent are tried as auth
+	KnownHosts    string `yaml:"known-hosts"`
+	KeyFile       string `yaml:"key-file"`
+	KeyPassphrase string `yaml:"key-passphrase"`
+	AgentSocket   string `yaml:"agent-socket"` // ssh-agent unix socket, as $SSH_AUTH_SOCK of user
+
+	// in seconds, 0 as default, negative to disable
+	HandshakeTimeout int `yaml:"handshake-timeout"` // dial and proto handshake with proxy server, 30 as default
+	IdleTimeout      int `yaml:"idle-timeout"`      // tunnel is closed if no data in both directions, 300 as default
+	TcpKeepAlive     int `yaml:"tcp-keepalive"`     // keepalive period of local and proxy server connection, 30 as default
+
+	// wrap connection to proxy server with tls, server with https:// prefix and trojan use tls too
+	TLS *TLSConfig `yaml:"tls,omitempty"`
+
+	// carry connection to proxy server in websocket or http2, for network only allow https-looking traffic
+	Transport *TransportConfig `yaml:"transport,omitempty"`
+
+	// wireguard only, tunnel run in userspace, no interface is created
+	WireGuard *WireGuardConfig `yaml:"wireguard,omitempty"`
+}
+
+// userspace wireguard device
+type WireGuardConfig struct {
+	PrivateKey string   `yaml:"private-key"` // base64 as wg genkey
+	Address    []string `yaml:"address"`     // address of tunnel, as 10.0.0.2 or fd00::2
+	DNS        []string `yaml:"dns"`         // resolve domain in tunnel, domain destination is refused if empty
+	MTU        int      `yaml:"mtu"`         // 1420 as default
+
+	Peers []WireGuardPeer `yaml:"peers"`
+}
+
+// wireguard peer
+type WireGuardPeer struct {
+	PublicKey    string   `yaml:"public-key"`
+	PresharedKey string   `yaml:"preshared-key"`
+	Endpoint     string   `yaml:"endpoint"`    // host:port, use server and port of proxy if empty
+	AllowedIPs   []string `yaml:"allowed-ips"` // 0.0.0.0/0 and ::/0 if empty
+	KeepAlive    int      `yaml:"persistent-keepalive"`
+}
+
+// transport of connection to proxy server
+type TransportConfig struct {
+	Type    string            `yaml:"type"` // ws or h2, plain tcp if empty
+	Path    string            `yaml:"path"` // request path, / as default
+	Host    string            `yaml:"host"` // host header, use server if empty
+	Headers map[string]string `yaml:"headers"`
+
+	// h2 only, request method, PUT as default
+	Method string `yaml:"method"`
+	// ws only, share one websocket connection with smux, h2 streams always share one connection
+	Mux bool `yaml:"mux"`
+}
+
+// tls config of connection to proxy server
+type TLSConfig struct {
+	ServerName string `yaml:"server-name"` // sni, use server if empty
+	CAFile     string `yaml:"ca-file"`     // pem ca bundle, use system ca if empty
+
+	// client certificate
+	CertFile string `yaml:"cert-file"`
+	KeyFile  string `yaml:"key-file"`
+
+	// base64 sha256 of certificate public key, any cert in chain match is ok
+	PinSHA256          []string `yaml:"pin-sha256"`
+	InsecureSkipVerify bool     `yaml:"insecure-skip-verify"` // dont verify chain, pin still checked
+
+	// application protocols, as h2 http/1.1
+	ALPN []string `yaml:"alpn"`
+	// hex sha256 of server leaf certificate, colon is allowed, checked even if chain is not verified
+	Fingerprint string `yaml:"fingerprint"`
 }
 
 // scope proxy
@@ -120,6 +206,139 @@ type ScopeProxies struct {
 	DNSPort   int      `yaml:"dns-port"`
 
 	UseFakeIP bool `yaml:"use-fake-ip"`
+	// recover domain of ip destination from tls sni or http host, so that proxy server resolve it
+	Sniff bool `yaml:"sniff"`
+
+	// destination never proxy, use default bypass cidrs if not set
+	BypassCIDRs []string `yaml:"bypass-cidrs"`
+
+	// destination port filter, support single port and port range, as 80 or 8000-9000
+	CapturePorts []string `yaml:"capture-ports"` // only proxy these ports, proxy all if empty
+	ExcludePorts []string `yaml:"exclude-ports"` // never proxy these ports
+
+	// listen at 127.0.0.1 for explicit http socks4 socks5 request, 0 means disable
+	MixedPort int `yaml:"mixed-port"`
+
+	// drop egress of proxied cgroup which not go through proxy, keep until disabled by user
+	KillSwitch bool `yaml:"kill-switch"`
+
+	// write one json line for each tcp connection when closed, to access.log in config dir
+	AccessLog bool `yaml:"access-log"`
+
+	// limit of all tunnels in scope, and of tunnels from each executable, key is executable path
+	Limit     LimitConfig            `yaml:"limit"`
+	AppLimits map[string]LimitConfig `yaml:"app-limits"`
+}
+
+// proxy of dbus api, only fields of the first version, other fields are set by json of AddProxy.
+// dbus struct cant hold nil pointer, and signature must keep stable for old clients
+type DBusProxy struct {
+	ProtoType string
+	Name      string
+	Server    string
+	Port      int
+	UserName  string
+	Password  string
+}
+
+// scope proxies of dbus api, setting added later has its own method
+type DBusScopeProxies struct {
+	Proxies        map[string][]DBusProxy
+	ProxyProgram   []string
+	NoProxyProgram []string
+	WhiteList      []string
+	TPort          int
+	DNSPort        int
+	UseFakeIP      bool
+}
+
+// convert to dbus proxy
+func (p Proxy) ToDBus() DBusProxy {
+	return DBusProxy{
+		ProtoType: p.ProtoType,
+		Name:      p.Name,
+		Server:    p.Server,
+		Port:      p.Port,
+		UserName:  p.UserName,
+		Password:  p.Password,
+	}
+}
+
+// convert to dbus scope proxies
+func (p *ScopeProxies) ToDBus() DBusScopeProxies {
+	result := DBusScopeProxies{
+		Proxies:        make(map[string][]DBusProxy, len(p.Proxies)),
+		ProxyProgram:   p.ProxyProgram,
+		NoProxyProgram: p.NoProxyProgram,
+		WhiteList:      p.WhiteList,
+		TPort:          p.TPort,
+		DNSPort:        p.DNSPort,
+		UseFakeIP:      p.UseFakeIP,
+	}
+	for proto, proxies := range p.Proxies {
+		for _, proxy := range proxies {
+			result.Proxies[proto] = append(result.Proxies[proto], proxy.ToDBus())
+		}
+	}
+	return result
+}
+
+// replace fields of dbus api, other setting is kept,
+// proxy keep its extra fields if the same proto and name still exist
+func (p *ScopeProxies) MergeDBus(proxies DBusScopeProxies) {
+	merged := make(map[string][]Proxy, len(proxies.Proxies))
+	for proto, list := range proxies.Proxies {
+		for _, elem := range list {
+			proxy, err := p.GetProxy(proto, elem.Name)
+			if err != nil {
+				proxy = Proxy{}
+			}
+			proxy.ProtoType = elem.ProtoType
+			proxy.Name = elem.Name
+			proxy.Server = elem.Server
+			proxy.Port = elem.Port
+			proxy.UserName = elem.UserName
+			proxy.Password = elem.Password
+			merged[proto] = append(merged[proto], proxy)
+		}
+	}
+	p.Proxies = merged
+	p.ProxyProgram = proxies.ProxyProgram
+	p.NoProxyProgram = proxies.NoProxyProgram
+	p.WhiteList = proxies.WhiteList
+	p.TPort = proxies.TPort
+	p.DNSPort = proxies.DNSPort
+	p.UseFakeIP = proxies.UseFakeIP
+}
+
+// bandwidth and connection limit, 0 means no limit
+type LimitConfig struct {
+	Upload   int64 `yaml:"upload"`    // bytes per second from local to remote
+	Download int64 `yaml:"download"`  // bytes per second from remote to local
+	MaxConns int   `yaml:"max-conns"` // concurrent tcp tunnels, new connection is refused if reached
+}
+
+// no limit is set
+func (l LimitConfig) IsZero() bool {
+	return l.Upload == 0 && l.Download == 0 && l.MaxConns == 0
+}
+
+// lan and reserved address, dont proxy as default
+var DefaultBypassCIDRs = []string{
+	"10.0.0.0/8",     // rfc1918
+	"172.16.0.0/12",  // rfc1918
+	"192.168.0.0/16", // rfc1918
+	"169.254.0.0/16", // link local
+	"224.0.0.0/4",    // multicast
+	"100.64.0.0/10",  // cgnat
+}
+
+// get bypass cidrs, return default if not set, empty slice means bypass nothing
+func (p *ScopeProxies) GetBypassCIDRs() []string {
+	if p.BypassCIDRs == nil {
+		return DefaultBypassCIDRs
+	}
+	return p.BypassCIDRs
 }
 
 func (p *ScopeProxies) GetProxy(proto string, name string) (Proxy, error) {
@@ -175,6 +394,30 @@ func (p *ScopeProxies) SetProxy(proto string, name string, proxy Proxy) {
 	p.Proxies[proto] = proxies
 }
 
+// delete proxy, proto is removed if empty
+func (p *ScopeProxies) DelProxy(proto string, name string) error {
+	if p == nil {
+		return errors.New("proxy proxies is nil")
+	}
+	proxies, ok := p.Proxies[proto]
+	if !ok {
+		return fmt.Errorf("proxy proto [%s] not exist in proxies", proto)
+	}
+	for index, proxy := range proxies {
+		if proxy.Name != name {
+			continue
+		}
+		proxies = append(proxies[:index], proxies[index+1:]...)
+		if len(proxies) == 0 {
+			delete(p.Proxies, proto)
+		} else {
+			p.Proxies[proto] = proxies
+		}
+		return nil
+	}
+	return fmt.Errorf("proxy name [%s] not exist in proto [%s]", name, proto)
+}
+
 // proxy config
 type ProxyConfig struct {
 	AllProxies map[string]ScopeProxies `yaml:"all-proxies"` // map[global,app]ScopeProxies
@@ -190,8 +433,15 @@ func NewProxyCfg() *ProxyConfig {
 
 // write config file
 func (p *ProxyConfig) WritePxyCfg(path string) error {
+	// nil bypass cidrs is written as empty list, which means bypass nothing when read back,
+	// so write defaults explicitly
+	out := &ProxyConfig{AllProxies: make(map[string]ScopeProxies, len(p.AllProxies))}
+	for scope, proxies := range p.AllProxies {
+		proxies.BypassCIDRs = proxies.GetBypassCIDRs()
+		out.AllProxies[scope] = proxies
+	}
 	// marshal interface
-	buf, err := yaml.Marshal(p)
+	buf, err := yaml.Marshal(out)
 	if err != nil {
 		return err
 	}
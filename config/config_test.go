@@ -6,9 +6,12 @@ package config
 
 import (
 	"log"
+	"path/filepath"
+	"reflect"
 	"testing"
 
 	"github.com/linuxdeepin/deepin-network-proxy/com"
+	"github.com/linuxdeepin/deepin-network-proxy/define"
 )
 
 func TestProxyConfig_LoadPxyCfg(t *testing.T) {
@@ -106,3 +109,31 @@ func TestProxyConfig_LoadPxyCfg(t *testing.T) {
 		log.Fatal(err)
 	}
 }
+
+// bypass cidrs not set keep default after written and read back, empty keep empty
+func TestProxyConfig_BypassCIDRsRoundTrip(t *testing.T) {
+	cfg := NewProxyCfg()
+	cfg.SetScopeProxies(define.App, ScopeProxies{TPort: 8090})
+	cfg.SetScopeProxies(define.Global, ScopeProxies{TPort: 8080, BypassCIDRs: []string{}})
+	path := filepath.Join(t.TempDir(), "proxy.yaml")
+	err := cfg.WritePxyCfg(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.AllProxies[define.App.String()].BypassCIDRs != nil {
+		t.Error("write config should not modify config in memory")
+	}
+	loaded := NewProxyCfg()
+	err = loaded.LoadPxyCfg(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app, _ := loaded.GetScopeProxies(define.App)
+	if !reflect.DeepEqual(app.GetBypassCIDRs(), DefaultBypassCIDRs) {
+		t.Errorf("app bypass cidrs is %v, want default", app.GetBypassCIDRs())
+	}
+	global, _ := loaded.GetScopeProxies(define.Global)
+	if len(global.GetBypassCIDRs()) != 0 {
+		t.Errorf("global bypass cidrs is %v, want empty", global.GetBypassCIDRs())
+	}
+}
@@ -4,6 +4,8 @@
 
 package define
 
+import "time"
+
 // proxy name
 /*
 	usage:
@@ -59,7 +61,43 @@ const (
 	GlobalPriority
 )
 
+// mark of socket created by proxy self, bigger than any t-port mark in case conflict
+const ProxyMark = 0x10000
+
 const (
 	ConfigName = "proxy.yaml"
 	ScriptName = "clean_script.sh"
+
+	// json lines of proxied connections, rotated by size
+	AccessLogName = "access.log"
+
+	// json lines of mutating dbus calls, rotated by size
+	AuditLogName = "audit.log"
+
+	// pcapng of captured handlers, only root can read
+	CaptureDir = "/var/lib/deepin-proxy/capture"
+)
+
+// dbus service of proxy, object of scope is at BusPath/<scope> with interface BusInterface.<scope>
+const (
+	BusServiceName = "org.deepin.dde.NetworkProxy1"
+	BusPath        = "/org/deepin/dde/NetworkProxy1"
+	BusInterface   = BusServiceName
 )
+
+// proto of proxies in config which can be started, socks5 is the same as socks5-tcp
+var ProxyProtos = []string{
+	"no-proxy", "http", "socks4", "socks5", "socks5-tcp", "socks5-udp", "shadowsocks", "shadowsocks-udp",
+	"ssh", "trojan", "trojan-udp", "wireguard", "wireguard-udp",
+}
+
+// state of proxied connection, returned by GetConnections as json
+type HandlerStat struct {
+	Proto       string    `json:"proto"`
+	Proxy       string    `json:"proxy"`
+	Source      string    `json:"source"`
+	Destination string    `json:"destination"` // domain if recovered
+	Start       time.Time `json:"start"`
+	Upload      int64     `json:"upload"`
+	Download    int64     `json:"download"`
+}
@@ -1,6 +1,7 @@
 module github.com/linuxdeepin/deepin-network-proxy
 
-go 1.15
+// wireguard-go and gvisor netstack require go 1.23.1
+go 1.23.1
 
 require (
 	github.com/godbus/dbus/v5 v5.1.0
@@ -8,6 +9,31 @@ require (
 	github.com/linuxdeepin/go-dbus-factory v0.0.0-20230407013947-6ff704a21ca7
 	github.com/linuxdeepin/go-lib v0.0.0-20230406092403-b4b4282fc513
 	github.com/miekg/dns v1.1.52
-	golang.org/x/sys v0.6.0
+	github.com/xtaci/smux v1.5.24
+	golang.org/x/crypto v0.37.0
+	golang.org/x/sys v0.32.0
+	golang.zx2c4.com/wireguard v0.0.0-20260522210424-ecfc5a8d5446
 	gopkg.in/yaml.v2 v2.4.0
+	lukechampine.com/blake3 v1.1.7
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/fsnotify/fsnotify v1.5.4 // indirect
+	github.com/google/btree v1.1.2 // indirect
+	github.com/klauspost/cpuid/v2 v2.0.9 // indirect
+	github.com/kr/pretty v0.3.1 // indirect
+	github.com/linuxdeepin/go-gir v0.0.0-20230331033513-a8d7a9e89f9b // indirect
+	github.com/linuxdeepin/go-x11-client v0.0.0-20220830090948-78fe92b727bb // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/stretchr/objx v0.5.0 // indirect
+	github.com/stretchr/testify v1.8.4 // indirect
+	golang.org/x/mod v0.21.0 // indirect
+	golang.org/x/net v0.39.0 // indirect
+	golang.org/x/sync v0.13.0 // indirect
+	golang.org/x/time v0.7.0 // indirect
+	golang.org/x/tools v0.26.0 // indirect
+	golang.zx2c4.com/wintun v0.0.0-20230126152724-0fa3db229ce2 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+	gvisor.dev/gvisor v0.0.0-20250503011706-39ed1f5ac29c // indirect
 )
@@ -5,12 +5,13 @@ clear_app_iptables(){
     ## clear app chain
     iptables -t mangle -F App
     ## detach app chain from main
-    iptables -t mangle -D Main -j App -p tcp -m cgroup --path App.slice
+    iptables -t mangle -D Main -j App -m cgroup --path App.slice
     ## remove chain
     iptables -t mangle -X App
 
     ## del mark rule from output chain
     iptables -t mangle -D PREROUTING -j TPROXY -p tcp --on-port 8090 -m mark --mark 8090
+    iptables -t mangle -D PREROUTING -j TPROXY -p udp --on-port 8090 -m mark --mark 8090
 
     ## del nat rule
     iptables -t nat -D OUTPUT -j REDIRECT -p udp --dport 53 --to-ports 5353 -m cgroup --path App.slice
@@ -33,12 +34,13 @@ clear_global_iptables(){
    ## clear global chain
     iptables -t mangle -F Global
     ## detach global chain from main
-    iptables -t mangle -D Main -j Global -p tcp -m cgroup ! --path Global.slice
+    iptables -t mangle -D Main -j Global -m cgroup ! --path Global.slice
     ## remove chain
     iptables -t mangle -X Global
 
     ## del mark rule from output chain
     iptables -t mangle -D PREROUTING -j TPROXY -p tcp --on-port 8080 -m mark --mark 8080
+    iptables -t mangle -D PREROUTING -j TPROXY -p udp --on-port 8080 -m mark --mark 8080
 }
 
 ## clear global ip rule
@@ -53,6 +55,26 @@ clear_global(){
     clear_global_iprule
 }
 
+## clear app kill switch
+clear_app_killswitch(){
+    ## clear kill switch chain
+    iptables -t filter -F App_KillSwitch
+    ## detach kill switch chain from output
+    iptables -t filter -D OUTPUT -j App_KillSwitch -m cgroup --path App.slice
+    ## remove chain
+    iptables -t filter -X App_KillSwitch
+}
+
+## clear global kill switch
+clear_global_killswitch(){
+    ## clear kill switch chain
+    iptables -t filter -F Global_KillSwitch
+    ## detach kill switch chain from output
+    iptables -t filter -D OUTPUT -j Global_KillSwitch -m cgroup ! --path Global.slice
+    ## remove chain
+    iptables -t filter -X Global_KillSwitch
+}
+
 ## clear main iptables
 clear_main_iptables(){
     ## clear main rules
@@ -93,6 +115,14 @@ case $i in
         clear_app
         exit 0
         ;;
+    clear_App_KillSwitch)
+        clear_app_killswitch
+        exit 0
+        ;;
+    clear_Global_KillSwitch)
+        clear_global_killswitch
+        exit 0
+        ;;
     *)
         exit 0
         ;;
@@ -0,0 +1,54 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/linuxdeepin/deepin-network-proxy/define"
+)
+
+// client of one scope object of proxy service
+type client struct {
+	scope define.Scope
+	obj   dbus.BusObject
+}
+
+func newClient(conn *dbus.Conn, scope define.Scope) *client {
+	path := dbus.ObjectPath(define.BusPath + "/" + scope.String())
+	return &client{
+		scope: scope,
+		obj:   conn.Object(define.BusServiceName, path),
+	}
+}
+
+// call method of scope interface, store output in ret
+func (c *client) call(method string, args []interface{}, ret ...interface{}) error {
+	call := c.obj.Call(define.BusInterface+"."+c.scope.String()+"."+method, 0, args...)
+	if call.Err != nil {
+		return call.Err
+	}
+	if len(ret) == 0 {
+		return nil
+	}
+	return call.Store(ret...)
+}
+
+// call getter which return json, unmarshal to v if not nil
+func (c *client) getJson(method string, v interface{}, args ...interface{}) (string, error) {
+	var buf string
+	err := c.call(method, args, &buf)
+	if err != nil {
+		return "", err
+	}
+	if v != nil && buf != "" {
+		err = json.Unmarshal([]byte(buf), v)
+		if err != nil {
+			return "", err
+		}
+	}
+	return buf, nil
+}
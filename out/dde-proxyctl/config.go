@@ -0,0 +1,210 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/linuxdeepin/deepin-network-proxy/config"
+	"github.com/linuxdeepin/deepin-network-proxy/define"
+)
+
+// check proxy without connecting, all problems are returned
+func validateProxy(proto string, proxy config.Proxy) []error {
+	var errs []error
+	add := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("proxy [%s/%s]: %s", proto, proxy.Name, fmt.Sprintf(format, args...)))
+	}
+	if !isProxyProto(proto) {
+		add("unknown proto, proxy cant be started")
+	}
+	if proxy.Name == "" {
+		add("name is empty")
+	}
+	isWireGuard := strings.HasPrefix(proto, "wireguard")
+	// wireguard peer may have its own endpoint
+	if proxy.Server == "" && !isWireGuard {
+		add("server is empty")
+	}
+	if proxy.Server != "" && (proxy.Port <= 0 || proxy.Port > 65535) {
+		add("port %d is invalid", proxy.Port)
+	}
+	if isWireGuard && (proxy.WireGuard == nil || proxy.WireGuard.PrivateKey == "" || len(proxy.WireGuard.Peers) == 0) {
+		add("wireguard need private key and peers")
+	}
+	if proxy.Transport != nil {
+		switch proxy.Transport.Type {
+		case "", "ws", "h2":
+		default:
+			add("transport type %s is unknown", proxy.Transport.Type)
+		}
+	}
+	return errs
+}
+
+// check if proxy of proto can be started
+func isProxyProto(proto string) bool {
+	for _, elem := range define.ProxyProtos {
+		if elem == proto {
+			return true
+		}
+	}
+	return false
+}
+
+// check port filter as 80 or 8000-9000
+func validatePortRange(value string) error {
+	parts := strings.SplitN(value, "-", 2)
+	var ports []int
+	for _, part := range parts {
+		port, err := strconv.Atoi(part)
+		if err != nil || port <= 0 || port > 65535 {
+			return fmt.Errorf("port %s is invalid", value)
+		}
+		ports = append(ports, port)
+	}
+	if len(ports) == 2 && ports[0] > ports[1] {
+		return fmt.Errorf("port range %s is reversed", value)
+	}
+	return nil
+}
+
+// check scope setting and all proxies of scope
+func validateScope(scope string, proxies config.ScopeProxies) []error {
+	var errs []error
+	add := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("scope [%s]: %s", scope, fmt.Sprintf(format, args...)))
+	}
+	ports := map[string]int{"t-port": proxies.TPort, "dns-port": proxies.DNSPort, "mixed-port": proxies.MixedPort}
+	for name, port := range ports {
+		if port < 0 || port > 65535 {
+			add("%s %d is invalid", name, port)
+		}
+	}
+	for _, cidr := range proxies.BypassCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			add("bypass cidr %s is invalid", cidr)
+		}
+	}
+	for _, value := range append(append([]string{}, proxies.CapturePorts...), proxies.ExcludePorts...) {
+		if err := validatePortRange(value); err != nil {
+			add("%v", err)
+		}
+	}
+	protos := make([]string, 0, len(proxies.Proxies))
+	for proto := range proxies.Proxies {
+		protos = append(protos, proto)
+	}
+	sort.Strings(protos)
+	for _, proto := range protos {
+		names := make(map[string]bool)
+		for _, proxy := range proxies.Proxies[proto] {
+			if names[proxy.Name] {
+				add("proxy [%s/%s] is duplicated", proto, proxy.Name)
+			}
+			names[proxy.Name] = true
+			errs = append(errs, validateProxy(proto, proxy)...)
+		}
+	}
+	return errs
+}
+
+// load config file and check all scopes
+func loadConfig(path string) (*config.ProxyConfig, []error, error) {
+	cfg := config.NewProxyCfg()
+	err := cfg.LoadPxyCfg(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	scopes := make([]string, 0, len(cfg.AllProxies))
+	for scope := range cfg.AllProxies {
+		scopes = append(scopes, scope)
+	}
+	sort.Strings(scopes)
+	var errs []error
+	for _, scope := range scopes {
+		if scope != define.App.String() && scope != define.Global.String() {
+			errs = append(errs, fmt.Errorf("scope [%s] is unknown", scope))
+			continue
+		}
+		errs = append(errs, validateScope(scope, cfg.AllProxies[scope])...)
+	}
+	return cfg, errs, nil
+}
+
+func (c *ctl) configValidate(path string) error {
+	_, errs, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+	if c.opts.json {
+		problems := make([]string, 0, len(errs))
+		for _, err := range errs {
+			problems = append(problems, err.Error())
+		}
+		err = c.printJson(map[string]interface{}{"valid": len(errs) == 0, "errors": problems})
+		if err != nil {
+			return err
+		}
+	} else {
+		for _, err := range errs {
+			fmt.Fprintln(c.out, err)
+		}
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("%s has %d problems", path, len(errs))
+	}
+	if !c.opts.json {
+		fmt.Fprintf(c.out, "%s is valid\n", path)
+	}
+	return nil
+}
+
+// proxies of file are added to scopes, proxy with the same proto and name is replaced,
+// other setting of scope is kept
+func (c *ctl) configImport(path string) error {
+	cfg, errs, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+	if len(errs) != 0 {
+		for _, err := range errs {
+			fmt.Fprintln(c.out, err)
+		}
+		return errors.New("config is invalid, nothing imported")
+	}
+	clients, err := c.client(true)
+	if err != nil {
+		return err
+	}
+	imported := make(map[string]int)
+	for _, cl := range clients {
+		proxies, ok := cfg.AllProxies[cl.scope.String()]
+		if !ok {
+			continue
+		}
+		for proto, list := range proxies.Proxies {
+			for _, proxy := range list {
+				err = addProxy(cl, proto, proxy)
+				if err != nil {
+					return fmt.Errorf("import proxy [%s/%s] to %s failed, err: %v", proto, proxy.Name, cl.scope, err)
+				}
+				imported[cl.scope.String()]++
+			}
+		}
+	}
+	if c.opts.json {
+		return c.printJson(imported)
+	}
+	for _, cl := range clients {
+		fmt.Fprintf(c.out, "%s: %d proxies imported\n", cl.scope, imported[cl.scope.String()])
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"testing"
+
+	"github.com/linuxdeepin/deepin-network-proxy/config"
+)
+
+func TestValidatePortRange(t *testing.T) {
+	for _, value := range []string{"80", "8000-9000", "1-65535"} {
+		if err := validatePortRange(value); err != nil {
+			t.Errorf("port %s is refused, err: %v", value, err)
+		}
+	}
+	for _, value := range []string{"", "0", "65536", "http", "9000-8000", "80-"} {
+		if err := validatePortRange(value); err == nil {
+			t.Errorf("port %s is accepted", value)
+		}
+	}
+}
+
+func TestValidateProxy(t *testing.T) {
+	proxy := config.Proxy{Name: "p1", Server: "1.2.3.4", Port: 1080}
+	if errs := validateProxy("socks5", proxy); len(errs) != 0 {
+		t.Errorf("valid proxy has problems %v", errs)
+	}
+	// unknown proto, empty name and invalid port are all reported
+	if errs := validateProxy("sock5", config.Proxy{Server: "1.2.3.4"}); len(errs) != 3 {
+		t.Errorf("problems are %v, want 3", errs)
+	}
+	// wireguard peer may have its own endpoint, but key and peers are required
+	if errs := validateProxy("wireguard", config.Proxy{Name: "wg"}); len(errs) != 1 {
+		t.Errorf("problems are %v, want 1", errs)
+	}
+	proxy.Transport = &config.TransportConfig{Type: "quic"}
+	if errs := validateProxy("trojan", proxy); len(errs) != 1 {
+		t.Errorf("problems are %v, want 1", errs)
+	}
+}
+
+func TestValidateScope(t *testing.T) {
+	proxies := config.ScopeProxies{
+		Proxies: map[string][]config.Proxy{
+			"http": {
+				{Name: "p1", Server: "1.2.3.4", Port: 8080},
+				{Name: "p1", Server: "1.2.3.5", Port: 8080},
+			},
+		},
+		TPort:        70000,
+		BypassCIDRs:  []string{"10.0.0.0/8", "10.0.0.1"},
+		CapturePorts: []string{"443"},
+		ExcludePorts: []string{"22-21"},
+	}
+	// t-port, cidr, exclude port and duplicated proxy
+	if errs := validateScope("App", proxies); len(errs) != 4 {
+		t.Errorf("problems are %v, want 4", errs)
+	}
+}
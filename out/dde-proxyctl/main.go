@@ -0,0 +1,546 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/linuxdeepin/deepin-network-proxy/config"
+	"github.com/linuxdeepin/deepin-network-proxy/define"
+)
+
+const usage = `usage: dde-proxyctl [options] <command> [args]
+
+commands:
+  status                                  show state of scopes
+  start <proto> <name>                    start proxy with proxy in config
+  stop                                    stop proxy
+  proxy list                              list proxies in config
+  proxy add <proto> <name> <server> <port>
+                                          add or replace proxy
+  proxy remove <proto> <name>             remove proxy
+  proxy test <proto> <name> [addr]        create tunnel to addr, print delay
+  app add <app>...                        add app to app scope, or ignore it in global scope
+  app remove <app>...                     undo app add
+  connections                             list active connections
+  dns                                     list recent queries of dns proxy
+  config validate <file>                  check proxy.yaml without applying it
+  config import <file>                    add proxies of proxy.yaml to scopes
+
+options:
+`
+
+// default target of proxy test
+const defaultTestAddr = "www.deepin.org:80"
+
+// options shared by all commands, accepted before and after command
+type options struct {
+	json     bool
+	scope    string
+	udp      bool
+	user     string
+	passStd  bool
+	watch    bool
+	interval time.Duration
+	count    int
+}
+
+func (opts *options) register(set *flag.FlagSet) {
+	set.BoolVar(&opts.json, "json", opts.json, "print json for scripts")
+	set.StringVar(&opts.scope, "scope", opts.scope, "scope to operate, app or global")
+	set.BoolVar(&opts.udp, "udp", opts.udp, "start: proxy udp too")
+	set.StringVar(&opts.user, "user", opts.user, "proxy add: username of proxy")
+	set.BoolVar(&opts.passStd, "password-stdin", opts.passStd, "proxy add: read password from stdin")
+	set.BoolVar(&opts.watch, "watch", opts.watch, "connections: refresh until interrupted")
+	set.DurationVar(&opts.interval, "interval", opts.interval, "connections: refresh interval")
+	set.IntVar(&opts.count, "n", opts.count, "dns: number of queries, 0 for all")
+}
+
+// parse flags mixed with args, stop at --
+func (opts *options) parse(args []string) ([]string, error) {
+	var rest []string
+	for len(args) != 0 {
+		set := flag.NewFlagSet("dde-proxyctl", flag.ContinueOnError)
+		set.SetOutput(io.Discard)
+		opts.register(set)
+		err := set.Parse(args)
+		if err != nil {
+			return nil, err
+		}
+		args = set.Args()
+		if len(args) == 0 {
+			break
+		}
+		if args[0] == "--" {
+			rest = append(rest, args[1:]...)
+			break
+		}
+		rest = append(rest, args[0])
+		args = args[1:]
+	}
+	return rest, nil
+}
+
+// scopes to operate, both if not set and all is true
+func (opts *options) scopes(all bool) ([]define.Scope, error) {
+	switch strings.ToLower(opts.scope) {
+	case "":
+		if all {
+			return []define.Scope{define.App, define.Global}, nil
+		}
+		return nil, errors.New("scope is required, use -scope app or -scope global")
+	case "app":
+		return []define.Scope{define.App}, nil
+	case "global":
+		return []define.Scope{define.Global}, nil
+	default:
+		return nil, fmt.Errorf("unknown scope %s", opts.scope)
+	}
+}
+
+// command context
+type ctl struct {
+	opts options
+	conn *dbus.Conn
+	out  io.Writer
+}
+
+func (c *ctl) client(all bool) ([]*client, error) {
+	scopes, err := c.opts.scopes(all)
+	if err != nil {
+		return nil, err
+	}
+	if c.conn == nil {
+		c.conn, err = dbus.SystemBus()
+		if err != nil {
+			return nil, err
+		}
+	}
+	var clients []*client
+	for _, scope := range scopes {
+		clients = append(clients, newClient(c.conn, scope))
+	}
+	return clients, nil
+}
+
+// client of the only scope
+func (c *ctl) one() (*client, error) {
+	clients, err := c.client(false)
+	if err != nil {
+		return nil, err
+	}
+	return clients[0], nil
+}
+
+func (c *ctl) printJson(v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(c.out, string(buf))
+	return err
+}
+
+// check arg count of command
+func needArgs(args []string, min int, max int, use string) error {
+	if len(args) < min || (max >= 0 && len(args) > max) {
+		return fmt.Errorf("usage: dde-proxyctl %s", use)
+	}
+	return nil
+}
+
+func (c *ctl) run(args []string) error {
+	if len(args) == 0 {
+		return errors.New("command is required, see dde-proxyctl -h")
+	}
+	cmd, args := args[0], args[1:]
+	sub := ""
+	if len(args) != 0 {
+		sub = args[0]
+	}
+	switch cmd {
+	case "status":
+		return c.status()
+	case "start":
+		if err := needArgs(args, 2, 2, "start <proto> <name>"); err != nil {
+			return err
+		}
+		return c.start(args[0], args[1])
+	case "stop":
+		return c.stop()
+	case "proxy":
+		switch sub {
+		case "list":
+			return c.proxyList()
+		case "add":
+			if err := needArgs(args[1:], 4, 4, "proxy add <proto> <name> <server> <port>"); err != nil {
+				return err
+			}
+			return c.proxyAdd(args[1], args[2], args[3], args[4])
+		case "remove":
+			if err := needArgs(args[1:], 2, 2, "proxy remove <proto> <name>"); err != nil {
+				return err
+			}
+			return c.proxyRemove(args[1], args[2])
+		case "test":
+			if err := needArgs(args[1:], 2, 3, "proxy test <proto> <name> [addr]"); err != nil {
+				return err
+			}
+			addr := defaultTestAddr
+			if len(args) == 4 {
+				addr = args[3]
+			}
+			return c.proxyTest(args[1], args[2], addr)
+		}
+		return errors.New("usage: dde-proxyctl proxy list|add|remove|test")
+	case "app":
+		switch sub {
+		case "add", "remove":
+			if err := needArgs(args[1:], 1, -1, "app "+sub+" <app>..."); err != nil {
+				return err
+			}
+			return c.app(sub == "add", args[1:])
+		}
+		return errors.New("usage: dde-proxyctl app add|remove <app>...")
+	case "connections":
+		return c.connections()
+	case "dns":
+		return c.dns()
+	case "config":
+		switch sub {
+		case "validate":
+			if err := needArgs(args[1:], 1, 1, "config validate <file>"); err != nil {
+				return err
+			}
+			return c.configValidate(args[1])
+		case "import":
+			if err := needArgs(args[1:], 1, 1, "config import <file>"); err != nil {
+				return err
+			}
+			return c.configImport(args[1])
+		}
+		return errors.New("usage: dde-proxyctl config validate|import <file>")
+	default:
+		return fmt.Errorf("unknown command %s, see dde-proxyctl -h", cmd)
+	}
+}
+
+// state of scope, as GetStatus
+type scopeStatus struct {
+	Scope       string `json:"scope"`
+	Enabled     bool   `json:"enabled"`
+	Proto       string `json:"proto,omitempty"`
+	Proxy       string `json:"proxy,omitempty"`
+	TPort       int    `json:"t-port"`
+	DNSPort     int    `json:"dns-port"`
+	MixedPort   int    `json:"mixed-port"`
+	KillSwitch  bool   `json:"kill-switch"`
+	AccessLog   bool   `json:"access-log"`
+	Connections int    `json:"connections"`
+}
+
+func (c *ctl) status() error {
+	clients, err := c.client(true)
+	if err != nil {
+		return err
+	}
+	statuses := make([]scopeStatus, 0, len(clients))
+	for _, cl := range clients {
+		var status scopeStatus
+		_, err := cl.getJson("GetStatus", &status)
+		if err != nil {
+			return fmt.Errorf("get status of %s failed, err: %v", cl.scope, err)
+		}
+		statuses = append(statuses, status)
+	}
+	if c.opts.json {
+		return c.printJson(statuses)
+	}
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SCOPE\tSTATE\tPROXY\tT-PORT\tDNS-PORT\tMIXED-PORT\tKILL-SWITCH\tCONNECTIONS")
+	for _, status := range statuses {
+		state, proxy := "stopped", "-"
+		if status.Enabled {
+			state = "running"
+			proxy = status.Proto + "/" + status.Proxy
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\t%v\t%d\n", status.Scope, state, proxy,
+			status.TPort, status.DNSPort, status.MixedPort, status.KillSwitch, status.Connections)
+	}
+	return w.Flush()
+}
+
+func (c *ctl) start(proto string, name string) error {
+	cl, err := c.one()
+	if err != nil {
+		return err
+	}
+	return cl.call("StartProxy", []interface{}{proto, name, c.opts.udp})
+}
+
+func (c *ctl) stop() error {
+	cl, err := c.one()
+	if err != nil {
+		return err
+	}
+	return cl.call("StopProxy", nil)
+}
+
+// proxy in config, as GetProxies
+type proxySummary struct {
+	Proto   string `json:"proto"`
+	Name    string `json:"name"`
+	Server  string `json:"server"`
+	Port    int    `json:"port"`
+	Current bool   `json:"current"`
+}
+
+func (c *ctl) proxyList() error {
+	cl, err := c.one()
+	if err != nil {
+		return err
+	}
+	var proxies []proxySummary
+	buf, err := cl.getJson("GetProxies", &proxies)
+	if err != nil {
+		return err
+	}
+	if c.opts.json {
+		_, err = fmt.Fprintln(c.out, buf)
+		return err
+	}
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PROTO\tNAME\tSERVER\tCURRENT")
+	for _, proxy := range proxies {
+		current := ""
+		if proxy.Current {
+			current = "*"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", proxy.Proto, proxy.Name,
+			proxy.Server+":"+strconv.Itoa(proxy.Port), current)
+	}
+	return w.Flush()
+}
+
+func (c *ctl) proxyAdd(proto string, name string, server string, portStr string) error {
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return fmt.Errorf("port %s is invalid", portStr)
+	}
+	proxy := config.Proxy{
+		ProtoType: proto,
+		Name:      name,
+		Server:    server,
+		Port:      port,
+		UserName:  c.opts.user,
+	}
+	// password in args can be seen by other users
+	if c.opts.passStd {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		proxy.Password = strings.TrimRight(line, "\r\n")
+	}
+	if errs := validateProxy(proto, proxy); len(errs) != 0 {
+		return errs[0]
+	}
+	cl, err := c.one()
+	if err != nil {
+		return err
+	}
+	return addProxy(cl, proto, proxy)
+}
+
+func addProxy(cl *client, proto string, proxy config.Proxy) error {
+	buf, err := json.Marshal(proxy)
+	if err != nil {
+		return err
+	}
+	return cl.call("AddProxy", []interface{}{proto, proxy.Name, buf})
+}
+
+func (c *ctl) proxyRemove(proto string, name string) error {
+	cl, err := c.one()
+	if err != nil {
+		return err
+	}
+	return cl.call("DelProxy", []interface{}{proto, name})
+}
+
+func (c *ctl) proxyTest(proto string, name string, addr string) error {
+	cl, err := c.one()
+	if err != nil {
+		return err
+	}
+	var delay int32
+	err = cl.call("TestProxy", []interface{}{proto, name, addr}, &delay)
+	if c.opts.json {
+		result := map[string]interface{}{"proto": proto, "name": name, "addr": addr, "ok": err == nil}
+		if err != nil {
+			result["error"] = err.Error()
+		} else {
+			result["delay"] = delay
+		}
+		if printErr := c.printJson(result); printErr != nil {
+			return printErr
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(c.out, "%s/%s -> %s: %d ms\n", proto, name, addr, delay)
+	return err
+}
+
+// app scope proxy apps, global scope ignore them
+func (c *ctl) app(add bool, apps []string) error {
+	cl, err := c.one()
+	if err != nil {
+		return err
+	}
+	var method string
+	switch {
+	case cl.scope == define.App && add:
+		method = "AddProxyApps"
+	case cl.scope == define.App:
+		method = "DelProxyApps"
+	case add:
+		method = "IgnoreProxyApps"
+	default:
+		method = "UnIgnoreProxyApps"
+	}
+	return cl.call(method, []interface{}{apps})
+}
+
+func (c *ctl) connections() error {
+	clients, err := c.client(true)
+	if err != nil {
+		return err
+	}
+	for {
+		var all []define.HandlerStat
+		for _, cl := range clients {
+			var stats []define.HandlerStat
+			_, err := cl.getJson("GetConnections", &stats)
+			if err != nil {
+				return fmt.Errorf("get connections of %s failed, err: %v", cl.scope, err)
+			}
+			all = append(all, stats...)
+		}
+		if c.opts.json {
+			if all == nil {
+				all = []define.HandlerStat{}
+			}
+			err = c.printJson(all)
+		} else {
+			if c.opts.watch {
+				// clear screen and move to top
+				fmt.Fprint(c.out, "\033[H\033[2J")
+			}
+			err = printConnections(c.out, all)
+		}
+		if err != nil || !c.opts.watch {
+			return err
+		}
+		time.Sleep(c.opts.interval)
+	}
+}
+
+func printConnections(out io.Writer, stats []define.HandlerStat) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PROTO\tPROXY\tSOURCE\tDESTINATION\tDURATION\tUPLOAD\tDOWNLOAD")
+	for _, stat := range stats {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", stat.Proto, stat.Proxy, stat.Source, stat.Destination,
+			time.Since(stat.Start).Truncate(time.Second), formatBytes(stat.Upload), formatBytes(stat.Download))
+	}
+	return w.Flush()
+}
+
+// as 1.5M
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return strconv.FormatInt(size, 10) + "B"
+	}
+	value := float64(size)
+	var suffix string
+	for _, suffix = range []string{"K", "M", "G", "T"} {
+		value /= unit
+		if value < unit {
+			break
+		}
+	}
+	return strconv.FormatFloat(value, 'f', 1, 64) + suffix
+}
+
+// query of dns proxy, as GetDNSHistory
+type dnsQuery struct {
+	Time   time.Time `json:"time"`
+	Domain string    `json:"domain"`
+	Type   string    `json:"type"`
+	Answer string    `json:"answer,omitempty"`
+}
+
+func (c *ctl) dns() error {
+	cl, err := c.one()
+	if err != nil {
+		return err
+	}
+	var queries []dnsQuery
+	buf, err := cl.getJson("GetDNSHistory", &queries, int32(c.opts.count))
+	if err != nil {
+		return err
+	}
+	if c.opts.json {
+		_, err = fmt.Fprintln(c.out, buf)
+		return err
+	}
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tTYPE\tDOMAIN\tANSWER")
+	for _, query := range queries {
+		answer := query.Answer
+		if answer == "" {
+			answer = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", query.Time.Format("15:04:05"), query.Type, query.Domain, answer)
+	}
+	return w.Flush()
+}
+
+func main() {
+	c := &ctl{
+		opts: options{interval: time.Second},
+		out:  os.Stdout,
+	}
+	args, err := c.opts.parse(os.Args[1:])
+	if err == flag.ErrHelp {
+		fmt.Fprint(os.Stderr, usage)
+		set := flag.NewFlagSet("dde-proxyctl", flag.ContinueOnError)
+		c.opts.register(set)
+		set.SetOutput(os.Stderr)
+		set.PrintDefaults()
+		return
+	}
+	if err == nil {
+		err = c.run(args)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "dde-proxyctl:", err)
+		os.Exit(1)
+	}
+}
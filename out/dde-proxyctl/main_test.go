@@ -0,0 +1,51 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/linuxdeepin/deepin-network-proxy/define"
+)
+
+// flags are accepted before and after command, args after -- are kept as is
+func TestOptionsParse(t *testing.T) {
+	opts := options{interval: time.Second}
+	rest, err := opts.parse([]string{"-scope", "app", "proxy", "add", "-user", "me", "http", "p1",
+		"-json", "1.2.3.4", "8080", "--", "-n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"proxy", "add", "http", "p1", "1.2.3.4", "8080", "-n"}
+	if !reflect.DeepEqual(rest, want) {
+		t.Errorf("args are %v, want %v", rest, want)
+	}
+	if opts.scope != "app" || opts.user != "me" || !opts.json || opts.interval != time.Second {
+		t.Errorf("options are %+v", opts)
+	}
+	if _, err = (&options{}).parse([]string{"status", "-unknown"}); err == nil {
+		t.Error("unknown flag should be refused")
+	}
+}
+
+func TestOptionsScopes(t *testing.T) {
+	opts := options{}
+	if scopes, err := opts.scopes(true); err != nil || len(scopes) != 2 {
+		t.Errorf("all scopes are %v, err: %v", scopes, err)
+	}
+	if _, err := opts.scopes(false); err == nil {
+		t.Error("missing scope should be refused")
+	}
+	opts.scope = "Global"
+	if scopes, err := opts.scopes(false); err != nil || !reflect.DeepEqual(scopes, []define.Scope{define.Global}) {
+		t.Errorf("scopes are %v, err: %v", scopes, err)
+	}
+	opts.scope = "main"
+	if _, err := opts.scopes(true); err == nil {
+		t.Error("unknown scope should be refused")
+	}
+}
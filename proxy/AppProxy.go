@@ -19,14 +19,39 @@ type AppProxy struct {
 
 	// methods
 	methods *struct {
-		ClearProxy func()
-		SetProxies func() `in:"proxies" out:"err"`
-		StartProxy func() `in:"proto,name,udp" out:"err"`
-		StopProxy  func()
-		GetProxy   func() `out:"proxy"`
-		AddProxy   func() `in:"proto,name,proxy"`
-		GetCGroups func() `out:"cgroups"`
-		AddProc    func() `in:"pid" out:"success"`
+		ClearProxy  func()
+		SetProxies  func() `in:"proxies" out:"err"`
+		StartProxy  func() `in:"proto,name,udp" out:"err"`
+		StopProxy   func()
+		SwitchProxy func() `in:"proto,name,killOld" out:"err"`
+		GetProxy    func() `out:"proxy"`
+		AddProxy    func() `in:"proto,name,proxy"`
+		DelProxy    func() `in:"proto,name"`
+		GetProxies  func() `out:"proxies"`
+		TestProxy   func() `in:"proto,name,addr" out:"delay"`
+		GetCGroups  func() `out:"cgroups"`
+		AddProc     func() `in:"pid" out:"success"`
+
+		SetKillSwitch func() `in:"enable" out:"err"`
+		GetKillSwitch func() `out:"enable"`
+
+		SetLimit  func() `in:"exe,upload,download,maxConns" out:"err"`
+		GetLimits func() `out:"limits"`
+
+		SetAccessLog func() `in:"enable" out:"err"`
+		GetAccessLog func() `out:"enable"`
+
+		StartCapture func() `in:"exe,domain,srcAddr,dstAddr,maxSize,duration" out:"path"`
+		StopCapture  func()
+
+		GetAuditLog func() `in:"count" out:"log"`
+
+		SetOptions func() `in:"options" out:"err"`
+		GetOptions func() `out:"options"`
+
+		GetStatus      func() `out:"status"`
+		GetConnections func() `out:"connections"`
+		GetDNSHistory  func() `in:"count" out:"history"`
 
 		// diff method
 		AddProxyApps func() `in:"app" out:"err"`
@@ -36,7 +61,7 @@ type AppProxy struct {
 	// signal
 	signals *struct {
 		Proxy struct {
-			proxy config.Proxy
+			proxy config.DBusProxy
 		}
 	}
 }
@@ -63,9 +88,11 @@ func (mgr *AppProxy) export(service *dbusutil.Service) error {
 }
 
 // add proxy app
-func (mgr *AppProxy) AddProxyApps(apps []string) *dbus.Error {
+func (mgr *AppProxy) AddProxyApps(sender dbus.Sender, apps []string) *dbus.Error {
+	audit := mgr.beginAudit(sender, "AddProxyApps", apps)
 	go func() {
-		_ = mgr.addProxyApps(apps)
+		err := mgr.addProxyApps(apps)
+		audit.end(dbusutil.ToError(err))
 	}()
 	return nil
 }
@@ -132,9 +159,11 @@ func (mgr *AppProxy) addProxyApps(apps []string) error {
 }
 
 // delete proxy app
-func (mgr *AppProxy) DelProxyApps(apps []string) *dbus.Error {
+func (mgr *AppProxy) DelProxyApps(sender dbus.Sender, apps []string) *dbus.Error {
+	audit := mgr.beginAudit(sender, "DelProxyApps", apps)
 	go func() {
-		_ = mgr.delProxyApps(apps)
+		err := mgr.delProxyApps(apps)
+		audit.end(dbusutil.ToError(err))
 	}()
 	return nil
 }
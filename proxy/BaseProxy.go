@@ -16,12 +16,16 @@ import (
 type BaseProxy interface {
 	// DBus method
 	StartProxy(sender dbus.Sender, proto string, name string, udp bool) *dbus.Error
-	StopProxy() *dbus.Error
-	SetProxies(proxies config.ScopeProxies) *dbus.Error
-	ClearProxy() *dbus.Error
+	StopProxy(sender dbus.Sender) *dbus.Error
+	SwitchProxy(sender dbus.Sender, proto string, name string, killOld bool) *dbus.Error
+	SetProxies(sender dbus.Sender, proxies config.DBusScopeProxies) *dbus.Error
+	ClearProxy(sender dbus.Sender) *dbus.Error
 	GetProxy() (string, *dbus.Error)
-	AddProxy(proto string, name string, jsonProxy []byte) *dbus.Error
+	AddProxy(sender dbus.Sender, proto string, name string, jsonProxy []byte) *dbus.Error
+	DelProxy(sender dbus.Sender, proto string, name string) *dbus.Error
 	GetCGroups() (string, *dbus.Error)
+	SetKillSwitch(sender dbus.Sender, enable bool) *dbus.Error
+	GetKillSwitch() (bool, *dbus.Error)
 
 	// manager
 	loadConfig()
@@ -42,6 +46,9 @@ type BaseProxy interface {
 	appendRule() error
 	releaseRule() error
 
+	// kill switch
+	initKillSwitch()
+
 	// export DBus service
 	export(service *dbusutil.Service) error
 }
@@ -22,14 +22,39 @@ type GlobalProxy struct {
 
 	// methods
 	methods *struct {
-		ClearProxy func()
-		SetProxies func() `in:"proxies" out:"err"`
-		StartProxy func() `in:"proto,name,udp" out:"err"`
-		StopProxy  func()
-		GetProxy   func() `out:"proxy"`
-		AddProxy   func() `in:"proto,name,proxy"`
-		GetCGroups func() `out:"cgroups"`
-		AddProc    func() `in:"pid" out:"success"`
+		ClearProxy  func()
+		SetProxies  func() `in:"proxies" out:"err"`
+		StartProxy  func() `in:"proto,name,udp" out:"err"`
+		StopProxy   func()
+		SwitchProxy func() `in:"proto,name,killOld" out:"err"`
+		GetProxy    func() `out:"proxy"`
+		AddProxy    func() `in:"proto,name,proxy"`
+		DelProxy    func() `in:"proto,name"`
+		GetProxies  func() `out:"proxies"`
+		TestProxy   func() `in:"proto,name,addr" out:"delay"`
+		GetCGroups  func() `out:"cgroups"`
+		AddProc     func() `in:"pid" out:"success"`
+
+		SetKillSwitch func() `in:"enable" out:"err"`
+		GetKillSwitch func() `out:"enable"`
+
+		SetLimit  func() `in:"exe,upload,download,maxConns" out:"err"`
+		GetLimits func() `out:"limits"`
+
+		SetAccessLog func() `in:"enable" out:"err"`
+		GetAccessLog func() `out:"enable"`
+
+		StartCapture func() `in:"exe,domain,srcAddr,dstAddr,maxSize,duration" out:"path"`
+		StopCapture  func()
+
+		GetAuditLog func() `in:"count" out:"log"`
+
+		SetOptions func() `in:"options" out:"err"`
+		GetOptions func() `out:"options"`
+
+		GetStatus      func() `out:"status"`
+		GetConnections func() `out:"connections"`
+		GetDNSHistory  func() `in:"count" out:"history"`
 
 		// diff method
 		IgnoreProxyApps   func() `in:"app" out:"err"`
@@ -39,7 +64,7 @@ type GlobalProxy struct {
 	// signal
 	signals *struct {
 		Proxy struct {
-			proxy config.Proxy
+			proxy config.DBusProxy
 		}
 	}
 }
@@ -65,9 +90,11 @@ func (mgr *GlobalProxy) export(service *dbusutil.Service) error {
 }
 
 // add proxy app
-func (mgr *GlobalProxy) IgnoreProxyApps(apps []string) *dbus.Error {
+func (mgr *GlobalProxy) IgnoreProxyApps(sender dbus.Sender, apps []string) *dbus.Error {
+	audit := mgr.beginAudit(sender, "IgnoreProxyApps", apps)
 	go func() {
-		_ = mgr.ignoreProxyApps(apps)
+		err := mgr.ignoreProxyApps(apps)
+		audit.end(dbusutil.ToError(err))
 	}()
 	return nil
 }
@@ -123,9 +150,11 @@ func (mgr *GlobalProxy) ignoreProxyApps(apps []string) error {
 }
 
 // delete proxy app
-func (mgr *GlobalProxy) UnIgnoreProxyApps(apps []string) *dbus.Error {
+func (mgr *GlobalProxy) UnIgnoreProxyApps(sender dbus.Sender, apps []string) *dbus.Error {
+	audit := mgr.beginAudit(sender, "UnIgnoreProxyApps", apps)
 	go func() {
-		_ = mgr.unIgnoreProxyApps(apps)
+		err := mgr.unIgnoreProxyApps(apps)
+		audit.end(dbusutil.ToError(err))
 	}()
 	return nil
 }
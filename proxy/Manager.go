@@ -7,6 +7,7 @@ package proxy
 import (
 	"os"
 	"path/filepath"
+	"strconv"
 	"sync"
 
 	"github.com/linuxdeepin/deepin-network-proxy/com"
@@ -43,10 +44,18 @@ type Manager struct {
 	mainChain   *iptables.Chain // main attach chain
 	iptablesMgr *iptables.Manager
 
+	// kill switch iptables manager, never release with proxy
+	filterMgr *iptables.Manager
+
 	// iproute manager
 	mainRoute *iproute.Route
 	routeMgr  *iproute.Manager
 
+	// access log shared by all scopes
+	accessLog *com.RotateWriter
+	// audit log of mutating dbus calls shared by all scopes
+	auditLog *com.RotateWriter
+
 	// if current listening
 	runOnce *sync.Once
 }
@@ -67,6 +76,16 @@ func (m *Manager) Init() error {
 	}
 	// store service
 	m.sysService = sysService
+	// kill switch rules should keep after proxy stop
+	m.filterMgr = iptables.NewManager()
+	m.filterMgr.Init()
+	// access and audit log are opened at first record
+	dir, err := com.GetConfigDir()
+	if err != nil {
+		return err
+	}
+	m.accessLog = com.NewRotateWriter(filepath.Join(dir, define.AccessLogName), accessLogSize, accessLogBackups)
+	m.auditLog = com.NewRotateWriter(filepath.Join(dir, define.AuditLogName), auditLogSize, auditLogBackups)
 	// attach dbus objects
 	// m.procsService = netlink.NewProcs(sysService.Conn())
 	// m.sigLoop = dbusutil.NewSignalLoop(sysService.Conn(), 10)
@@ -117,6 +136,8 @@ func (m *Manager) Export() error {
 	appProxy.saveManager(m)
 	// load config
 	appProxy.loadConfig()
+	// restore kill switch
+	appProxy.initKillSwitch()
 	// export
 	err := appProxy.export(m.sysService)
 	if err != nil {
@@ -131,6 +152,8 @@ func (m *Manager) Export() error {
 	//globalProxy.saveManager(m)
 	//// load config
 	//globalProxy.loadConfig()
+	//// restore kill switch
+	//globalProxy.initKillSwitch()
 	//// export
 	//err = globalProxy.export(m.sysService)
 	//if err != nil {
@@ -188,6 +211,26 @@ func (m *Manager) initIptables() error {
 		logger.Warningf("init iptables failed, err: %v", err)
 		return err
 	}
+	// dont proxy connection created by proxy self, must be the first rule, in case proxy loop
+	// sudo iptables -t mangle -A Main -m mark --mark 65536 -j RETURN
+	cpl := &iptables.CompleteRule{
+		Action: iptables.RETURN,
+		ExtendsSl: []iptables.ExtendsRule{
+			{
+				Match: "m",
+				Elem: iptables.ExtendsElem{
+					Match: "mark",
+					Base:  iptables.BaseRule{Match: "mark", Param: strconv.Itoa(define.ProxyMark)},
+				},
+			},
+		},
+	}
+	err = m.mainChain.AppendRule(cpl)
+	if err != nil {
+		logger.Warningf("init iptables failed, err: %v", err)
+		return err
+	}
+
 	// dont proxy local lo
 	// sudo iptables -t mangle -A Main 1 -o lo -j RETURN
 	base := iptables.BaseRule{
@@ -196,7 +239,7 @@ func (m *Manager) initIptables() error {
 		// "lo"
 		Param: "lo",
 	}
-	cpl := &iptables.CompleteRule{
+	cpl = &iptables.CompleteRule{
 		Action:    iptables.RETURN,
 		BaseSl:    []iptables.BaseRule{base},
 		ExtendsSl: nil,
@@ -10,6 +10,7 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"sync"
 
 	"github.com/godbus/dbus/v5"
 	"github.com/linuxdeepin/deepin-network-proxy/cgroups"
@@ -26,9 +27,9 @@ import (
 var logger *log.Logger
 
 const (
-	BusServiceName = "org.deepin.dde.NetworkProxy1"
-	BusPath        = "/org/deepin/dde/NetworkProxy1"
-	BusInterface   = BusServiceName
+	BusServiceName = define.BusServiceName
+	BusPath        = define.BusPath
+	BusInterface   = define.BusInterface
 )
 
 // must ignore proxy proc
@@ -45,6 +46,11 @@ type proxyPrv struct {
 	Proxies config.ScopeProxies
 	Proxy   config.Proxy // current proxy
 
+	// current proxy type, use proxyLock to guard Proxy and proxyTyp,
+	// in case accept read proxy while switching
+	proxyTyp  tproxy.ProtoTyp
+	proxyLock sync.RWMutex
+
 	// if proxy opened
 	Enabled bool
 
@@ -52,8 +58,9 @@ type proxyPrv struct {
 	manager *Manager
 
 	// listener
-	tcpHandler net.Listener
-	udpHandler net.PacketConn
+	tcpHandler   net.Listener
+	udpHandler   net.PacketConn
+	mixedHandler net.Listener // explicit proxy inbound
 
 	// cgroup controller
 	controller *cgroups.Controller
@@ -61,6 +68,9 @@ type proxyPrv struct {
 	// iptables chain rule slice[3]
 	chains [2]*iptables.Chain
 
+	// kill switch chain in filter table
+	killChain *iptables.Chain
+
 	// route rule
 	ipRule *iproute.Rule
 
@@ -69,6 +79,15 @@ type proxyPrv struct {
 
 	dnsProxy *proxyDNS
 
+	// limit of scope and executables
+	scopeLimiter *tproxy.Limiter
+	appLimiters  map[string]*tproxy.Limiter
+	limitLock    sync.Mutex
+
+	// capture of matched handlers for debugging
+	capture     *tproxy.Capture
+	captureLock sync.Mutex
+
 	// handler
 	uid uint32
 	gid uint32
@@ -84,6 +103,7 @@ func initProxyPrv(scope define.Scope, priority define.Priority) *proxyPrv {
 		priority:   priority,
 		handlerMgr: tproxy.NewHandlerMgr(scope),
 		// stop:       true,
+		scopeLimiter: tproxy.NewLimiter(),
 		Proxies: config.ScopeProxies{
 			Proxies:      make(map[string][]config.Proxy),
 			ProxyProgram: []string{},
@@ -179,6 +199,21 @@ func (mgr *proxyPrv) loadConfig() {
 	logger.Debugf("[%s] load config success, config: %v", mgr.scope, mgr.Proxies)
 }
 
+// save current proxy, new connections will use it
+func (mgr *proxyPrv) setCurrentProxy(proxyTyp tproxy.ProtoTyp, proxy config.Proxy) {
+	mgr.proxyLock.Lock()
+	defer mgr.proxyLock.Unlock()
+	mgr.proxyTyp = proxyTyp
+	mgr.Proxy = proxy
+}
+
+// get current proxy
+func (mgr *proxyPrv) getCurrentProxy() (tproxy.ProtoTyp, config.Proxy) {
+	mgr.proxyLock.RLock()
+	defer mgr.proxyLock.RUnlock()
+	return mgr.proxyTyp, mgr.Proxy
+}
+
 func (mgr *proxyPrv) saveManager(manager *Manager) {
 	mgr.manager = manager
 }
@@ -231,7 +266,9 @@ func (mgr *proxyPrv) GetCGroups() (string, *dbus.Error) {
 }
 
 // add pid to proc
-func (mgr *proxyPrv) AddProc(pid int32) *dbus.Error {
+func (mgr *proxyPrv) AddProc(sender dbus.Sender, pid int32) (dbusErr *dbus.Error) {
+	audit := mgr.beginAudit(sender, "AddProc", pid)
+	defer func() { audit.end(dbusErr) }()
 	// controller
 	if mgr.controller == nil {
 		return dbusutil.ToError(errors.New("controller not exist"))
@@ -0,0 +1,101 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package proxy
+
+import (
+	"encoding/json"
+	"net"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/linuxdeepin/deepin-network-proxy/config"
+	"github.com/linuxdeepin/deepin-network-proxy/tproxy"
+	"github.com/linuxdeepin/go-lib/dbusutil"
+)
+
+const (
+	accessLogSize    = 10 * 1024 * 1024
+	accessLogBackups = 5
+)
+
+// one line of access log, written when connection closed
+type accessRecord struct {
+	Time        time.Time `json:"time"` // connection accepted
+	Scope       string    `json:"scope"`
+	Exe         string    `json:"exe,omitempty"`
+	Pid         int       `json:"pid,omitempty"`
+	Source      string    `json:"source"`
+	Destination string    `json:"destination"`      // original ip and port
+	Domain      string    `json:"domain,omitempty"` // from fake ip or sniff
+	Proxy       string    `json:"proxy"`            // name of upstream proxy
+	Proto       string    `json:"proto"`
+	Duration    float64   `json:"duration"` // seconds
+	Upload      int64     `json:"upload"`   // bytes from local to remote
+	Download    int64     `json:"download"` // bytes from remote to local
+	Reason      string    `json:"reason"`   // close reason or error
+}
+
+// set access log state
+func (mgr *proxyPrv) SetAccessLog(sender dbus.Sender, enable bool) (dbusErr *dbus.Error) {
+	audit := mgr.beginAudit(sender, "SetAccessLog", enable)
+	defer func() { audit.end(dbusErr) }()
+	mgr.Proxies.AccessLog = enable
+	err := mgr.writeConfig()
+	if err != nil {
+		logger.Warningf("[%s] write config failed, err: %v", mgr.scope, err)
+		return dbusutil.ToError(err)
+	}
+	return nil
+}
+
+// get access log state
+func (mgr *proxyPrv) GetAccessLog() (bool, *dbus.Error) {
+	return mgr.Proxies.AccessLog, nil
+}
+
+// begin record of connection, nil if access log is disabled
+func (mgr *proxyPrv) startAccess(start time.Time, pid int, exe string, proxyTyp tproxy.ProtoTyp, proxy config.Proxy,
+	lAddr net.Addr, rAddr net.Addr, realRAddr net.Addr) *accessRecord {
+	if !mgr.Proxies.AccessLog {
+		return nil
+	}
+	record := &accessRecord{
+		Time:        start,
+		Scope:       mgr.scope.String(),
+		Exe:         exe,
+		Pid:         pid,
+		Source:      lAddr.String(),
+		Destination: rAddr.String(),
+		Proxy:       proxy.Name,
+		Proto:       string(proxyTyp),
+	}
+	if domain, ok := realRAddr.(*tproxy.DomainAddr); ok {
+		record.Domain = domain.Domain
+	}
+	return record
+}
+
+// finish record and write it as one line, nil record is ignored
+func (mgr *proxyPrv) endAccess(record *accessRecord, upload int64, download int64, reason error) {
+	if record == nil {
+		return
+	}
+	record.Duration = time.Since(record.Time).Seconds()
+	record.Upload = upload
+	record.Download = download
+	record.Reason = "closed"
+	if reason != nil {
+		record.Reason = reason.Error()
+	}
+	buf, err := json.Marshal(record)
+	if err != nil {
+		logger.Warningf("[%s] marshal access record failed, err: %v", mgr.scope, err)
+		return
+	}
+	_, err = mgr.manager.accessLog.Write(append(buf, '\n'))
+	if err != nil {
+		logger.Warningf("[%s] write access log failed, err: %v", mgr.scope, err)
+	}
+}
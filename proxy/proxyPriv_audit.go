@@ -0,0 +1,256 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/linuxdeepin/deepin-network-proxy/com"
+	"github.com/linuxdeepin/deepin-network-proxy/config"
+	"github.com/linuxdeepin/deepin-network-proxy/define"
+	"github.com/linuxdeepin/go-lib/dbusutil"
+	"gopkg.in/yaml.v2"
+)
+
+// audit log keep at most auditLogSize * (auditLogBackups + 1) bytes, about 110MB,
+// records older than the last backup are dropped by rotation
+const (
+	auditLogSize    = 10 * 1024 * 1024
+	auditLogBackups = 10
+	// max records returned at once
+	auditLogMaxCount = 1000
+)
+
+// value of these keys is not written to audit log, only that it changed
+var auditSecretKeys = map[string]bool{
+	"password":       true,
+	"key":            true,
+	"key-passphrase": true,
+	"private-key":    true,
+	"preshared-key":  true,
+}
+
+// groups of administrator, who can read audit log
+var auditAdminGroups = []string{"sudo", "wheel"}
+
+// one line of audit log, written when mutating call returned
+type auditRecord struct {
+	Time   time.Time     `json:"time"`
+	Scope  string        `json:"scope"`
+	Method string        `json:"method"`
+	Args   []interface{} `json:"args,omitempty"`
+	Sender string        `json:"sender"`
+	Uid    uint32        `json:"uid"`
+	Pid    uint32        `json:"pid"`
+	Exe    string        `json:"exe,omitempty"`
+	Error  string        `json:"error,omitempty"`
+	Diff   []string      `json:"diff,omitempty"` // changed keys of proxy.yaml, as key: old -> new
+}
+
+// mutating call in progress
+type auditCall struct {
+	mgr    *proxyPrv
+	record auditRecord
+	before map[string]string
+}
+
+// begin audit of mutating call, config is saved to diff when call ended
+func (mgr *proxyPrv) beginAudit(sender dbus.Sender, method string, args ...interface{}) *auditCall {
+	call := &auditCall{
+		mgr: mgr,
+		record: auditRecord{
+			Time:   time.Now(),
+			Scope:  mgr.scope.String(),
+			Method: method,
+			Args:   args,
+			Sender: string(sender),
+		},
+		before: flattenProxies(mgr.Proxies),
+	}
+	if mgr.manager != nil && mgr.manager.sysService != nil && sender != "" {
+		service := mgr.manager.sysService
+		call.record.Uid, _ = service.GetConnUID(string(sender))
+		call.record.Pid, _ = service.GetConnPID(string(sender))
+		if call.record.Pid != 0 {
+			call.record.Exe, _ = os.Readlink(fmt.Sprintf("/proc/%v/exe", call.record.Pid))
+		}
+	}
+	return call
+}
+
+// write record with result and config diff
+func (call *auditCall) end(err *dbus.Error) {
+	mgr := call.mgr
+	if err != nil {
+		call.record.Error = err.Error()
+	}
+	call.record.Diff = diffProxies(call.before, flattenProxies(mgr.Proxies))
+	logger.Infof("[%s] audit: %s called by uid %v pid %v [%s], err: %v",
+		mgr.scope, call.record.Method, call.record.Uid, call.record.Pid, call.record.Exe, err)
+	buf, marshalErr := json.Marshal(call.record)
+	if marshalErr != nil {
+		logger.Warningf("[%s] marshal audit record failed, err: %v", mgr.scope, marshalErr)
+		return
+	}
+	if mgr.manager == nil || mgr.manager.auditLog == nil {
+		return
+	}
+	_, writeErr := mgr.manager.auditLog.Write(append(buf, '\n'))
+	if writeErr != nil {
+		logger.Warningf("[%s] write audit log failed, err: %v", mgr.scope, writeErr)
+	}
+}
+
+// get last count records of audit log as json lines, only administrator is allowed
+func (mgr *proxyPrv) GetAuditLog(sender dbus.Sender, count int32) (string, *dbus.Error) {
+	uid, err := mgr.manager.sysService.GetConnUID(string(sender))
+	if err != nil {
+		return "", dbusutil.ToError(err)
+	}
+	if !isAdmin(uid) {
+		logger.Warningf("[%s] uid %v is not allowed to read audit log", mgr.scope, uid)
+		return "", dbusutil.ToError(errors.New("permission denied"))
+	}
+	if count <= 0 || count > auditLogMaxCount {
+		count = auditLogMaxCount
+	}
+	dir, err := com.GetConfigDir()
+	if err != nil {
+		return "", dbusutil.ToError(err)
+	}
+	path := filepath.Join(dir, define.AuditLogName)
+	return string(bytes.Join(readAuditLog(path, mgr.scope, int(count)), []byte("\n"))), nil
+}
+
+// read last count records of scope, from current file to the oldest backup until enough
+func readAuditLog(path string, scope define.Scope, count int) [][]byte {
+	match := []byte(`"scope":"` + scope.String() + `"`)
+	var result [][]byte
+	for index := 0; index <= auditLogBackups && len(result) < count; index++ {
+		name := path
+		if index > 0 {
+			name = fmt.Sprintf("%s.%d", path, index)
+		}
+		buf, err := ioutil.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		var lines [][]byte
+		for _, line := range bytes.Split(bytes.TrimSpace(buf), []byte("\n")) {
+			if bytes.Contains(line, match) {
+				lines = append(lines, line)
+			}
+		}
+		// older file is before
+		result = append(lines, result...)
+	}
+	if len(result) > count {
+		result = result[len(result)-count:]
+	}
+	return result
+}
+
+// root or member of administrator group
+func isAdmin(uid uint32) bool {
+	if uid == 0 {
+		return true
+	}
+	u, err := user.LookupId(strconv.Itoa(int(uid)))
+	if err != nil {
+		return false
+	}
+	gids, err := u.GroupIds()
+	if err != nil {
+		return false
+	}
+	for _, name := range auditAdminGroups {
+		group, err := user.LookupGroup(name)
+		if err != nil {
+			continue
+		}
+		if com.MegaExist(gids, group.Gid) {
+			return true
+		}
+	}
+	return false
+}
+
+// flatten config as proxy.yaml keys, as proxies.http[0].server
+func flattenProxies(proxies config.ScopeProxies) map[string]string {
+	result := make(map[string]string)
+	buf, err := yaml.Marshal(proxies)
+	if err != nil {
+		return result
+	}
+	var value interface{}
+	if yaml.Unmarshal(buf, &value) != nil {
+		return result
+	}
+	flattenValue("", value, result)
+	return result
+}
+
+func flattenValue(prefix string, value interface{}, result map[string]string) {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		for key, elem := range value {
+			name := fmt.Sprint(key)
+			if prefix != "" {
+				name = prefix + "." + name
+			}
+			flattenValue(name, elem, result)
+		}
+	case []interface{}:
+		for index, elem := range value {
+			flattenValue(fmt.Sprintf("%s[%d]", prefix, index), elem, result)
+		}
+	case nil:
+	default:
+		result[prefix] = fmt.Sprint(value)
+	}
+}
+
+// changed keys, sorted, value of secret is hidden
+func diffProxies(before map[string]string, after map[string]string) []string {
+	var diff []string
+	add := func(key string, old string, now string) {
+		if auditSecretKeys[key[strings.LastIndexByte(key, '.')+1:]] {
+			if old != "<none>" {
+				old = "<secret>"
+			}
+			if now != "<removed>" {
+				now = "<secret>"
+			}
+		}
+		diff = append(diff, fmt.Sprintf("%s: %s -> %s", key, old, now))
+	}
+	for key, old := range before {
+		now, ok := after[key]
+		if !ok {
+			add(key, old, "<removed>")
+		} else if now != old {
+			add(key, old, now)
+		}
+	}
+	for key, now := range after {
+		if _, ok := before[key]; !ok {
+			add(key, "<none>", now)
+		}
+	}
+	sort.Strings(diff)
+	return diff
+}
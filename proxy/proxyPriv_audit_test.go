@@ -0,0 +1,104 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/linuxdeepin/deepin-network-proxy/config"
+	"github.com/linuxdeepin/deepin-network-proxy/define"
+)
+
+// changed, added and removed keys are listed, secret value is never written
+func TestDiffProxies(t *testing.T) {
+	before := config.ScopeProxies{
+		Proxies: map[string][]config.Proxy{
+			"http":   {{Name: "a", Server: "1.1.1.1", Port: 80, Password: "old-secret"}},
+			"socks5": {{Name: "c", Server: "3.3.3.3", Port: 1080}},
+		},
+		TPort: 8080,
+	}
+	after := config.ScopeProxies{
+		Proxies: map[string][]config.Proxy{
+			"http": {{Name: "a", Server: "2.2.2.2", Port: 80, Password: "new-secret"}},
+			"wireguard": {{Name: "b", WireGuard: &config.WireGuardConfig{
+				PrivateKey: "private-secret",
+				Peers:      []config.WireGuardPeer{{PublicKey: "pub", PresharedKey: "psk-secret"}},
+			}}},
+		},
+	}
+	diff := diffProxies(flattenProxies(before), flattenProxies(after))
+	want := map[string]string{
+		"proxies.http[0].server":                                "1.1.1.1 -> 2.2.2.2",
+		"proxies.http[0].password":                              "<secret> -> <secret>",
+		"proxies.socks5[0].server":                              "3.3.3.3 -> <removed>",
+		"t-port":                                                "8080 -> 0",
+		"proxies.wireguard[0].wireguard.private-key":            "<none> -> <secret>",
+		"proxies.wireguard[0].wireguard.peers[0].preshared-key": "<none> -> <secret>",
+		"proxies.wireguard[0].wireguard.peers[0].public-key":    "<none> -> pub",
+	}
+	got := make(map[string]string)
+	for _, line := range diff {
+		if strings.Contains(line, "-secret") {
+			t.Errorf("secret is written in diff: %s", line)
+		}
+		index := strings.Index(line, ": ")
+		got[line[:index]] = line[index+2:]
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("diff of %s is %q, want %q", key, got[key], value)
+		}
+	}
+	if _, ok := got["proxies.http[0].port"]; ok {
+		t.Error("unchanged key is in diff")
+	}
+}
+
+// records are read from current file back to the oldest backup, until count reached
+func TestReadAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, define.AuditLogName)
+	record := func(scope define.Scope, index int) string {
+		return fmt.Sprintf(`{"scope":"%s","method":"m%d"}`, scope, index)
+	}
+	// path.3 is the oldest, path.2 is missing
+	files := map[string][]string{
+		path + ".3": {record(define.App, 1), record(define.Global, 2)},
+		path + ".1": {record(define.App, 3)},
+		path:        {record(define.Global, 4), record(define.App, 5)},
+	}
+	for name, lines := range files {
+		err = ioutil.WriteFile(name, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	toStrings := func(lines [][]byte) []string {
+		var result []string
+		for _, line := range lines {
+			result = append(result, string(line))
+		}
+		return result
+	}
+	all := toStrings(readAuditLog(path, define.App, 10))
+	if want := []string{record(define.App, 1), record(define.App, 3), record(define.App, 5)}; !reflect.DeepEqual(all, want) {
+		t.Errorf("records are %v, want %v", all, want)
+	}
+	last := toStrings(readAuditLog(path, define.App, 2))
+	if want := []string{record(define.App, 3), record(define.App, 5)}; !reflect.DeepEqual(last, want) {
+		t.Errorf("last records are %v, want %v", last, want)
+	}
+}
@@ -0,0 +1,102 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/linuxdeepin/deepin-network-proxy/define"
+	"github.com/linuxdeepin/deepin-network-proxy/tproxy"
+	"github.com/linuxdeepin/go-lib/dbusutil"
+)
+
+const (
+	captureMaxSize     = 1024 * 1024 * 1024
+	captureMaxDuration = time.Hour
+)
+
+// start capture of handlers which match filter, old capture is stopped,
+// max size in bytes and duration in seconds, 0 as default, return file path
+func (mgr *proxyPrv) StartCapture(sender dbus.Sender, exe string, domain string, srcAddr string, dstAddr string,
+	maxSize int64, duration int32) (path string, dbusErr *dbus.Error) {
+	audit := mgr.beginAudit(sender, "StartCapture", exe, domain, srcAddr, dstAddr, maxSize, duration)
+	defer func() { audit.end(dbusErr) }()
+	if maxSize < 0 || maxSize > captureMaxSize {
+		return "", dbusutil.ToError(fmt.Errorf("max size should be in [0, %v]", int64(captureMaxSize)))
+	}
+	if duration < 0 || time.Duration(duration)*time.Second > captureMaxDuration {
+		return "", dbusutil.ToError(fmt.Errorf("duration should be in [0, %v]", int(captureMaxDuration.Seconds())))
+	}
+	filter := tproxy.CaptureFilter{
+		Exe:    exe,
+		Domain: domain,
+		Key: tproxy.HandlerKey{
+			SrcAddr: srcAddr,
+			DstAddr: dstAddr,
+		},
+	}
+	name := fmt.Sprintf("%s-%s.pcapng", mgr.scope, time.Now().Format("20060102-150405.000"))
+	capture, err := tproxy.NewCapture(filepath.Join(define.CaptureDir, name), filter, maxSize, time.Duration(duration)*time.Second)
+	if err != nil {
+		logger.Warningf("[%s] start capture failed, err: %v", mgr.scope, err)
+		return "", dbusutil.ToError(err)
+	}
+	mgr.captureLock.Lock()
+	old := mgr.capture
+	mgr.capture = capture
+	mgr.captureLock.Unlock()
+	if old != nil {
+		_ = old.Close()
+	}
+	return capture.Path(), nil
+}
+
+// stop current capture, handlers captured already stop writing too
+func (mgr *proxyPrv) StopCapture(sender dbus.Sender) (dbusErr *dbus.Error) {
+	audit := mgr.beginAudit(sender, "StopCapture")
+	defer func() { audit.end(dbusErr) }()
+	mgr.captureLock.Lock()
+	capture := mgr.capture
+	mgr.capture = nil
+	mgr.captureLock.Unlock()
+	if capture == nil {
+		return dbusutil.ToError(errors.New("no capture is running"))
+	}
+	err := capture.Close()
+	if err != nil {
+		return dbusutil.ToError(err)
+	}
+	return nil
+}
+
+// check if capture filter need executable of connection
+func (mgr *proxyPrv) captureNeedExe() bool {
+	mgr.captureLock.Lock()
+	defer mgr.captureLock.Unlock()
+	return mgr.capture != nil && mgr.capture.NeedExe()
+}
+
+// get capture if handler match, nil if not
+func (mgr *proxyPrv) matchCapture(exe string, rAddr net.Addr, key tproxy.HandlerKey) *tproxy.Capture {
+	mgr.captureLock.Lock()
+	capture := mgr.capture
+	mgr.captureLock.Unlock()
+	if capture == nil {
+		return nil
+	}
+	var domain string
+	if addr, ok := rAddr.(*tproxy.DomainAddr); ok {
+		domain = addr.Domain
+	}
+	if !capture.Match(exe, domain, key) {
+		return nil
+	}
+	return capture
+}
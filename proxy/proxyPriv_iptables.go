@@ -7,6 +7,7 @@ package proxy
 import (
 	"errors"
 	"fmt"
+	"net"
 	"strconv"
 
 	"github.com/linuxdeepin/deepin-network-proxy/define"
@@ -40,18 +41,11 @@ func (mgr *proxyPrv) createTable() error {
 		mark = true
 	}
 
-	// command line
-	// iptables -t mangle -I main $1 -p tcp -m cgroup --path app.slice/global.slice -j app/global
+	// command line, protocol is matched in child chain
+	// iptables -t mangle -I main $1 -m cgroup --path app.slice/global.slice -j app/global
 	cpl := &iptables.CompleteRule{
 		// -j app/global
 		Action: mgr.scope.String(),
-		// base rules slice         -p tcp
-		BaseSl: []iptables.BaseRule{
-			{
-				Match: "p",
-				Param: "tcp",
-			},
-		},
 		// extends rules slice       -m cgroup --path app.slice/global.slice
 		ExtendsSl: []iptables.ExtendsRule{
 			{
@@ -102,6 +96,14 @@ func (mgr *proxyPrv) createTable() error {
 						Base:  iptables.BaseRule{Not: mark, Match: "path", Param: mgr.controller.GetName()},
 					},
 				},
+				// dns query of proxy self must not be answered by fake dns, in case proxy loop
+				{
+					Match: "m",
+					Elem: iptables.ExtendsElem{
+						Match: "mark",
+						Base:  iptables.BaseRule{Not: true, Match: "mark", Param: strconv.Itoa(define.ProxyMark)},
+					},
+				},
 			},
 		}
 
@@ -122,22 +124,63 @@ func (mgr *proxyPrv) appendRule() error {
 		logger.Warningf("[%s] cant add rule, chain is nil", mgr.scope)
 		return errors.New("chain is nil")
 	}
-	// iptables -t mangle -A App_Proxy -j MARK --set-mark $2
+	// lan and reserved address dont need proxy
+	// iptables -t mangle -A App -j RETURN -d 192.168.0.0/16
+	for _, cpl := range mgr.getBypassRules() {
+		err := selfChain.AppendRule(cpl)
+		if err != nil {
+			return err
+		}
+	}
+	// excluded ports dont need proxy
+	// iptables -t mangle -A App -j RETURN -p tcp -m multiport --dports 22,25
+	for _, cpl := range mgr.getPortRules(iptables.RETURN, nil, mgr.Proxies.ExcludePorts) {
+		err := selfChain.AppendRule(cpl)
+		if err != nil {
+			return err
+		}
+	}
+	// dns is redirected to dns proxy by nat table, dont capture it as udp
+	// iptables -t mangle -A App -j RETURN -p udp --dport 53
+	if mgr.Proxies.DNSPort != 0 && mgr.udpHandler != nil {
+		err := selfChain.AppendRule(&iptables.CompleteRule{
+			Action: iptables.RETURN,
+			BaseSl: []iptables.BaseRule{{Match: "p", Param: "udp"}, {Match: "-dport", Param: "53"}},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	// iptables -t mangle -A App_Proxy -j MARK --set-mark $2 -p tcp
 	base := iptables.BaseRule{
 		Match: "-set-mark",
 		Param: strconv.Itoa(mgr.Proxies.TPort),
 	}
-	// one complete rule
-	cpl := &iptables.CompleteRule{
-		// -j MARK
-		Action: iptables.MARK,
-		// --set-mark $2
-		BaseSl: []iptables.BaseRule{base},
+	// only mark capture ports if set
+	// iptables -t mangle -A App -j MARK --set-mark $2 -p tcp -m multiport --dports 80,443
+	cplSl := mgr.getPortRules(iptables.MARK, []iptables.BaseRule{base}, mgr.Proxies.CapturePorts)
+	// dont capture all if user only want some ports
+	if len(cplSl) == 0 && len(mgr.Proxies.CapturePorts) != 0 {
+		logger.Warningf("[%s] capture ports %v are all invalid", mgr.scope, mgr.Proxies.CapturePorts)
+		return fmt.Errorf("capture ports %v are all invalid", mgr.Proxies.CapturePorts)
+	}
+	if len(cplSl) == 0 {
+		for _, proto := range mgr.getCaptureProtos() {
+			// one complete rule
+			cplSl = append(cplSl, &iptables.CompleteRule{
+				// -j MARK
+				Action: iptables.MARK,
+				// --set-mark $2 -p tcp
+				BaseSl: []iptables.BaseRule{base, {Match: "p", Param: proto}},
+			})
+		}
 	}
 	// append
-	err := selfChain.AppendRule(cpl)
-	if err != nil {
-		return err
+	for _, cpl := range cplSl {
+		err := selfChain.AppendRule(cpl)
+		if err != nil {
+			return err
+		}
 	}
 
 	// default chain
@@ -146,47 +189,114 @@ func (mgr *proxyPrv) appendRule() error {
 		logger.Warningf("[%s] cant add rule, chain is nil", mgr.scope)
 		return errors.New("chain is nil")
 	}
-	// iptables -t mangle -A PREROUTING -j TPROXY -m mark --mark $2 --on-port 8080
-	protoExtends := iptables.ExtendsRule{
-		// -m
-		Match: "p",
-		// mark --mark $2
-		Elem: iptables.ExtendsElem{
-			// mark
-			Match: "tcp",
-			// --mark $2
-			Base: iptables.BaseRule{
-				Match: "on-port", Param: strconv.Itoa(mgr.Proxies.TPort),
-			},
-		},
+	// iptables -t mangle -A PREROUTING -j TPROXY -p tcp --on-port 8080 -m mark --mark $2
+	for _, cpl := range mgr.getTProxyRules(mgr.getCaptureProtos()) {
+		err := defChain.AppendRule(cpl)
+		if err != nil {
+			return err
+		}
 	}
-	markExtends := iptables.ExtendsRule{
-		// -m
-		Match: "m",
-		// mark --mark $2
-		Elem: iptables.ExtendsElem{
-			// mark
-			Match: "mark",
-			// --mark $2
-			Base: iptables.BaseRule{
-				Match: "mark", Param: strconv.Itoa(mgr.Proxies.TPort),
+	return nil
+}
+
+// make bypass rules, -j RETURN -d 192.168.0.0/16
+func (mgr *proxyPrv) getBypassRules() []*iptables.CompleteRule {
+	var rules []*iptables.CompleteRule
+	for _, cidr := range mgr.Proxies.GetBypassCIDRs() {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			logger.Warningf("[%s] bypass cidr %s is invalid, err: %v", mgr.scope, cidr, err)
+			continue
+		}
+		rules = append(rules, &iptables.CompleteRule{
+			Action: iptables.RETURN,
+			BaseSl: []iptables.BaseRule{
+				{
+					Match: "d",
+					Param: ipNet.String(),
+				},
 			},
-		},
+		})
 	}
-	// one complete rule
-	cpl = &iptables.CompleteRule{
-		// -j TPROXY
-		Action: iptables.TPROXY,
-		BaseSl: nil,
-		// -m mark --mark $2
-		ExtendsSl: []iptables.ExtendsRule{protoExtends, markExtends},
+	return rules
+}
+
+// get protocols captured by iptables, multiport match must be used with protocol
+func (mgr *proxyPrv) getCaptureProtos() []string {
+	// udp is captured only when listen udp
+	if mgr.udpHandler != nil {
+		return []string{"tcp", "udp"}
 	}
-	// append
-	err = defChain.AppendRule(cpl)
-	if err != nil {
-		return err
+	return []string{"tcp"}
+}
+
+// make t-proxy rules, -j TPROXY -p tcp --on-port 8080 -m mark --mark $2
+func (mgr *proxyPrv) getTProxyRules(protos []string) []*iptables.CompleteRule {
+	var rules []*iptables.CompleteRule
+	for _, proto := range protos {
+		protoExtends := iptables.ExtendsRule{
+			// -p
+			Match: "p",
+			// tcp --on-port $2
+			Elem: iptables.ExtendsElem{
+				// tcp
+				Match: proto,
+				// --on-port $2
+				Base: iptables.BaseRule{
+					Match: "on-port", Param: strconv.Itoa(mgr.Proxies.TPort),
+				},
+			},
+		}
+		markExtends := iptables.ExtendsRule{
+			// -m
+			Match: "m",
+			// mark --mark $2
+			Elem: iptables.ExtendsElem{
+				// mark
+				Match: "mark",
+				// --mark $2
+				Base: iptables.BaseRule{
+					Match: "mark", Param: strconv.Itoa(mgr.Proxies.TPort),
+				},
+			},
+		}
+		// one complete rule
+		rules = append(rules, &iptables.CompleteRule{
+			// -j TPROXY
+			Action: iptables.TPROXY,
+			BaseSl: nil,
+			// -p tcp --on-port $2 -m mark --mark $2
+			ExtendsSl: []iptables.ExtendsRule{protoExtends, markExtends},
+		})
 	}
-	return nil
+	return rules
+}
+
+// make destination port rules, -j RETURN -p tcp -m multiport --dports 22,25
+func (mgr *proxyPrv) getPortRules(action string, baseSl []iptables.BaseRule, ports []string) []*iptables.CompleteRule {
+	var rules []*iptables.CompleteRule
+	for _, proto := range mgr.getCaptureProtos() {
+		for _, group := range splitMultiPorts(ports) {
+			base := make([]iptables.BaseRule, len(baseSl), len(baseSl)+1)
+			copy(base, baseSl)
+			rules = append(rules, &iptables.CompleteRule{
+				Action: action,
+				// -p tcp
+				BaseSl: append(base, iptables.BaseRule{Match: "p", Param: proto}),
+				// -m multiport --dports 22,25
+				ExtendsSl: []iptables.ExtendsRule{
+					{
+						Match: "m",
+						Elem: iptables.ExtendsElem{
+							Match: "multiport",
+							Base:  iptables.BaseRule{Match: "dports", Param: group},
+						},
+					},
+				},
+			})
+		}
+	}
+	return rules
 }
 
 // delete chain and remove from parent
@@ -209,45 +319,14 @@ func (mgr *proxyPrv) releaseRule() error {
 		logger.Warningf("[%s] default chain is nil", mgr.scope)
 		return fmt.Errorf("[%s] default chain is nil", mgr.scope)
 	}
-	// iptables -t mangle -D PREROUTING -j TPROXY -m mark --mark $2 --on-port 8080
-	protoExtends := iptables.ExtendsRule{
-		// -m
-		Match: "p",
-		// mark --mark $2
-		Elem: iptables.ExtendsElem{
-			// mark
-			Match: "tcp",
-			// --mark $2
-			Base: iptables.BaseRule{
-				Match: "on-port", Param: strconv.Itoa(mgr.Proxies.TPort),
-			},
-		},
-	}
-	markExtends := iptables.ExtendsRule{
-		// -m
-		Match: "m",
-		// mark --mark $2
-		Elem: iptables.ExtendsElem{
-			// mark
-			Match: "mark",
-			// --mark $2
-			Base: iptables.BaseRule{
-				Match: "mark", Param: strconv.Itoa(mgr.Proxies.TPort),
-			},
-		},
-	}
-	// one complete rule
-	cpl := &iptables.CompleteRule{
-		// -j TPROXY
-		Action: iptables.TPROXY,
-		BaseSl: nil,
-		// -m mark --mark $2
-		ExtendsSl: []iptables.ExtendsRule{protoExtends, markExtends},
-	}
-	err = defChain.DelRule(cpl)
-	if err != nil {
-		logger.Warningf("[%s] delete rule failed, err: %v", mgr.scope, err)
-		return err
+	// iptables -t mangle -D PREROUTING -j TPROXY -p tcp --on-port 8080 -m mark --mark $2
+	// udp may not be captured, delete rule which not exist is ignored
+	for _, cpl := range mgr.getTProxyRules([]string{"tcp", "udp"}) {
+		err = defChain.DelRule(cpl)
+		if err != nil {
+			logger.Warningf("[%s] delete rule failed, err: %v", mgr.scope, err)
+			return err
+		}
 	}
 	return nil
 }
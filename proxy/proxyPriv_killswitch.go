@@ -0,0 +1,305 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package proxy
+
+import (
+	"errors"
+	"path/filepath"
+	"strconv"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/linuxdeepin/deepin-network-proxy/cgroups"
+	"github.com/linuxdeepin/deepin-network-proxy/com"
+	"github.com/linuxdeepin/deepin-network-proxy/define"
+	"github.com/linuxdeepin/deepin-network-proxy/iptables"
+	"github.com/linuxdeepin/go-lib/dbusutil"
+)
+
+/*
+	kill switch, drop all egress of proxied cgroup which not go through t-proxy,
+	rules live in filter table, independent with proxy start and stop,
+	so that app will not go direct when daemon died or proxy stopped
+
+	iptables -t filter -N App_KillSwitch
+	iptables -t filter -I OUTPUT 1 -j App_KillSwitch -m cgroup --path App.slice
+	iptables -t filter -A App_KillSwitch -j RETURN -o lo
+	iptables -t filter -A App_KillSwitch -j RETURN -m mark --mark 8090
+	iptables -t filter -A App_KillSwitch -j RETURN -m mark --mark 65536
+	iptables -t filter -A App_KillSwitch -j RETURN -d 192.168.0.0/16
+	iptables -t filter -A App_KillSwitch -j RETURN -p tcp -m multiport --dports 22
+	iptables -t filter -A App_KillSwitch -j RETURN -p tcp -m multiport ! --dports 80,443
+	iptables -t filter -A App_KillSwitch -j DROP
+*/
+
+// kill switch chain name
+func (mgr *proxyPrv) getKillSwitchName() string {
+	return mgr.scope.String() + "_KillSwitch"
+}
+
+// init kill switch according to config when daemon start
+func (mgr *proxyPrv) initKillSwitch() {
+	// rules may left when daemon died last time, clean first
+	_ = mgr.cleanKillSwitch()
+	if !mgr.Proxies.KillSwitch {
+		return
+	}
+	err := mgr.createKillSwitch()
+	if err != nil {
+		logger.Warningf("[%s] init kill switch failed, err: %v", mgr.scope, err)
+		return
+	}
+	logger.Debugf("[%s] init kill switch success", mgr.scope)
+}
+
+// enable or disable kill switch
+func (mgr *proxyPrv) SetKillSwitch(sender dbus.Sender, enable bool) (dbusErr *dbus.Error) {
+	audit := mgr.beginAudit(sender, "SetKillSwitch", enable)
+	defer func() { audit.end(dbusErr) }()
+	mgr.Proxies.KillSwitch = enable
+	err := mgr.applyKillSwitch()
+	if err != nil {
+		return dbusutil.ToError(err)
+	}
+	err = mgr.writeConfig()
+	if err != nil {
+		logger.Warningf("[%s] write config failed, err: %v", mgr.scope, err)
+		return dbusutil.ToError(err)
+	}
+	return nil
+}
+
+// get kill switch state
+func (mgr *proxyPrv) GetKillSwitch() (bool, *dbus.Error) {
+	return mgr.Proxies.KillSwitch, nil
+}
+
+// make rules match config
+func (mgr *proxyPrv) applyKillSwitch() error {
+	// t-port and bypass cidrs may changed
+	if mgr.Proxies.KillSwitch && mgr.killChain != nil {
+		err := mgr.updateKillSwitch()
+		if err != nil {
+			logger.Warningf("[%s] update kill switch failed, err: %v", mgr.scope, err)
+			return err
+		}
+		return nil
+	}
+	if !mgr.Proxies.KillSwitch && mgr.killChain == nil {
+		return nil
+	}
+	if mgr.Proxies.KillSwitch {
+		err := mgr.createKillSwitch()
+		if err != nil {
+			logger.Warningf("[%s] enable kill switch failed, err: %v", mgr.scope, err)
+			return err
+		}
+		logger.Infof("[%s] enable kill switch success", mgr.scope)
+		return nil
+	}
+	err := mgr.releaseKillSwitch()
+	if err != nil {
+		logger.Warningf("[%s] disable kill switch failed, err: %v", mgr.scope, err)
+		return err
+	}
+	logger.Infof("[%s] disable kill switch success", mgr.scope)
+	return nil
+}
+
+// create kill switch chain and rules
+func (mgr *proxyPrv) createKillSwitch() error {
+	chain := mgr.manager.filterMgr.GetChain("filter", "OUTPUT")
+	if chain == nil {
+		logger.Warningf("[%s] has no filter OUTPUT chain", mgr.scope)
+		return errors.New("has no filter OUTPUT chain")
+	}
+	// cgroup match need cgroup exist, kill switch may enable before proxy start
+	err := cgroups.GuaranteeCGroup(mgr.scope)
+	if err != nil {
+		return err
+	}
+	var mark bool
+	if mgr.scope == define.Global {
+		mark = true
+	}
+	// iptables -t filter -I OUTPUT 1 -j App_KillSwitch -m cgroup --path App.slice
+	cpl := &iptables.CompleteRule{
+		Action: mgr.getKillSwitchName(),
+		ExtendsSl: []iptables.ExtendsRule{
+			{
+				Match: "m",
+				Elem: iptables.ExtendsElem{
+					Match: "cgroup",
+					Base:  iptables.BaseRule{Not: mark, Match: "path", Param: mgr.scope.String() + ".slice"},
+				},
+			},
+		},
+	}
+	child, err := chain.CreateChild(mgr.getKillSwitchName(), 0, cpl)
+	if err != nil {
+		return err
+	}
+	mgr.killChain = child
+
+	rules := mgr.getKillSwitchRules()
+	// drop all left
+	// iptables -t filter -A App_KillSwitch -j DROP
+	rules = append(rules, &iptables.CompleteRule{Action: iptables.DROP})
+	for _, rule := range rules {
+		err = child.AppendRule(rule)
+		if err != nil {
+			// dont leave half rules
+			_ = mgr.releaseKillSwitch()
+			return err
+		}
+	}
+	return nil
+}
+
+// rules let traffic go, drop rule is appended after them
+func (mgr *proxyPrv) getKillSwitchRules() []*iptables.CompleteRule {
+	// loop back, including t-proxy redirected by ip rule
+	// iptables -t filter -A App_KillSwitch -j RETURN -o lo
+	rules := []*iptables.CompleteRule{
+		{
+			Action: iptables.RETURN,
+			BaseSl: []iptables.BaseRule{{Match: "o", Param: "lo"}},
+		},
+	}
+	// marked by t-proxy chain
+	// iptables -t filter -A App_KillSwitch -j RETURN -m mark --mark 8090
+	if mgr.Proxies.TPort != 0 {
+		rules = append(rules, &iptables.CompleteRule{
+			Action: iptables.RETURN,
+			ExtendsSl: []iptables.ExtendsRule{
+				{
+					Match: "m",
+					Elem: iptables.ExtendsElem{
+						Match: "mark",
+						Base:  iptables.BaseRule{Match: "mark", Param: strconv.Itoa(mgr.Proxies.TPort)},
+					},
+				},
+			},
+		})
+	}
+	// connection created by proxy self, as dial to proxy server
+	// iptables -t filter -A App_KillSwitch -j RETURN -m mark --mark 65536
+	rules = append(rules, &iptables.CompleteRule{
+		Action: iptables.RETURN,
+		ExtendsSl: []iptables.ExtendsRule{
+			{
+				Match: "m",
+				Elem: iptables.ExtendsElem{
+					Match: "mark",
+					Base:  iptables.BaseRule{Match: "mark", Param: strconv.Itoa(define.ProxyMark)},
+				},
+			},
+		},
+	})
+	// bypass address go direct, allow them
+	// iptables -t filter -A App_KillSwitch -j RETURN -d 192.168.0.0/16
+	rules = append(rules, mgr.getBypassRules()...)
+	// ports not proxied go direct, allow them, udp may be captured after start
+	excludeGroups := splitMultiPorts(mgr.Proxies.ExcludePorts)
+	captureGroups := splitMultiPorts(mgr.Proxies.CapturePorts)
+	for _, proto := range []string{"tcp", "udp"} {
+		// iptables -t filter -A App_KillSwitch -j RETURN -p tcp -m multiport --dports 22,25
+		for _, group := range excludeGroups {
+			rules = append(rules, &iptables.CompleteRule{
+				Action:    iptables.RETURN,
+				BaseSl:    []iptables.BaseRule{{Match: "p", Param: proto}},
+				ExtendsSl: []iptables.ExtendsRule{multiPortExtends(false, group)},
+			})
+		}
+		// only capture ports are proxied, port must be out of all groups
+		// iptables -t filter -A App_KillSwitch -j RETURN -p tcp -m multiport ! --dports 80,443
+		if len(captureGroups) == 0 {
+			continue
+		}
+		rule := &iptables.CompleteRule{
+			Action: iptables.RETURN,
+			BaseSl: []iptables.BaseRule{{Match: "p", Param: proto}},
+		}
+		for _, group := range captureGroups {
+			rule.ExtendsSl = append(rule.ExtendsSl, multiPortExtends(true, group))
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// -m multiport --dports 22,25
+func multiPortExtends(not bool, group string) iptables.ExtendsRule {
+	return iptables.ExtendsRule{
+		Match: "m",
+		Elem: iptables.ExtendsElem{
+			Match: "multiport",
+			Base:  iptables.BaseRule{Not: not, Match: "dports", Param: group},
+		},
+	}
+}
+
+// update rules of existing chain, new rules are inserted before stale ones are removed,
+// drop rule is kept at last all the time, so traffic dont go direct while update
+func (mgr *proxyPrv) updateKillSwitch() error {
+	rules := mgr.getKillSwitchRules()
+	keep := make(map[string]bool)
+	for index := len(rules) - 1; index >= 0; index-- {
+		keep[rules[index].String()] = true
+		// exist rule is skipped
+		err := mgr.killChain.InsertRule(0, rules[index])
+		if err != nil {
+			return err
+		}
+	}
+	keep[(&iptables.CompleteRule{Action: iptables.DROP}).String()] = true
+	var stale []*iptables.CompleteRule
+	for index := 0; index < mgr.killChain.GetRulesCount(); index++ {
+		rule := mgr.killChain.GetRuleByIndex(index)
+		if !keep[rule.String()] {
+			stale = append(stale, rule)
+		}
+	}
+	for _, rule := range stale {
+		err := mgr.killChain.DelRule(rule)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove kill switch chain
+func (mgr *proxyPrv) releaseKillSwitch() error {
+	if mgr.killChain == nil {
+		return nil
+	}
+	err := mgr.killChain.Remove()
+	if err != nil {
+		logger.Warningf("[%s] remove kill switch chain failed, err: %v", mgr.scope, err)
+		return err
+	}
+	mgr.killChain = nil
+	return nil
+}
+
+// clean kill switch left by last run
+func (mgr *proxyPrv) cleanKillSwitch() error {
+	// get config path
+	path, err := com.GetConfigDir()
+	if err != nil {
+		logger.Warningf("[%s] run kill switch clean failed, config err: %v", mgr.scope, err)
+		return err
+	}
+	// get script file path
+	path = filepath.Join(path, define.ScriptName)
+	// run script
+	buf, err := com.RunScript(path, []string{"clear_" + mgr.getKillSwitchName()})
+	if err != nil {
+		logger.Debugf("[%s] run kill switch clean script failed, out: %s, err: %v", mgr.scope, string(buf), err)
+		return err
+	}
+	logger.Debugf("[%s] run kill switch clean script success", mgr.scope)
+	return nil
+}
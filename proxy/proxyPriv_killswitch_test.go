@@ -0,0 +1,39 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package proxy
+
+import (
+	"testing"
+
+	"github.com/linuxdeepin/deepin-network-proxy/config"
+	"github.com/linuxdeepin/deepin-network-proxy/define"
+)
+
+// ports not proxied go direct, kill switch must not drop them
+func TestKillSwitchPortRules(t *testing.T) {
+	mgr := &proxyPrv{
+		scope: define.App,
+		Proxies: config.ScopeProxies{
+			TPort:        8090,
+			BypassCIDRs:  []string{},
+			ExcludePorts: []string{"22"},
+			CapturePorts: []string{"80", "443"},
+		},
+	}
+	got := make(map[string]bool)
+	for _, rule := range mgr.getKillSwitchRules() {
+		got[rule.String()] = true
+	}
+	for _, want := range []string{
+		"-j RETURN -p tcp -m multiport --dports 22",
+		"-j RETURN -p udp -m multiport --dports 22",
+		"-j RETURN -p tcp -m multiport ! --dports 80,443",
+		"-j RETURN -p udp -m multiport ! --dports 80,443",
+	} {
+		if !got[want] {
+			t.Errorf("rule [%s] is missing in %v", want, got)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package proxy
+
+import (
+	"errors"
+	"net"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/linuxdeepin/deepin-network-proxy/com"
+	"github.com/linuxdeepin/deepin-network-proxy/config"
+	"github.com/linuxdeepin/deepin-network-proxy/define"
+	"github.com/linuxdeepin/deepin-network-proxy/tproxy"
+	"github.com/linuxdeepin/go-lib/dbusutil"
+)
+
+// limit and current tunnel count, as json of GetLimits
+type limitState struct {
+	config.LimitConfig
+	Conns int
+}
+
+// make limiters match config, running tunnels follow new limit at once
+func (mgr *proxyPrv) applyLimits() {
+	mgr.limitLock.Lock()
+	defer mgr.limitLock.Unlock()
+	mgr.scopeLimiter.SetLimit(mgr.Proxies.Limit)
+	if mgr.appLimiters == nil {
+		mgr.appLimiters = make(map[string]*tproxy.Limiter)
+	}
+	for exe, limiter := range mgr.appLimiters {
+		if _, ok := mgr.Proxies.AppLimits[exe]; ok {
+			continue
+		}
+		// running tunnels still hold limiter, dont limit them any more
+		limiter.SetLimit(config.LimitConfig{})
+		delete(mgr.appLimiters, exe)
+	}
+	for exe, limit := range mgr.Proxies.AppLimits {
+		limiter, ok := mgr.appLimiters[exe]
+		if !ok {
+			limiter = tproxy.NewLimiter()
+			mgr.appLimiters[exe] = limiter
+		}
+		limiter.SetLimit(limit)
+	}
+}
+
+// pid and executable of local socket, all processes are searched if access log or capture need it,
+// otherwise only processes of executables which have limit
+func (mgr *proxyPrv) getSocketOwner(lAddr net.Addr) (int, string) {
+	var match func(exe string) bool
+	if !mgr.Proxies.AccessLog && !mgr.captureNeedExe() {
+		mgr.limitLock.Lock()
+		count := len(mgr.appLimiters)
+		mgr.limitLock.Unlock()
+		if count == 0 {
+			return 0, ""
+		}
+		match = func(exe string) bool {
+			mgr.limitLock.Lock()
+			defer mgr.limitLock.Unlock()
+			_, ok := mgr.appLimiters[exe]
+			return ok
+		}
+	}
+	pid, exe, err := com.GetSocketOwner(lAddr, mgr.getScopePids(), match)
+	if err != nil {
+		logger.Debugf("[%s] get owner of [%s] failed, err: %v", mgr.scope, lAddr, err)
+		return 0, ""
+	}
+	return pid, exe
+}
+
+// pids of processes proxied by app scope, nil for global scope,
+// which proxy processes out of app cgroup, so that all processes are searched
+func (mgr *proxyPrv) getScopePids() []string {
+	if mgr.scope != define.App || mgr.controller == nil {
+		return nil
+	}
+	pids, err := mgr.controller.GetPids()
+	if err != nil {
+		logger.Debugf("[%s] get pids of cgroup failed, err: %v", mgr.scope, err)
+		return nil
+	}
+	return pids
+}
+
+// limiters of tunnel from executable
+func (mgr *proxyPrv) getLimiters(exe string) []*tproxy.Limiter {
+	limiters := []*tproxy.Limiter{mgr.scopeLimiter}
+	mgr.limitLock.Lock()
+	defer mgr.limitLock.Unlock()
+	if limiter, ok := mgr.appLimiters[exe]; ok && exe != "" {
+		limiters = append(limiters, limiter)
+	}
+	return limiters
+}
+
+// check if executable of connection is needed by app limit
+func (mgr *proxyPrv) limitNeedExe() bool {
+	mgr.limitLock.Lock()
+	defer mgr.limitLock.Unlock()
+	return len(mgr.appLimiters) != 0
+}
+
+// set limit of executable, set limit of scope if exe is empty, executable limit is removed if all is 0
+func (mgr *proxyPrv) SetLimit(sender dbus.Sender, exe string, upload int64, download int64, maxConns int32) (dbusErr *dbus.Error) {
+	audit := mgr.beginAudit(sender, "SetLimit", exe, upload, download, maxConns)
+	defer func() { audit.end(dbusErr) }()
+	if upload < 0 || download < 0 || maxConns < 0 {
+		return dbusutil.ToError(errors.New("limit should not be negative"))
+	}
+	limit := config.LimitConfig{
+		Upload:   upload,
+		Download: download,
+		MaxConns: int(maxConns),
+	}
+	// GetLimits and applyLimits read limits under lock, dbus calls may run at the same time
+	mgr.limitLock.Lock()
+	if exe == "" {
+		mgr.Proxies.Limit = limit
+	} else {
+		// copy on write, map may be marshaled by config writer
+		appLimits := make(map[string]config.LimitConfig, len(mgr.Proxies.AppLimits)+1)
+		for key, value := range mgr.Proxies.AppLimits {
+			appLimits[key] = value
+		}
+		if limit.IsZero() {
+			delete(appLimits, exe)
+		} else {
+			appLimits[exe] = limit
+		}
+		if len(appLimits) == 0 {
+			appLimits = nil
+		}
+		mgr.Proxies.AppLimits = appLimits
+	}
+	mgr.limitLock.Unlock()
+	mgr.applyLimits()
+	err := mgr.writeConfig()
+	if err != nil {
+		logger.Warningf("[%s] write config failed, err: %v", mgr.scope, err)
+		return dbusutil.ToError(err)
+	}
+	return nil
+}
+
+// get limits and tunnel count as json, key is executable, empty key is scope
+func (mgr *proxyPrv) GetLimits() (string, *dbus.Error) {
+	mgr.limitLock.Lock()
+	limits := map[string]limitState{
+		"": {LimitConfig: mgr.Proxies.Limit, Conns: mgr.scopeLimiter.Conns()},
+	}
+	for exe, limit := range mgr.Proxies.AppLimits {
+		state := limitState{LimitConfig: limit}
+		if limiter, ok := mgr.appLimiters[exe]; ok {
+			state.Conns = limiter.Conns()
+		}
+		limits[exe] = state
+	}
+	mgr.limitLock.Unlock()
+	buf, err := com.MarshalJson(limits)
+	if err != nil {
+		logger.Warningf("[%s] get limits failed, err: %v", mgr.scope, err)
+		return "", dbusutil.ToError(err)
+	}
+	return buf, nil
+}
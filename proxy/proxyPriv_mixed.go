@@ -0,0 +1,363 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/linuxdeepin/deepin-network-proxy/config"
+	"github.com/linuxdeepin/deepin-network-proxy/tproxy"
+)
+
+/*
+	mixed inbound, listen at 127.0.0.1:<mixed-port> and accept explicit proxy request,
+	protocol is detected by first byte, 0x05 sock5, 0x04 sock4 and sock4a, others http,
+	target is sent to current proxy as the same as t-proxy captured connection
+*/
+
+// local conn which read through buffered reader, data peeked when detect protocol should not lost
+type mixedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn *mixedConn) Read(buf []byte) (int, error) {
+	return conn.reader.Read(buf)
+}
+
+// write to remote through handler
+type remoteWriter struct {
+	handler tproxy.BaseHandler
+}
+
+func (writer remoteWriter) Write(buf []byte) (int, error) {
+	err := writer.handler.WriteRemote(buf)
+	if err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+// listen mixed port, only local is allowed
+func (mgr *proxyPrv) listenMixed() (net.Listener, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(mgr.Proxies.MixedPort))
+	if err != nil {
+		logger.Warningf("[%s] listen mixed port failed, err: %v", mgr.scope, err)
+		return nil, err
+	}
+	return l, nil
+}
+
+// accept explicit proxy request
+func (mgr *proxyPrv) acceptMixed(listen net.Listener) {
+	var delay time.Duration
+	for {
+		lConn, err := listen.Accept()
+		if err != nil {
+			if !mgr.Enabled || errors.Is(err, net.ErrClosed) {
+				logger.Debugf("[%s] stop mixed proxy break", mgr.scope)
+				break
+			}
+			// error as too many open files may last, dont spin
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > time.Second {
+				delay = time.Second
+			}
+			logger.Warningf("[%s] accept mixed failed, retry in %v, err: %v", mgr.scope, delay, err)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		// proxy may be switched, always use current one
+		proxyTyp, proxy := mgr.getCurrentProxy()
+		go mgr.proxyMixed(proxyTyp, proxy, lConn)
+	}
+}
+
+// detect protocol and proxy
+func (mgr *proxyPrv) proxyMixed(proxyTyp tproxy.ProtoTyp, proxy config.Proxy, lConn net.Conn) {
+	conn := &mixedConn{
+		Conn:   lConn,
+		reader: bufio.NewReader(lConn),
+	}
+	buf, err := conn.reader.Peek(1)
+	if err != nil {
+		_ = lConn.Close()
+		return
+	}
+	switch buf[0] {
+	case 5:
+		err = mgr.proxySock5Inbound(proxyTyp, proxy, conn)
+	case 4:
+		err = mgr.proxySock4Inbound(proxyTyp, proxy, conn)
+	default:
+		err = mgr.proxyHttpInbound(proxyTyp, proxy, conn)
+	}
+	if err != nil {
+		logger.Infof("[%s] mixed proxy request from [%s] failed, err: %v", mgr.scope, lConn.RemoteAddr(), err)
+		_ = lConn.Close()
+	}
+}
+
+// create handler of mixed request, nil means handler of proxy type
+type mixedHandlerFunc func(key tproxy.HandlerKey, lAddr net.Addr, rAddr net.Addr, lConn net.Conn) tproxy.BaseHandler
+
+// create handler to target, reply is called after tunnel created or failed
+func (mgr *proxyPrv) tunnelMixed(proxyTyp tproxy.ProtoTyp, proxy config.Proxy, conn *mixedConn,
+	rAddr net.Addr, create mixedHandlerFunc, reply func(handler tproxy.BaseHandler, err error) error) error {
+	start := time.Now()
+	lAddr := conn.RemoteAddr()
+	pid, exe := mgr.getSocketOwner(lAddr)
+	realRAddr := mgr.getRealRAddr(rAddr)
+	logger.Infof("[%s] mixed request accept successfully, local[%s] -> remote [%s]", proxyTyp, lAddr, realRAddr)
+	record := mgr.startAccess(start, pid, exe, proxyTyp, proxy, lAddr, rAddr, realRAddr)
+	key := tproxy.HandlerKey{
+		SrcAddr: lAddr.String(),
+		DstAddr: realRAddr.String(),
+	}
+	limiters := mgr.getLimiters(exe)
+	err := tproxy.AcquireLimiters(limiters)
+	if err != nil {
+		mgr.endAccess(record, 0, 0, err)
+		_ = reply(nil, err)
+		return err
+	}
+	// capture payload of client side and upstream for debugging
+	var lConn net.Conn = conn
+	capture := mgr.matchCapture(exe, realRAddr, key)
+	if capture != nil {
+		// domain target has no ip, use mixed listen addr instead
+		server := rAddr
+		if _, ok := server.(*net.TCPAddr); !ok {
+			server = conn.LocalAddr()
+		}
+		lConn = capture.WrapLocal(conn, lAddr, server)
+	}
+	var handler tproxy.BaseHandler
+	if create != nil {
+		handler = create(key, lAddr, realRAddr, lConn)
+	} else {
+		handler = tproxy.NewHandler(proxyTyp, mgr.scope, key, proxy, lAddr, realRAddr, lConn)
+	}
+	if handler == nil {
+		tproxy.ReleaseLimiters(limiters)
+		err := fmt.Errorf("proxy [%s] dont support tcp", proxyTyp)
+		mgr.endAccess(record, 0, 0, err)
+		_ = reply(nil, err)
+		return err
+	}
+	// handler release limiters when closed
+	handler.SetLimiters(limiters)
+	handler.SetCapture(capture)
+	err = handler.Tunnel()
+	if err != nil {
+		mgr.endAccess(record, 0, 0, err)
+		_ = reply(nil, err)
+		handler.Close()
+		return err
+	}
+	err = reply(handler, nil)
+	if err != nil {
+		mgr.endAccess(record, 0, 0, err)
+		handler.Close()
+		return err
+	}
+	if record != nil {
+		handler.SetCloseHook(func(upload int64, download int64, reason error) {
+			mgr.endAccess(record, upload, download, reason)
+		})
+	}
+	handler.AddMgr(mgr.handlerMgr)
+	handler.Communicate()
+	return nil
+}
+
+// make remote addr from host and port
+func makeMixedAddr(host string, port int) net.Addr {
+	if ip := net.ParseIP(host); ip != nil {
+		return &net.TCPAddr{IP: ip, Port: port}
+	}
+	return tproxy.NewDomainAddr("tcp", host, port)
+}
+
+// sock5 inbound, only no auth and connect is supported
+func (mgr *proxyPrv) proxySock5Inbound(proxyTyp tproxy.ProtoTyp, proxy config.Proxy, conn *mixedConn) error {
+	// VER NMETHODS METHODS
+	buf := make([]byte, 262)
+	_, err := io.ReadFull(conn, buf[:2])
+	if err != nil {
+		return err
+	}
+	methods := buf[:buf[1]]
+	_, err = io.ReadFull(conn, methods)
+	if err != nil {
+		return err
+	}
+	// VER METHOD, only no auth is supported
+	if bytes.IndexByte(methods, 0) < 0 {
+		_, _ = conn.Write([]byte{5, 0xFF})
+		return fmt.Errorf("sock5 methods %v dont include no auth", methods)
+	}
+	_, err = conn.Write([]byte{5, 0})
+	if err != nil {
+		return err
+	}
+	// VER CMD RSV ATYP
+	_, err = io.ReadFull(conn, buf[:4])
+	if err != nil {
+		return err
+	}
+	cmd := buf[1]
+	var host string
+	switch buf[3] {
+	case 1:
+		_, err = io.ReadFull(conn, buf[:net.IPv4len])
+		host = net.IP(buf[:net.IPv4len]).String()
+	case 4:
+		_, err = io.ReadFull(conn, buf[:net.IPv6len])
+		host = net.IP(buf[:net.IPv6len]).String()
+	case 3:
+		_, err = io.ReadFull(conn, buf[:1])
+		if err == nil {
+			size := int(buf[0])
+			_, err = io.ReadFull(conn, buf[:size])
+			host = string(buf[:size])
+		}
+	default:
+		// address type not supported
+		_, _ = conn.Write([]byte{5, 8, 0, 1, 0, 0, 0, 0, 0, 0})
+		return fmt.Errorf("sock5 addr type %v is not supported", buf[3])
+	}
+	if err != nil {
+		return err
+	}
+	_, err = io.ReadFull(conn, buf[:2])
+	if err != nil {
+		return err
+	}
+	port := int(binary.BigEndian.Uint16(buf[:2]))
+	// udp associate and bind is not supported
+	if cmd != 1 {
+		_, _ = conn.Write([]byte{5, 7, 0, 1, 0, 0, 0, 0, 0, 0})
+		return fmt.Errorf("sock5 command %v is not supported", cmd)
+	}
+	return mgr.tunnelMixed(proxyTyp, proxy, conn, makeMixedAddr(host, port), nil, func(handler tproxy.BaseHandler, err error) error {
+		// general failure
+		code := byte(0)
+		if err != nil {
+			code = 1
+		}
+		_, err = conn.Write([]byte{5, code, 0, 1, 0, 0, 0, 0, 0, 0})
+		return err
+	})
+}
+
+// sock4 and sock4a inbound, only connect is supported
+func (mgr *proxyPrv) proxySock4Inbound(proxyTyp tproxy.ProtoTyp, proxy config.Proxy, conn *mixedConn) error {
+	// VN CD DSTPORT DSTIP
+	buf := make([]byte, 8)
+	_, err := io.ReadFull(conn, buf)
+	if err != nil {
+		return err
+	}
+	cmd := buf[1]
+	port := int(binary.BigEndian.Uint16(buf[2:4]))
+	ip := net.IP(append([]byte(nil), buf[4:8]...))
+	// USERID NULL
+	_, err = conn.reader.ReadString(0)
+	if err != nil {
+		return err
+	}
+	host := ip.String()
+	// sock4a, ip is 0.0.0.x, domain follows
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		domain, err := conn.reader.ReadString(0)
+		if err != nil {
+			return err
+		}
+		host = domain[:len(domain)-1]
+	}
+	if cmd != 1 {
+		_, _ = conn.Write([]byte{0, 0x5B, 0, 0, 0, 0, 0, 0})
+		return fmt.Errorf("sock4 command %v is not supported", cmd)
+	}
+	return mgr.tunnelMixed(proxyTyp, proxy, conn, makeMixedAddr(host, port), nil, func(handler tproxy.BaseHandler, err error) error {
+		// granted or rejected
+		code := byte(0x5A)
+		if err != nil {
+			code = 0x5B
+		}
+		_, err = conn.Write([]byte{0, code, 0, 0, 0, 0, 0, 0})
+		return err
+	})
+}
+
+// http inbound, connect and plain http proxy request
+func (mgr *proxyPrv) proxyHttpInbound(proxyTyp tproxy.ProtoTyp, proxy config.Proxy, conn *mixedConn) error {
+	req, err := http.ReadRequest(conn.reader)
+	if err != nil {
+		return err
+	}
+	host := req.Host
+	if req.Method != http.MethodConnect && req.URL.Host != "" {
+		host = req.URL.Host
+	}
+	if host == "" {
+		_, _ = conn.Write([]byte("HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+		return errors.New("http request has no host")
+	}
+	// default port
+	hostname, portStr, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname = host
+		portStr = "80"
+		if req.Method == http.MethodConnect {
+			portStr = "443"
+		}
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
+	}
+	rAddr := makeMixedAddr(hostname, port)
+
+	// http proxy can handle request self, including forward plain http, reply is sent by handler
+	if proxyTyp == tproxy.HTTP {
+		create := func(key tproxy.HandlerKey, lAddr net.Addr, rAddr net.Addr, lConn net.Conn) tproxy.BaseHandler {
+			handler := tproxy.NewHttpHandlerEProxy(mgr.scope, key, proxy, lAddr, rAddr, lConn)
+			handler.SetRequest(req)
+			return handler
+		}
+		return mgr.tunnelMixed(proxyTyp, proxy, conn, rAddr, create, func(handler tproxy.BaseHandler, err error) error {
+			return err
+		})
+	}
+	// other proxy use tunnel, plain http is sent in origin form
+	return mgr.tunnelMixed(proxyTyp, proxy, conn, rAddr, nil, func(handler tproxy.BaseHandler, err error) error {
+		if err != nil {
+			_, _ = conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+			return err
+		}
+		if req.Method == http.MethodConnect {
+			_, err = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+			return err
+		}
+		// tunnel is bound to one host, following request may be sent to another host
+		req.Close = true
+		req.Header.Del("Proxy-Authorization")
+		req.Header.Del("Proxy-Connection")
+		return req.Write(remoteWriter{handler: handler})
+	})
+}
@@ -0,0 +1,65 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package proxy
+
+import (
+	"encoding/json"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/linuxdeepin/deepin-network-proxy/com"
+	"github.com/linuxdeepin/go-lib/dbusutil"
+)
+
+// setting of scope not in SetProxies, as json, in case dbus signature changed
+type scopeOptions struct {
+	Sniff        bool     `json:"sniff"`
+	BypassCIDRs  []string `json:"bypass-cidrs"` // null as default
+	CapturePorts []string `json:"capture-ports"`
+	ExcludePorts []string `json:"exclude-ports"`
+	MixedPort    int      `json:"mixed-port"`
+}
+
+// set options of scope, rules and listeners take effect at next start
+func (mgr *proxyPrv) SetOptions(sender dbus.Sender, jsonOptions string) (dbusErr *dbus.Error) {
+	audit := mgr.beginAudit(sender, "SetOptions", jsonOptions)
+	defer func() { audit.end(dbusErr) }()
+	var options scopeOptions
+	err := json.Unmarshal([]byte(jsonOptions), &options)
+	if err != nil {
+		logger.Warningf("[%s] unmarshal options failed, err: %v", mgr.scope, err)
+		return dbusutil.ToError(err)
+	}
+	mgr.Proxies.Sniff = options.Sniff
+	mgr.Proxies.BypassCIDRs = options.BypassCIDRs
+	mgr.Proxies.CapturePorts = options.CapturePorts
+	mgr.Proxies.ExcludePorts = options.ExcludePorts
+	mgr.Proxies.MixedPort = options.MixedPort
+	// bypass cidrs of kill switch may changed
+	err = mgr.applyKillSwitch()
+	if err != nil {
+		return dbusutil.ToError(err)
+	}
+	err = mgr.writeConfig()
+	if err != nil {
+		logger.Warningf("[%s] write config failed, err: %v", mgr.scope, err)
+		return dbusutil.ToError(err)
+	}
+	return nil
+}
+
+// get options of scope as json
+func (mgr *proxyPrv) GetOptions() (string, *dbus.Error) {
+	buf, err := com.MarshalJson(scopeOptions{
+		Sniff:        mgr.Proxies.Sniff,
+		BypassCIDRs:  mgr.Proxies.BypassCIDRs,
+		CapturePorts: mgr.Proxies.CapturePorts,
+		ExcludePorts: mgr.Proxies.ExcludePorts,
+		MixedPort:    mgr.Proxies.MixedPort,
+	})
+	if err != nil {
+		return "", dbusutil.ToError(err)
+	}
+	return buf, nil
+}
@@ -0,0 +1,67 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package proxy
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/linuxdeepin/deepin-network-proxy/tproxy"
+	"github.com/linuxdeepin/go-lib/dbusutil"
+)
+
+// create tunnel to addr through proxy, return delay in milliseconds,
+// dial is limited by handshake timeout of proxy
+func (mgr *proxyPrv) TestProxy(proto string, name string, addr string) (int32, *dbus.Error) {
+	if strings.HasSuffix(proto, "-udp") {
+		return 0, dbusutil.ToError(errors.New("udp proxy cant be tested, test tcp proxy of the same server instead"))
+	}
+	proxyTyp, proxy, err := mgr.buildProxy(proto, name)
+	if err != nil {
+		return 0, dbusutil.ToError(err)
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0, dbusutil.ToError(err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return 0, dbusutil.ToError(err)
+	}
+	var rAddr net.Addr
+	if ip := net.ParseIP(host); ip != nil {
+		rAddr = &net.TCPAddr{IP: ip, Port: port}
+	} else {
+		rAddr = tproxy.NewDomainAddr("tcp", host, port)
+	}
+	// forward handler wait for request of local app, probe always use connect
+	proxy.HttpForward = false
+	lAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	// no local app, local side is only closed with handler
+	lConn, peer := net.Pipe()
+	defer peer.Close()
+	key := tproxy.HandlerKey{
+		SrcAddr: lAddr.String(),
+		DstAddr: addr,
+	}
+	handler := tproxy.NewHandler(proxyTyp, mgr.scope, key, proxy, lAddr, rAddr, lConn)
+	if handler == nil {
+		return 0, dbusutil.ToError(errors.New("proto is not supported"))
+	}
+	defer handler.Close()
+	start := time.Now()
+	err = handler.Tunnel()
+	if err != nil {
+		logger.Warningf("[%s] test proxy [%s] to [%s] failed, err: %v", mgr.scope, name, addr, err)
+		return 0, dbusutil.ToError(err)
+	}
+	delay := time.Since(start)
+	logger.Debugf("[%s] test proxy [%s] to [%s] success, delay: %v", mgr.scope, name, addr, delay)
+	return int32(delay / time.Millisecond), nil
+}
@@ -7,6 +7,7 @@ package proxy
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"io/ioutil"
 	"net"
 	"os"
@@ -14,6 +15,7 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/godbus/dbus/v5"
 	"github.com/linuxdeepin/deepin-network-proxy/cgroups"
@@ -23,6 +25,12 @@ import (
 	"github.com/linuxdeepin/go-lib/dbusutil"
 )
 
+// buffer of datagram read from tproxy socket, handler copy datagram it queued
+var udpBufferPool = com.NewBufferPool(64 * 1024)
+
+// wait for first data of local when sniff domain, server speak first protocol is delayed by it
+const sniffTimeout = 300 * time.Millisecond
+
 // interface path
 func (mgr *proxyPrv) GetInterfaceName() string {
 	return BusInterface + "." + mgr.scope.String()
@@ -30,10 +38,11 @@ func (mgr *proxyPrv) GetInterfaceName() string {
 
 // get proxy
 func (mgr *proxyPrv) GetProxy() (string, *dbus.Error) {
-	if mgr.Proxy.ProtoType == "" {
+	_, proxy := mgr.getCurrentProxy()
+	if proxy.ProtoType == "" {
 		return "", nil
 	}
-	buf, err := com.MarshalJson(mgr.Proxy)
+	buf, err := com.MarshalJson(proxy)
 	if err != nil {
 		logger.Warningf("[%s] get proxy failed, err: %v", mgr.scope, err)
 		return "", dbusutil.ToError(err)
@@ -42,7 +51,9 @@ func (mgr *proxyPrv) GetProxy() (string, *dbus.Error) {
 }
 
 // start proxy
-func (mgr *proxyPrv) StartProxy(sender dbus.Sender, proto string, name string, udp bool) *dbus.Error {
+func (mgr *proxyPrv) StartProxy(sender dbus.Sender, proto string, name string, udp bool) (dbusErr *dbus.Error) {
+	audit := mgr.beginAudit(sender, "StartProxy", proto, name, udp)
+	defer func() { audit.end(dbusErr) }()
 	con, err := dbusutil.NewSystemService()
 	if err != nil {
 		logger.Warningf("get session service failed, err: %v", err)
@@ -63,7 +74,7 @@ func (mgr *proxyPrv) StartProxy(sender dbus.Sender, proto string, name string, u
 	}
 	mgr.gid = uint32(gid)
 	if mgr.Enabled {
-		_ = mgr.StopProxy()
+		_ = mgr.stopProxy()
 	}
 
 	//// already in proxy
@@ -73,25 +84,14 @@ func (mgr *proxyPrv) StartProxy(sender dbus.Sender, proto string, name string, u
 	//}
 	//mgr.stop = false
 	logger.Debugf("[%s] start proxy, proto [%s] name [%s] udp [%v]", mgr.scope, proto, name, udp)
-	// check if proto is legal
-	var proxyTyp tproxy.ProtoTyp
-	if proto == "socks5" {
-		// never err
-		proxyTyp = tproxy.SOCKS5TCP
-	} else {
-		proxyTyp, err = tproxy.BuildProto(proto)
-		if err != nil {
-			return dbusutil.ToError(err)
-		}
-	}
-	// get proxies
-	proxy, err := mgr.Proxies.GetProxy(proto, name)
+	// check if proto is legal and get proxy
+	proxyTyp, proxy, err := mgr.buildProxy(proto, name)
 	if err != nil {
-		logger.Warningf("[%s] get proxy failed, err: %v", mgr.scope, err)
 		return dbusutil.ToError(err)
 	}
 	// save proxy
-	mgr.Proxy = proxy
+	mgr.setCurrentProxy(proxyTyp, proxy)
+	mgr.applyLimits()
 	logger.Debugf("[%s] get proxy success, proxy: %v", mgr.scope, proxy)
 	// tcp module
 	listen, err := mgr.listen()
@@ -102,18 +102,32 @@ func (mgr *proxyPrv) StartProxy(sender dbus.Sender, proto string, name string, u
 	mgr.tcpHandler = listen
 	logger.Debugf("[%s] proxy [%s] listen tcp success at port %v", mgr.scope, proto, mgr.Proxies.TPort)
 	// in case blocks DBus-return, use goroutine
-	go mgr.accept(proxyTyp, proxy, listen)
+	go mgr.accept(listen)
 
 	// udp module
-	if udp && proto == "sock5" {
+	if udp && proxyTyp.UdpProto() != tproxy.NoneProto {
 		// listen packet conn
 		packetConn, err := mgr.listenPacket()
 		if err != nil {
 			return dbusutil.ToError(err)
 		}
+		// save udp handler
+		mgr.udpHandler = packetConn
 		logger.Debugf("[%s] proxy [%s] listen udp success at port %v", mgr.scope, proto, mgr.Proxies.TPort)
 		// start proxy udp
-		go mgr.readMsgUDP(proxyTyp, proxy, packetConn)
+		go mgr.readMsgUDP(packetConn)
+	}
+
+	// mixed module, explicit proxy inbound
+	if mgr.Proxies.MixedPort != 0 {
+		mixedListen, err := mgr.listenMixed()
+		if err != nil {
+			return dbusutil.ToError(err)
+		}
+		// save mixed handler
+		mgr.mixedHandler = mixedListen
+		logger.Debugf("[%s] proxy [%s] listen mixed success at port %v", mgr.scope, proto, mgr.Proxies.MixedPort)
+		go mgr.acceptMixed(mixedListen)
 	}
 
 	// mark enable
@@ -135,8 +149,74 @@ func (mgr *proxyPrv) StartProxy(sender dbus.Sender, proto string, name string, u
 	return nil
 }
 
+// switch proxy, keep listener iptables ip rule and cgroup, only replace the proxy used by new connections
+func (mgr *proxyPrv) SwitchProxy(sender dbus.Sender, proto string, name string, killOld bool) (dbusErr *dbus.Error) {
+	audit := mgr.beginAudit(sender, "SwitchProxy", proto, name, killOld)
+	defer func() { audit.end(dbusErr) }()
+	if !mgr.Enabled {
+		logger.Warningf("[%s] switch proxy failed, proxy not started", mgr.scope)
+		return dbusutil.ToError(errors.New("proxy not started"))
+	}
+	logger.Debugf("[%s] switch proxy, proto [%s] name [%s] kill old [%v]", mgr.scope, proto, name, killOld)
+	// check if proto is legal and get proxy
+	proxyTyp, proxy, err := mgr.buildProxy(proto, name)
+	if err != nil {
+		return dbusutil.ToError(err)
+	}
+	oldTyp, oldProxy := mgr.getCurrentProxy()
+	// save old handler keys before switch, handlers created after switch will not be killed
+	var oldKeys []tproxy.HandlerKey
+	var oldUdpKeys []tproxy.HandlerKey
+	if killOld {
+		oldKeys = mgr.handlerMgr.GetTypHandlerKeys(oldTyp)
+		// udp relay belongs to the proxy too
+		if udpTyp := oldTyp.UdpProto(); udpTyp != tproxy.NoneProto {
+			oldUdpKeys = mgr.handlerMgr.GetTypHandlerKeys(udpTyp)
+		}
+	}
+	// new connections use new proxy from now on
+	mgr.setCurrentProxy(proxyTyp, proxy)
+	logger.Infof("[%s] switch proxy success, [%s] -> [%s]", mgr.scope, oldProxy.Name, proxy.Name)
+	// old handlers drain by default, kill them if needed
+	for _, key := range oldKeys {
+		mgr.handlerMgr.CloseBaseHandler(oldTyp, key)
+	}
+	for _, key := range oldUdpKeys {
+		mgr.handlerMgr.CloseBaseHandler(oldTyp.UdpProto(), key)
+	}
+	return nil
+}
+
+// check if proto is legal and get proxy from proxies
+func (mgr *proxyPrv) buildProxy(proto string, name string) (tproxy.ProtoTyp, config.Proxy, error) {
+	var proxyTyp tproxy.ProtoTyp
+	var err error
+	if proto == "socks5" {
+		// never err
+		proxyTyp = tproxy.SOCKS5TCP
+	} else {
+		proxyTyp, err = tproxy.BuildProto(proto)
+		if err != nil {
+			return tproxy.NoneProto, config.Proxy{}, err
+		}
+	}
+	// get proxies
+	proxy, err := mgr.Proxies.GetProxy(proto, name)
+	if err != nil {
+		logger.Warningf("[%s] get proxy failed, err: %v", mgr.scope, err)
+		return tproxy.NoneProto, config.Proxy{}, err
+	}
+	return proxyTyp, proxy, nil
+}
+
 // stop proxy
-func (mgr *proxyPrv) StopProxy() *dbus.Error {
+func (mgr *proxyPrv) StopProxy(sender dbus.Sender) (dbusErr *dbus.Error) {
+	audit := mgr.beginAudit(sender, "StopProxy")
+	defer func() { audit.end(dbusErr) }()
+	return mgr.stopProxy()
+}
+
+func (mgr *proxyPrv) stopProxy() *dbus.Error {
 	if !mgr.Enabled {
 		return nil
 	}
@@ -158,7 +238,24 @@ func (mgr *proxyPrv) StopProxy() *dbus.Error {
 		if err != nil {
 			logger.Warningf("[%s] stop proxy udp handler failed, err: %v", mgr.scope, err)
 		}
+		mgr.udpHandler = nil
+	}
+	if mgr.mixedHandler != nil {
+		err := mgr.mixedHandler.Close()
+		if err != nil {
+			logger.Warningf("[%s] stop proxy mixed handler failed, err: %v", mgr.scope, err)
+		}
+		mgr.mixedHandler = nil
 	}
+	// proxy may be switched, old handlers may still be draining
+	mgr.handlerMgr.CloseAll()
+	mgr.tcpHandler = nil
+	// userspace wireguard device is only used by this scope
+	tproxy.CloseWireGuard(mgr.scope)
+	tproxy.CloseSock5Pool(mgr.scope)
+	tproxy.CloseTransport(mgr.scope)
+	tproxy.CloseSsh(mgr.scope)
+	tproxy.ClearTLSConfigs()
 
 	mgr.Enabled = false
 
@@ -215,7 +312,9 @@ func (mgr *proxyPrv) attachBackUser() error {
 }
 
 // set proxy
-func (mgr *proxyPrv) AddProxy(proto string, name string, jsonProxy []byte) *dbus.Error {
+func (mgr *proxyPrv) AddProxy(sender dbus.Sender, proto string, name string, jsonProxy []byte) (dbusErr *dbus.Error) {
+	audit := mgr.beginAudit(sender, "AddProxy", proto, name)
+	defer func() { audit.end(dbusErr) }()
 	proxy, err := UnMarshalProxy(jsonProxy)
 	if err != nil {
 		logger.Warningf("[%s] unmarshal proxy message failed, err: %v", mgr.scope, err)
@@ -223,13 +322,42 @@ func (mgr *proxyPrv) AddProxy(proto string, name string, jsonProxy []byte) *dbus
 	}
 	// check if exist
 	mgr.Proxies.SetProxy(proto, name, proxy)
+	err = mgr.writeConfig()
+	if err != nil {
+		logger.Warningf("[%s] write config failed, err: %v", mgr.scope, err)
+		return dbusutil.ToError(err)
+	}
+	return nil
+}
+
+// delete proxy, current proxy keep working until switched or stopped
+func (mgr *proxyPrv) DelProxy(sender dbus.Sender, proto string, name string) (dbusErr *dbus.Error) {
+	audit := mgr.beginAudit(sender, "DelProxy", proto, name)
+	defer func() { audit.end(dbusErr) }()
+	err := mgr.Proxies.DelProxy(proto, name)
+	if err != nil {
+		logger.Warningf("[%s] delete proxy failed, err: %v", mgr.scope, err)
+		return dbusutil.ToError(err)
+	}
+	err = mgr.writeConfig()
+	if err != nil {
+		logger.Warningf("[%s] write config failed, err: %v", mgr.scope, err)
+		return dbusutil.ToError(err)
+	}
 	return nil
 }
 
 // set proxies
-func (mgr *proxyPrv) SetProxies(proxies config.ScopeProxies) *dbus.Error {
-	mgr.Proxies = proxies
-	err := mgr.writeConfig()
+func (mgr *proxyPrv) SetProxies(sender dbus.Sender, proxies config.DBusScopeProxies) (dbusErr *dbus.Error) {
+	audit := mgr.beginAudit(sender, "SetProxies")
+	defer func() { audit.end(dbusErr) }()
+	mgr.Proxies.MergeDBus(proxies)
+	// t-port of kill switch may changed
+	err := mgr.applyKillSwitch()
+	if err != nil {
+		return dbusutil.ToError(err)
+	}
+	err = mgr.writeConfig()
 	if err != nil {
 		logger.Warningf("[%s] write config failed, err: %v", mgr.scope, err)
 		return dbusutil.ToError(err)
@@ -237,7 +365,9 @@ func (mgr *proxyPrv) SetProxies(proxies config.ScopeProxies) *dbus.Error {
 	return nil
 }
 
-func (mgr *proxyPrv) ClearProxy() *dbus.Error {
+func (mgr *proxyPrv) ClearProxy(sender dbus.Sender) (dbusErr *dbus.Error) {
+	audit := mgr.beginAudit(sender, "ClearProxy")
+	defer func() { audit.end(dbusErr) }()
 	mgr.Proxies.Proxies = nil
 	err := mgr.writeConfig()
 	if err != nil {
@@ -315,7 +445,7 @@ func (mgr *proxyPrv) listenPacket() (net.PacketConn, error) {
 }
 
 // proxy tcp
-func (mgr *proxyPrv) accept(proxyTyp tproxy.ProtoTyp, proxy config.Proxy, listen net.Listener) {
+func (mgr *proxyPrv) accept(listen net.Listener) {
 	if listen == nil {
 		logger.Warningf("[%s] tcp listener is nil", mgr.scope)
 		return
@@ -331,19 +461,19 @@ func (mgr *proxyPrv) accept(proxyTyp tproxy.ProtoTyp, proxy config.Proxy, listen
 				logger.Debugf("[%s] stop proxy tcp break", mgr.scope)
 				break
 			}
-			logger.Warningf("[%s] accept socket failed, err: %v", proxyTyp, err)
+			logger.Warningf("[%s] accept socket failed, err: %v", mgr.scope, err)
 			break
 		}
+		// proxy may be switched, always use current one
+		proxyTyp, proxy := mgr.getCurrentProxy()
 		// proxy tcp
 		go mgr.proxyTcp(proxyTyp, proxy, lConn)
 	}
-	logger.Debugf("[%s] stop proxy, prepare close handler", mgr.scope)
-	mgr.handlerMgr.CloseTypHandler(proxyTyp)
-	mgr.tcpHandler = nil
+	logger.Debugf("[%s] stop accept tcp", mgr.scope)
 }
 
 // read udp message
-func (mgr *proxyPrv) readMsgUDP(proxyTyp tproxy.ProtoTyp, proxy config.Proxy, listen net.PacketConn) {
+func (mgr *proxyPrv) readMsgUDP(listen net.PacketConn) {
 	if listen == nil {
 		logger.Warningf("[%s] tcp listener is nil", mgr.scope)
 		return
@@ -355,18 +485,19 @@ func (mgr *proxyPrv) readMsgUDP(proxyTyp tproxy.ProtoTyp, proxy config.Proxy, li
 		return
 	}
 
-	defer func(){
-		if err := conn.Close(); err != nil{
+	defer func() {
+		if err := conn.Close(); err != nil {
 			logger.Warning("close conn failed, err: %v", err)
 		}
 	}()
 
+	// oob is parsed at once, can be reused
+	oob := make([]byte, 1024)
+	buf := udpBufferPool.Get()
 	// start accept until stop
 	for {
 		// read origin addr
-		buf := make([]byte, 512)
-		oob := make([]byte, 1024)
-		_, oobNum, _, lAddr, err := conn.ReadMsgUDP(buf, oob)
+		n, oobNum, _, lAddr, err := conn.ReadMsgUDP(*buf, oob)
 		if err != nil {
 			if !mgr.Enabled {
 				logger.Debugf("[%s] stop proxy udp break", mgr.scope)
@@ -386,94 +517,169 @@ func (mgr *proxyPrv) readMsgUDP(proxyTyp tproxy.ProtoTyp, proxy config.Proxy, li
 			IP:   rBaseAddr.IP,
 			Port: rBaseAddr.Port,
 		}
+		// proxy may be switched, only sock5 shadowsocks and trojan support udp
+		proxyTyp, proxy := mgr.getCurrentProxy()
+		udpTyp := proxyTyp.UdpProto()
+		if udpTyp == tproxy.NoneProto {
+			logger.Debugf("[%s] current proxy [%s] dont support udp, drop message", mgr.scope, proxyTyp)
+			continue
+		}
 		// proxy udp
-		go mgr.proxyUdp(proxy, lAddr, rAddr, buf)
+		mgr.proxyUdp(udpTyp, proxy, lAddr, rAddr, (*buf)[:n])
 	}
+	udpBufferPool.Put(buf)
 	logger.Debugf("[%s] stop proxy, prepare close handler", mgr.scope)
-	mgr.handlerMgr.CloseTypHandler(proxyTyp)
+	mgr.handlerMgr.CloseTypHandler(tproxy.SOCKS5UDP)
+	mgr.handlerMgr.CloseTypHandler(tproxy.SHADOWSOCKSUDP)
+	mgr.handlerMgr.CloseTypHandler(tproxy.TROJANUDP)
+	mgr.handlerMgr.CloseTypHandler(tproxy.WIREGUARDUDP)
 }
 
-// for t-proxy
-func (mgr *proxyPrv) proxyTcp(proxyTyp tproxy.ProtoTyp, proxy config.Proxy, lConn net.Conn) {
-	// request is redirect by t-proxy, output -> pre-routing
-	// at that time, the actual remote addr is conn`s local addr, the actual local addr is conn`s remote addr
-	// can use conn as fake remote conn, to connect with actual local connection
-	lAddr := lConn.RemoteAddr()
-	rAddr := lConn.LocalAddr()
-
-	realRAddr := rAddr
+// fake ip is mapped to domain, request domain from proxy server
+func (mgr *proxyPrv) getRealRAddr(rAddr net.Addr) net.Addr {
 	switch addr := rAddr.(type) {
 	case *net.UDPAddr:
 		domain, ok := mgr.dnsProxy.getDomainFromFakeIP(addr.IP)
 		if ok {
-			realRAddr = tproxy.NewDomainAddr("udp", domain, addr.Port)
+			return tproxy.NewDomainAddr("udp", domain, addr.Port)
 		}
 
 	case *net.TCPAddr:
 		domain, ok := mgr.dnsProxy.getDomainFromFakeIP(addr.IP)
 		if ok {
-			realRAddr = tproxy.NewDomainAddr("tcp", domain, addr.Port)
+			return tproxy.NewDomainAddr("tcp", domain, addr.Port)
+		}
+	}
+	return rAddr
+}
+
+// for t-proxy
+func (mgr *proxyPrv) proxyTcp(proxyTyp tproxy.ProtoTyp, proxy config.Proxy, lConn net.Conn) {
+	// request is redirect by t-proxy, output -> pre-routing
+	// at that time, the actual remote addr is conn`s local addr, the actual local addr is conn`s remote addr
+	// can use conn as fake remote conn, to connect with actual local connection
+	lAddr := lConn.RemoteAddr()
+	rAddr := lConn.LocalAddr()
+
+	start := time.Now()
+	pid, exe := mgr.getSocketOwner(lAddr)
+
+	realRAddr := mgr.getRealRAddr(rAddr)
+	// app may resolve domain itself, recover domain from first data
+	if tcpAddr, ok := realRAddr.(*net.TCPAddr); ok && mgr.Proxies.Sniff {
+		domain, err := tproxy.SniffDomain(lConn, sniffTimeout)
+		if err == nil {
+			realRAddr = tproxy.NewDomainAddr("tcp", domain, tcpAddr.Port)
+		} else {
+			logger.Debugf("[%s] sniff domain of [%s] failed, err: %v", mgr.scope, rAddr, err)
 		}
 	}
 
 	// print local -> remote
 	logger.Infof("[%s] tcp request capture by proxy successfully, "+
 		"local[%s] -> remote [%s](%s)", proxyTyp, lAddr.String(), rAddr.String(), realRAddr)
+	record := mgr.startAccess(start, pid, exe, proxyTyp, proxy, lAddr, rAddr, realRAddr)
+
+	// refuse before tunnel created if max connections reached
+	limiters := mgr.getLimiters(exe)
+	err := tproxy.AcquireLimiters(limiters)
+	if err != nil {
+		logger.Infof("[%s] refuse tcp request, local [%s] -> remote [%s], err: %v", mgr.scope, lAddr, rAddr, err)
+		mgr.endAccess(record, 0, 0, err)
+		_ = lConn.Close()
+		return
+	}
 
 	// make key to mark this connection
 	key := tproxy.HandlerKey{
 		SrcAddr: lAddr.String(),
 		DstAddr: rAddr.String(),
 	}
+	// capture payload of client side and upstream for debugging
+	capture := mgr.matchCapture(exe, realRAddr, key)
+	if capture != nil {
+		lConn = capture.WrapLocal(lConn, lAddr, rAddr)
+	}
 	// create new handler
 	handler := tproxy.NewHandler(proxyTyp, mgr.scope, key, proxy, lAddr, realRAddr, lConn)
+	// handler release limiters when closed
+	handler.SetLimiters(limiters)
+	handler.SetCapture(capture)
 	// create tunnel between proxy server and dst server
-	err := handler.Tunnel()
+	err = handler.Tunnel()
 	if err != nil {
 		logger.Warningf("[%s] create tunnel failed, err: %v", proxyTyp, err)
+		mgr.endAccess(record, 0, 0, err)
 		handler.Close()
 		return
 	}
+	if record != nil {
+		handler.SetCloseHook(func(upload int64, download int64, reason error) {
+			mgr.endAccess(record, upload, download, reason)
+		})
+	}
 	// add handler to map
 	handler.AddMgr(mgr.handlerMgr)
 	// begin communication
 	handler.Communicate()
 }
 
-func (mgr *proxyPrv) proxyUdp(proxy config.Proxy, lAddr net.Addr, rAddr net.Addr, buf []byte) {
-	// make a fake udp dial to cheat socket
-	lConn, err := com.MegaDial("udp", rAddr, lAddr)
-	if err != nil {
-		logger.Warningf("fake dial udp rAddr to lAddr failed, err: %v", err)
-		return
-	}
-	// make key to mark this connection
+// udp sessions from the same local addr share one association
+func (mgr *proxyPrv) proxyUdp(udpTyp tproxy.ProtoTyp, proxy config.Proxy, lAddr *net.UDPAddr, rAddr *net.UDPAddr, data []byte) {
+	// make key to mark this association
 	key := tproxy.HandlerKey{
 		SrcAddr: lAddr.String(),
-		DstAddr: rAddr.String(),
 	}
-	// create new handler
-	handler := tproxy.NewHandler(tproxy.SOCKS5UDP, mgr.scope, key, proxy, lAddr, rAddr, lConn)
-	// create tunnel between proxy server and dst server
-	err = handler.Tunnel()
-	if err != nil {
-		logger.Warningf("[%s] create tunnel failed, err: %v", tproxy.SOCKS5UDP, err)
-		handler.Close()
-		return
+	// fake ip is sent to proxy server as domain, reply is still sent from fake ip
+	realRAddr := mgr.getRealRAddr(rAddr)
+	base, ok := mgr.handlerMgr.GetHandler(udpTyp, key)
+	if !ok {
+		// exe is searched only if access log, capture filter or app limit need it
+		var pid int
+		var exe string
+		if mgr.Proxies.AccessLog || mgr.captureNeedExe() || mgr.limitNeedExe() {
+			pid, exe = mgr.getSocketOwner(lAddr)
+		}
+		// association is counted as one connection, datagram is dropped if max reached
+		limiters := mgr.getLimiters(exe)
+		err := tproxy.AcquireLimiters(limiters)
+		if err != nil {
+			logger.Debugf("[%s] drop udp message, local [%s] -> remote [%s], err: %v", mgr.scope, lAddr, realRAddr, err)
+			return
+		}
+		// create new handler, add to map before tunnel created, in case create twice
+		base = tproxy.NewHandler(udpTyp, mgr.scope, key, proxy, lAddr, realRAddr, nil)
+		// handler release limiters when closed
+		base.SetLimiters(limiters)
+		base.SetCapture(mgr.matchCapture(exe, realRAddr, key))
+		// each session is recorded when closed
+		if udpHandler, ok := base.(tproxy.UdpHandler); ok && mgr.Proxies.AccessLog {
+			udpHandler.SetSessionHook(func(stat tproxy.UdpSessionStat, reason error) {
+				record := mgr.startAccess(stat.Start, pid, exe, udpTyp, proxy, lAddr, stat.BindAddr, stat.RAddr)
+				mgr.endAccess(record, stat.Upload, stat.Download, reason)
+			})
+		}
+		base.AddMgr(mgr.handlerMgr)
+		go func() {
+			// create tunnel between proxy server and dst server
+			err := base.Tunnel()
+			if err != nil {
+				logger.Warningf("[%s] create tunnel failed, err: %v", udpTyp, err)
+				base.Remove()
+				return
+			}
+			// begin communication
+			base.Communicate()
+		}()
 	}
-	// add handler to map
-	handler.AddMgr(mgr.handlerMgr)
-	// begin communication
-	handler.Communicate()
-	// write first buf to rAddr
-	pkgData := com.DataPackage{
-		Addr: rAddr,
-		Data: buf,
+	handler, ok := base.(tproxy.UdpHandler)
+	if !ok {
+		logger.Warningf("[%s] handler type is not udp handler", mgr.scope)
+		return
 	}
-	// write first udp to remote
-	err = handler.WriteRemote(com.MarshalPackage(pkgData, "udp"))
+	// datagram is queued in order by handler until tunnel created
+	err := handler.WriteTo(rAddr, realRAddr, data)
 	if err != nil {
-		handler.Close()
-		return
+		logger.Debugf("[%s] write udp to remote [%s] failed, err: %v", mgr.scope, realRAddr, err)
 	}
 }
@@ -8,16 +8,33 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/miekg/dns"
 )
 
+// max queries kept in history
+const dnsHistorySize = 256
+
+// one query of dns proxy
+type dnsQuery struct {
+	Time   time.Time `json:"time"`
+	Domain string    `json:"domain"`
+	Type   string    `json:"type"`
+	Answer string    `json:"answer,omitempty"` // fake ip, empty if not answered
+}
+
 type proxyDNS struct {
 	prv    *proxyPrv
 	server *dns.Server
 
 	fIP   fakeIP
 	cache *fakeIPCache
+
+	// recent queries, oldest is dropped when full
+	history     []dnsQuery
+	historyLock sync.Mutex
 }
 
 func newProxyDNS(prv *proxyPrv) *proxyDNS {
@@ -25,7 +42,8 @@ func newProxyDNS(prv *proxyPrv) *proxyDNS {
 		prv: prv,
 	}
 
-	p.fIP = newFakeIP(net.IP{192, 168, 135, 0}, 24)
+	// use benchmark range rfc2544, in case conflict with lan address which may bypass proxy
+	p.fIP = newFakeIP(net.IP{198, 18, 0, 0}, 15)
 	p.cache = newFakeIPCache()
 
 	p.server = &dns.Server{
@@ -57,17 +75,47 @@ func (p *proxyDNS) getDomainFromFakeIP(ip net.IP) (string, bool) {
 
 func (p *proxyDNS) parseQuery(m *dns.Msg) {
 	for _, q := range m.Question {
+		query := dnsQuery{
+			Time:   time.Now(),
+			Domain: strings.TrimRight(q.Name, "."),
+			Type:   dns.TypeToString[q.Qtype],
+		}
 		switch q.Qtype {
 		case dns.TypeA:
 			ip := p.resolveDomain(q.Name)
 			rr, err := dns.NewRR(fmt.Sprintf("%s 0 A %s", q.Name, ip))
 			if err == nil {
 				m.Answer = append(m.Answer, rr)
+				query.Answer = ip.String()
 			}
 		case dns.TypeAAAA:
 			logger.Debugf("Query AAAA for %s", q.Name)
 		}
+		p.addHistory(query)
+	}
+}
+
+// save query to history
+func (p *proxyDNS) addHistory(query dnsQuery) {
+	p.historyLock.Lock()
+	defer p.historyLock.Unlock()
+	if len(p.history) >= dnsHistorySize {
+		p.history = append(p.history[:0], p.history[1:]...)
+	}
+	p.history = append(p.history, query)
+}
+
+// get last count queries, all if count is not positive
+func (p *proxyDNS) getHistory(count int) []dnsQuery {
+	p.historyLock.Lock()
+	defer p.historyLock.Unlock()
+	history := p.history
+	if count > 0 && len(history) > count {
+		history = history[len(history)-count:]
 	}
+	result := make([]dnsQuery, len(history))
+	copy(result, history)
+	return result
 }
 
 func (p *proxyDNS) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
@@ -0,0 +1,110 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package proxy
+
+import (
+	"sort"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/linuxdeepin/deepin-network-proxy/com"
+	"github.com/linuxdeepin/go-lib/dbusutil"
+)
+
+// state of scope
+type proxyStatus struct {
+	Scope       string `json:"scope"`
+	Enabled     bool   `json:"enabled"`
+	Proto       string `json:"proto,omitempty"`
+	Proxy       string `json:"proxy,omitempty"` // name of current proxy
+	TPort       int    `json:"t-port"`
+	DNSPort     int    `json:"dns-port"`
+	MixedPort   int    `json:"mixed-port"`
+	KillSwitch  bool   `json:"kill-switch"`
+	AccessLog   bool   `json:"access-log"`
+	Connections int    `json:"connections"`
+}
+
+// proxy in config, auth message is not included
+type proxySummary struct {
+	Proto   string `json:"proto"`
+	Name    string `json:"name"`
+	Server  string `json:"server"`
+	Port    int    `json:"port"`
+	Current bool   `json:"current"`
+}
+
+// get state of scope as json
+func (mgr *proxyPrv) GetStatus() (string, *dbus.Error) {
+	proxyTyp, proxy := mgr.getCurrentProxy()
+	status := proxyStatus{
+		Scope:       mgr.scope.String(),
+		Enabled:     mgr.Enabled,
+		TPort:       mgr.Proxies.TPort,
+		DNSPort:     mgr.Proxies.DNSPort,
+		MixedPort:   mgr.Proxies.MixedPort,
+		KillSwitch:  mgr.Proxies.KillSwitch,
+		AccessLog:   mgr.Proxies.AccessLog,
+		Connections: len(mgr.handlerMgr.Stats()),
+	}
+	if mgr.Enabled {
+		status.Proto = proxyTyp.String()
+		status.Proxy = proxy.Name
+	}
+	buf, err := com.MarshalJson(status)
+	if err != nil {
+		return "", dbusutil.ToError(err)
+	}
+	return buf, nil
+}
+
+// get all proxies of scope as json, sorted by proto
+func (mgr *proxyPrv) GetProxies() (string, *dbus.Error) {
+	_, current := mgr.getCurrentProxy()
+	protos := make([]string, 0, len(mgr.Proxies.Proxies))
+	for proto := range mgr.Proxies.Proxies {
+		protos = append(protos, proto)
+	}
+	sort.Strings(protos)
+	summaries := make([]proxySummary, 0)
+	for _, proto := range protos {
+		for _, proxy := range mgr.Proxies.Proxies[proto] {
+			summaries = append(summaries, proxySummary{
+				Proto:   proto,
+				Name:    proxy.Name,
+				Server:  proxy.Server,
+				Port:    proxy.Port,
+				Current: mgr.Enabled && proxy.Name == current.Name && proxy.Server == current.Server,
+			})
+		}
+	}
+	buf, err := com.MarshalJson(summaries)
+	if err != nil {
+		return "", dbusutil.ToError(err)
+	}
+	return buf, nil
+}
+
+// get active connections as json, sorted by start time
+func (mgr *proxyPrv) GetConnections() (string, *dbus.Error) {
+	stats := mgr.handlerMgr.Stats()
+	if stats == nil {
+		return "[]", nil
+	}
+	buf, err := com.MarshalJson(stats)
+	if err != nil {
+		return "", dbusutil.ToError(err)
+	}
+	return buf, nil
+}
+
+// get last count queries of dns proxy as json, all kept queries if count is 0
+func (mgr *proxyPrv) GetDNSHistory(count int32) (string, *dbus.Error) {
+	history := mgr.dnsProxy.getHistory(int(count))
+	buf, err := com.MarshalJson(history)
+	if err != nil {
+		return "", dbusutil.ToError(err)
+	}
+	return buf, nil
+}
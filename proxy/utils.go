@@ -9,6 +9,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/linuxdeepin/deepin-network-proxy/config"
@@ -62,3 +63,42 @@ func parseDesktopPath(app string) (string, error) {
 	}
 	return table, nil
 }
+
+// multiport match accept 15 ports at most, port range count as two
+const multiPortMax = 15
+
+// split ports to multiport groups, as [80 443 8000-9000] -> [80,443,8000:9000]
+func splitMultiPorts(ports []string) []string {
+	var groups []string
+	var group []string
+	var count int
+	for _, port := range ports {
+		port = strings.Replace(strings.TrimSpace(port), "-", ":", 1)
+		// check if port or port range valid
+		weight := 0
+		for _, elem := range strings.Split(port, ":") {
+			num, err := strconv.Atoi(elem)
+			if err != nil || num <= 0 || num > 65535 {
+				weight = 0
+				break
+			}
+			weight++
+		}
+		if weight == 0 {
+			logger.Warningf("port %s is invalid, ignore", port)
+			continue
+		}
+		// group full, start a new one
+		if count+weight > multiPortMax {
+			groups = append(groups, strings.Join(group, ","))
+			group = nil
+			count = 0
+		}
+		group = append(group, port)
+		count += weight
+	}
+	if len(group) != 0 {
+		groups = append(groups, strings.Join(group, ","))
+	}
+	return groups
+}
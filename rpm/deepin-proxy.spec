@@ -17,6 +17,14 @@ BuildRequires:  golang-github-linuxdeepin-go-x11-client-devel
 BuildRequires:  golang-github-linuxdeepin-go-dbus-factory-devel
 BuildRequires:  go-lib-devel
 BuildRequires:  go-gir-generator
+BuildRequires:  golang(github.com/xtaci/smux)
+BuildRequires:  golang(golang.org/x/crypto)
+BuildRequires:  golang(golang.org/x/net)
+BuildRequires:  golang(golang.org/x/sys)
+BuildRequires:  golang(golang.org/x/time)
+BuildRequires:  golang(golang.zx2c4.com/wireguard)
+BuildRequires:  golang(gvisor.dev/gvisor)
+BuildRequires:  golang(lukechampine.com/blake3)
 
 %description
 This is my first RPM package, which does nothing.
@@ -37,6 +45,7 @@ export GOPATH=/usr/share/gocode
 %{_datadir}/dbus-1/system.d/*
 %{_datadir}/dbus-1/system-services/*
 %{_libexecdir}/deepin-daemon/*
+%{_bindir}/dde-proxyctl
 
 %changelog
 # let's skip this for now
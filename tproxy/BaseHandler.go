@@ -5,10 +5,13 @@
 package tproxy
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"sort"
 	"sync"
 
+	"github.com/linuxdeepin/deepin-network-proxy/com"
 	"github.com/linuxdeepin/deepin-network-proxy/config"
 	"github.com/linuxdeepin/deepin-network-proxy/define"
 	"github.com/linuxdeepin/go-lib/log"
@@ -26,6 +29,10 @@ type BaseHandler interface {
 	Close()  // direct close handler
 	Remove() // remove self from map
 	AddMgr(mgr *HandlerMgr)
+	SetLimiters(limiters []*Limiter)
+	SetCloseHook(hook func(upload int64, download int64, reason error))
+	SetCapture(capture *Capture)
+	Stat() define.HandlerStat
 
 	// write and read
 	WriteRemote([]byte) error
@@ -44,6 +51,17 @@ const (
 	SOCKS4    ProtoTyp = "socks4"
 	SOCKS5TCP ProtoTyp = "socks5-tcp"
 	SOCKS5UDP ProtoTyp = "socks5-udp"
+
+	SHADOWSOCKS    ProtoTyp = "shadowsocks"
+	SHADOWSOCKSUDP ProtoTyp = "shadowsocks-udp"
+
+	SSH ProtoTyp = "ssh"
+
+	TROJAN    ProtoTyp = "trojan"
+	TROJANUDP ProtoTyp = "trojan-udp"
+
+	WIREGUARD    ProtoTyp = "wireguard"
+	WIREGUARDUDP ProtoTyp = "wireguard-udp"
 )
 
 func BuildProto(proto string) (ProtoTyp, error) {
@@ -58,6 +76,20 @@ func BuildProto(proto string) (ProtoTyp, error) {
 		return SOCKS5TCP, nil
 	case "socks5-udp":
 		return SOCKS5UDP, nil
+	case "shadowsocks":
+		return SHADOWSOCKS, nil
+	case "shadowsocks-udp":
+		return SHADOWSOCKSUDP, nil
+	case "ssh":
+		return SSH, nil
+	case "trojan":
+		return TROJAN, nil
+	case "trojan-udp":
+		return TROJANUDP, nil
+	case "wireguard":
+		return WIREGUARD, nil
+	case "wireguard-udp":
+		return WIREGUARDUDP, nil
 	default:
 		return NoneProto, fmt.Errorf("scope is invalid, scope: %v", proto)
 	}
@@ -75,11 +107,41 @@ func (Typ ProtoTyp) String() string {
 		return "socks5-tcp"
 	case SOCKS5UDP:
 		return "socks5-udp"
+	case SHADOWSOCKS:
+		return "shadowsocks"
+	case SHADOWSOCKSUDP:
+		return "shadowsocks-udp"
+	case SSH:
+		return "ssh"
+	case TROJAN:
+		return "trojan"
+	case TROJANUDP:
+		return "trojan-udp"
+	case WIREGUARD:
+		return "wireguard"
+	case WIREGUARDUDP:
+		return "wireguard-udp"
 	default:
 		return "unknown-proto"
 	}
 }
 
+// udp proto of tcp proto, NoneProto if udp is not supported
+func (Typ ProtoTyp) UdpProto() ProtoTyp {
+	switch Typ {
+	case SOCKS5TCP:
+		return SOCKS5UDP
+	case SHADOWSOCKS:
+		return SHADOWSOCKSUDP
+	case TROJAN:
+		return TROJANUDP
+	case WIREGUARD:
+		return WIREGUARDUDP
+	default:
+		return NoneProto
+	}
+}
+
 // proxy server
 type proxyServer struct {
 	server string
@@ -140,6 +202,18 @@ func (mgr *HandlerMgr) AddHandler(typ ProtoTyp, key HandlerKey, base BaseHandler
 	logger.Debugf("[%s] handler add to manager success, type: %v, key: %v", mgr.scope, typ, key)
 }
 
+// get handler according to proto and key
+func (mgr *HandlerMgr) GetHandler(typ ProtoTyp, key HandlerKey) (BaseHandler, bool) {
+	mgr.handlerLock.Lock()
+	defer mgr.handlerLock.Unlock()
+	baseMap, ok := mgr.handlerMap[typ]
+	if !ok {
+		return nil, false
+	}
+	base, ok := baseMap[key]
+	return base, ok
+}
+
 // close and remove base handler
 func (mgr *HandlerMgr) CloseBaseHandler(typ ProtoTyp, key HandlerKey) {
 	mgr.handlerLock.Lock()
@@ -176,9 +250,47 @@ func (mgr *HandlerMgr) CloseTypHandler(typ ProtoTyp) {
 	delete(mgr.handlerMap, typ)
 }
 
+// get handler keys according to proto
+func (mgr *HandlerMgr) GetTypHandlerKeys(typ ProtoTyp) []HandlerKey {
+	mgr.handlerLock.Lock()
+	defer mgr.handlerLock.Unlock()
+	baseMap, ok := mgr.handlerMap[typ]
+	if !ok {
+		return nil
+	}
+	keys := make([]HandlerKey, 0, len(baseMap))
+	for key := range baseMap {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// get state of all handlers, sorted by start time
+func (mgr *HandlerMgr) Stats() []define.HandlerStat {
+	mgr.handlerLock.Lock()
+	var stats []define.HandlerStat
+	for _, baseMap := range mgr.handlerMap {
+		for _, base := range baseMap {
+			stats = append(stats, base.Stat())
+		}
+	}
+	mgr.handlerLock.Unlock()
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Start.Before(stats[j].Start)
+	})
+	return stats
+}
+
 // close all handler
 func (mgr *HandlerMgr) CloseAll() {
-	for proto, _ := range mgr.handlerMap {
+	// copy protos, map cant be ranged without lock
+	mgr.handlerLock.Lock()
+	protos := make([]ProtoTyp, 0, len(mgr.handlerMap))
+	for proto := range mgr.handlerMap {
+		protos = append(protos, proto)
+	}
+	mgr.handlerLock.Unlock()
+	for _, proto := range protos {
 		mgr.CloseTypHandler(proto)
 	}
 }
@@ -187,6 +299,10 @@ func NewHandler(proto ProtoTyp, scope define.Scope, key HandlerKey, proxy config
 	// search proto
 	switch proto {
 	case HTTP:
+		// some proxy reject connect to port 80, plain http can be forwarded instead
+		if proxy.HttpForward && getAddrPort(rAddr) == 80 {
+			return NewHttpHandlerEProxy(scope, key, proxy, lAddr, rAddr, lConn)
+		}
 		return NewHttpHandler(scope, key, proxy, lAddr, rAddr, lConn)
 	case SOCKS4:
 		return NewSock4Handler(scope, key, proxy, lAddr, rAddr, lConn)
@@ -194,12 +310,73 @@ func NewHandler(proto ProtoTyp, scope define.Scope, key HandlerKey, proxy config
 		return NewTcpSock5Handler(scope, key, proxy, lAddr, rAddr, lConn)
 	case SOCKS5UDP:
 		return NewUdpSock5Handler(scope, key, proxy, lAddr, rAddr, lConn)
+	case SHADOWSOCKS:
+		return NewShadowsocksHandler(scope, key, proxy, lAddr, rAddr, lConn)
+	case SHADOWSOCKSUDP:
+		return NewUdpShadowsocksHandler(scope, key, proxy, lAddr, rAddr, lConn)
+	case SSH:
+		return NewSshHandler(scope, key, proxy, lAddr, rAddr, lConn)
+	case TROJAN:
+		return NewTrojanHandler(scope, key, proxy, lAddr, rAddr, lConn)
+	case TROJANUDP:
+		return NewUdpTrojanHandler(scope, key, proxy, lAddr, rAddr, lConn)
+	case WIREGUARD:
+		return NewWireGuardHandler(scope, key, proxy, lAddr, rAddr, lConn)
+	case WIREGUARDUDP:
+		return NewUdpWireGuardHandler(scope, key, proxy, lAddr, rAddr, lConn)
 	default:
 		logger.Warningf("unknown proto type: %v", proto)
 	}
 	return nil
 }
 
+// get port of tcp udp and domain addr
+func getAddrPort(addr net.Addr) int {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.Port
+	case *net.UDPAddr:
+		return addr.Port
+	case *DomainAddr:
+		return addr.Port
+	}
+	return 0
+}
+
+// socks address of remote, as ATYP DST.ADDR DST.PORT, addr may be tcp udp or domain addr
+func marshalSocksAddr(addr net.Addr) ([]byte, error) {
+	// reuse sock5 udp header, without RSV FRAG
+	msg := com.MarshalPackage(com.DataPackage{Addr: addr}, "udp")
+	if msg == nil {
+		return nil, fmt.Errorf("marshal socks addr failed, addr: %s", addr)
+	}
+	return msg[3:], nil
+}
+
+// parse socks address and the following payload
+func unmarshalSocksAddr(buf []byte) (com.DataPackage, error) {
+	// reuse sock5 udp header, without RSV FRAG
+	msg := make([]byte, 3, 3+len(buf))
+	return com.UnMarshalPackage(append(msg, buf...))
+}
+
+// length of socks address at the beginning of buf
+func socksAddrLen(buf []byte) (int, error) {
+	if len(buf) < 2 {
+		return 0, errors.New("socks addr is too short")
+	}
+	switch buf[0] {
+	case 1:
+		return 1 + net.IPv4len + 2, nil
+	case 4:
+		return 1 + net.IPv6len + 2, nil
+	case 3:
+		return 1 + 1 + int(buf[1]) + 2, nil
+	default:
+		return 0, fmt.Errorf("socks addr type %v is invalid", buf[0])
+	}
+}
+
 func init() {
 	logger = log.NewLogger("proxy/tproxy")
 }
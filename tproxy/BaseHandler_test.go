@@ -0,0 +1,62 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package tproxy
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/linuxdeepin/deepin-network-proxy/define"
+)
+
+// proto list used by clients without tproxy keep the same as BuildProto
+func TestProxyProtos(t *testing.T) {
+	for _, proto := range define.ProxyProtos {
+		// socks5 is special-cased by StartProxy
+		if proto == "socks5" {
+			continue
+		}
+		if _, err := BuildProto(proto); err != nil {
+			t.Errorf("proto %s is not accepted by BuildProto, err: %v", proto, err)
+		}
+	}
+}
+
+func TestSocksAddr(t *testing.T) {
+	addrs := []struct {
+		addr net.Addr
+		want []byte
+	}{
+		{&net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 53}, []byte{1, 1, 2, 3, 4, 0, 53}},
+		{&net.UDPAddr{IP: net.ParseIP("::1"), Port: 443}, append(append([]byte{4}, net.ParseIP("::1")...), 1, 0xBB)},
+		{NewDomainAddr("udp", "a.com", 80), []byte{3, 5, 'a', '.', 'c', 'o', 'm', 0, 80}},
+		// max length of domain
+		{NewDomainAddr("udp", strings.Repeat("a", 255), 80), append(append([]byte{3, 255}, strings.Repeat("a", 255)...), 0, 80)},
+	}
+	for _, elem := range addrs {
+		buf, err := marshalSocksAddr(elem.addr)
+		if err != nil || !bytes.Equal(buf, elem.want) {
+			t.Errorf("socks addr of %v is %x, want %x, err: %v", elem.addr, buf, elem.want, err)
+			continue
+		}
+		// length is known from the first two bytes
+		size, err := socksAddrLen(append(buf, "data"...))
+		if err != nil || size != len(elem.want) {
+			t.Errorf("socks addr length of %v is %v, want %v, err: %v", elem.addr, size, len(elem.want), err)
+		}
+	}
+	// domain length dont fit in one byte
+	if buf, err := marshalSocksAddr(NewDomainAddr("udp", strings.Repeat("a", 256), 80)); err == nil {
+		t.Errorf("socks addr of long domain is %x, want error", buf)
+	}
+	if _, err := socksAddrLen([]byte{3}); err == nil {
+		t.Error("length of truncated socks addr success")
+	}
+	if _, err := socksAddrLen([]byte{5, 0}); err == nil {
+		t.Error("length of invalid socks addr type success")
+	}
+}
@@ -5,12 +5,7 @@
 package tproxy
 
 import (
-	"bufio"
-	"encoding/base64"
-	"fmt"
 	"net"
-	"net/http"
-	"net/url"
 
 	"github.com/linuxdeepin/deepin-network-proxy/config"
 	"github.com/linuxdeepin/deepin-network-proxy/define"
@@ -45,50 +40,12 @@ func (handler *HttpHandler) Tunnel() error {
 	//	logger.Warning("[http] tunnel addr type is not tcp")
 	//	return errors.New("type is not tcp")
 	//}
-	// auth
-	auth := auth{
-		user:     handler.proxy.UserName,
-		password: handler.proxy.Password,
-	}
-	// create http head
-	req := &http.Request{
-		Method: http.MethodConnect,
-		Host:   handler.rAddr.String(),
-		URL: &url.URL{
-			Host: handler.rAddr.String(),
-		},
-		Header: http.Header{},
-	}
-	// check if need auth
-	if auth.user != "" && auth.password != "" {
-		authMsg := auth.user + ":" + auth.password
-		req.Header.Add("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(authMsg)))
-	}
-	// send connect request to rConn to create tunnel
-	logger.Infof("[http] req is %v", req)
-	err = req.Write(rConn)
+	// send connect request and auth if needed, connection may be replaced
+	rConn, err = handler.httpConnect(rConn, handler.rAddr.String())
 	if err != nil {
-		logger.Warningf("[http] write http tunnel request failed, err: %v", err)
+		logger.Warningf("[http] create http tunnel failed, err: %v", err)
 		return err
 	}
-	logger.Info("[http] write req success")
-	// read response
-	reader := bufio.NewReader(rConn)
-	resp, err := http.ReadResponse(reader, req)
-	if err != nil {
-		logger.Warningf("[http] read response failed, err: %v", err)
-		return err
-	} else {
-		logger.Info("[http] read response success")
-	}
-	logger.Debug(resp.Status)
-	// close body
-	defer resp.Body.Close()
-	// check if connect success
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("proxy response error, status code: %v, message: %s",
-			resp.StatusCode, resp.Status)
-	}
 	logger.Infof("[http] proxy: tunnel create success, [%s] -> [%s] -> [%s]",
 		handler.lAddr.String(), rConn.RemoteAddr(), handler.rAddr.String())
 	// save rConn handler
@@ -0,0 +1,54 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package tproxy
+
+import (
+	"net"
+
+	"github.com/linuxdeepin/deepin-network-proxy/config"
+	"github.com/linuxdeepin/deepin-network-proxy/define"
+)
+
+type ShadowsocksHandler struct {
+	handlerPrv
+}
+
+func NewShadowsocksHandler(scope define.Scope, key HandlerKey, proxy config.Proxy, lAddr net.Addr, rAddr net.Addr, lConn net.Conn) *ShadowsocksHandler {
+	// create new handler
+	handler := &ShadowsocksHandler{
+		handlerPrv: createHandlerPrv(SHADOWSOCKS, scope, key, proxy, lAddr, rAddr, lConn),
+	}
+	// add self to private parent
+	handler.saveParent(handler)
+	return handler
+}
+
+// create tunnel between proxy and server
+func (handler *ShadowsocksHandler) Tunnel() error {
+	aeadCipher, err := newSsCipher(handler.proxy.Method, handler.proxy.Key, handler.proxy.Password)
+	if err != nil {
+		logger.Warningf("[%s] create cipher failed, err: %v", handler.typ, err)
+		return err
+	}
+	// dial proxy server
+	rConn, err := handler.dialProxy()
+	if err != nil {
+		logger.Warningf("[%s] failed to dial proxy server, err: %v", handler.typ, err)
+		return err
+	}
+	// server never reply until data sent, header is sent at once in case remote speak first
+	conn := newSsConn(rConn, aeadCipher)
+	err = conn.writeHeader(handler.rAddr)
+	if err != nil {
+		logger.Warningf("[%s] send request header failed, err: %v", handler.typ, err)
+		_ = rConn.Close()
+		return err
+	}
+	logger.Infof("[%s] proxy: tunnel create success, [%s] -> [%s] -> [%s]",
+		handler.typ, handler.lAddr.String(), rConn.RemoteAddr(), handler.rAddr.String())
+	// save rConn handler
+	handler.rConn = conn
+	return nil
+}
@@ -30,28 +30,70 @@ func NewSock4Handler(scope define.Scope, key HandlerKey, proxy config.Proxy, lAd
 	return handler
 }
 
-func (handler *Sock4Handler) Tunnel() error {
-	// dial proxy server
-	rConn, err := handler.dialProxy()
-	if err != nil {
-		logger.Warningf("[sock4] failed to dial proxy server, err: %v", err)
-		return err
+// sock4 reply code
+const sock4Granted = 0x5A
+
+// sock4 reply error
+type Sock4Error byte
+
+const (
+	Sock4Rejected         Sock4Error = 0x5B // request rejected or failed
+	Sock4IdentUnreachable Sock4Error = 0x5C // proxy server cannot connect to identd on the client
+	Sock4IdentMismatch    Sock4Error = 0x5D // identd report different user id
+)
+
+func (e Sock4Error) Error() string {
+	switch e {
+	case Sock4Rejected:
+		return "sock4 request rejected or failed"
+	case Sock4IdentUnreachable:
+		return "sock4 request rejected, cannot connect to identd"
+	case Sock4IdentMismatch:
+		return "sock4 request rejected, user id mismatch"
+	default:
+		return fmt.Sprintf("sock4 unknown reply code: %#x", byte(e))
 	}
+}
+
+func (handler *Sock4Handler) Tunnel() error {
 	// check type
 	var port uint16
 	var ip net.IP
 	dominname := ""
 	switch addr := handler.rAddr.(type) {
 	case *net.TCPAddr:
+		port = uint16(addr.Port)
 		ip = addr.IP
 	case *DomainAddr:
 		port = uint16(addr.Port)
-		ip = net.IPv4(0x00, 0x00, 0x00, 0x01)
-		dominname = addr.Domain
+		if handler.proxy.Sock4a {
+			// socks4a, ip 0.0.0.x with x non-zero means domain follows
+			ip = net.IPv4(0x00, 0x00, 0x00, 0x01)
+			dominname = addr.Domain
+			break
+		}
+		// sock4 can only accept ipv4, resolve local
+		var err error
+		ip, err = handler.resolveIP4(addr.Domain)
+		if err != nil {
+			logger.Warningf("[sock4] resolve domain %s failed, err: %v", addr.Domain, err)
+			return err
+		}
 	default:
 		logger.Warning("[sock4] tunnel addr type is not tcp")
 		return errors.New("type is not tcp")
 	}
+	if ip.To4() == nil {
+		logger.Warningf("[sock4] ip %s is not ipv4", ip)
+		return fmt.Errorf("sock4 dont support ip %s", ip)
+	}
+
+	// dial proxy server
+	rConn, err := handler.dialProxy()
+	if err != nil {
+		logger.Warningf("[sock4] failed to dial proxy server, err: %v", err)
+		return err
+	}
 
 	// sock4 dont support password auth
 	auth := auth{
@@ -59,10 +101,10 @@ func (handler *Sock4Handler) Tunnel() error {
 	}
 	/*
 					sock4 connect request
-				+----+----+----+----+----+----+----+----+----+----+....+----+
-				| VN | CD | DSTPORT |      DSTIP        | USERID       |NULL|
-				+----+----+----+----+----+----+----+----+----+----+....+----+
-		           1    1      2              4           variable       1
+				+----+----+----+----+----+----+----+----+----+----+....+----+....+----+
+				| VN | CD | DSTPORT |      DSTIP        | USERID       |NULL| HOST |NULL|
+				+----+----+----+----+----+----+----+----+----+----+....+----+....+----+
+		           1    1      2              4           variable       1  socks4a   1
 	*/
 	buf := bytes.NewBuffer(nil)
 	buf.WriteByte(0x04) // sock version
@@ -95,16 +137,10 @@ func (handler *Sock4Handler) Tunnel() error {
 	_, err = rConn.Write(buf.Bytes())
 	if err != nil {
 		logger.Warningf("[sock4] send connect request failed, err: %v", err)
+		_ = rConn.Close()
 		return err
 	}
 
-	// resp
-	tmp := buf.Bytes()
-	_, err = io.ReadFull(rConn, tmp[0:2])
-	if err != nil {
-		logger.Warningf("[sock4] connect response failed, err: %v", err)
-		return err
-	}
 	/*
 					sock4 server response
 				+----+----+----+----+----+----+----+----+
@@ -113,20 +149,27 @@ func (handler *Sock4Handler) Tunnel() error {
 		          1    1      2              4
 
 	*/
-	// 0   0x5A
-	if tmp[0] != 0 || tmp[1] != 90 {
-		logger.Warningf("[sock4] proto is invalid, sock type: %v, code: %v", tmp[0], tmp[1])
-		return fmt.Errorf("sock4 proto is invalid, sock type: %v, code: %v", tmp[0], tmp[1])
-	}
-
-	// port and ip
-	_, err = io.ReadFull(rConn, tmp[0:6])
+	tmp := make([]byte, 8)
+	_, err = io.ReadFull(rConn, tmp)
 	if err != nil {
 		logger.Warningf("[sock4] connect response failed, err: %v", err)
+		_ = rConn.Close()
 		return err
 	}
+	// reply version should be 0, some server reply 4
+	if tmp[0] != 0 && tmp[0] != 4 {
+		logger.Warningf("[sock4] proto is invalid, sock type: %v, code: %v", tmp[0], tmp[1])
+		_ = rConn.Close()
+		return fmt.Errorf("sock4 proto is invalid, sock type: %v, code: %v", tmp[0], tmp[1])
+	}
+	// 0x5A
+	if tmp[1] != sock4Granted {
+		logger.Warningf("[sock4] connect request rejected, code: %#x", tmp[1])
+		_ = rConn.Close()
+		return Sock4Error(tmp[1])
+	}
 
-	logger.Debugf("[sock4] port and ip: %v", tmp[0:6])
+	logger.Debugf("[sock4] port and ip: %v", tmp[2:8])
 	logger.Debugf("[sock4] proxy: tunnel create success, [%s] -> [%s] -> [%s]",
 		handler.lConn.RemoteAddr(), rConn.RemoteAddr(), handler.rAddr.String())
 	// save rConn handler
@@ -0,0 +1,331 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package tproxy
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/linuxdeepin/deepin-network-proxy/config"
+	"github.com/linuxdeepin/deepin-network-proxy/define"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	// default ssh port
+	sshDefaultPort = 22
+	// interval to check if ssh connection is alive
+	sshKeepAliveInterval = 30 * time.Second
+)
+
+// ssh clients are shared by proxies with the same server and auth in scope
+type sshClientKey struct {
+	scope  define.Scope
+	server string
+	port   int
+	user   string
+	// auth material, proxy with other credentials dont reuse authenticated connection
+	auth string
+}
+
+// client in cache, ready is closed when dial and handshake finished
+type sshClientEntry struct {
+	ready  chan struct{}
+	client *ssh.Client
+	err    error
+}
+
+var sshClientMap = make(map[sshClientKey]*sshClientEntry)
+var sshClientLock sync.Mutex
+
+// close all ssh clients of scope
+func CloseSsh(scope define.Scope) {
+	var entries []*sshClientEntry
+	sshClientLock.Lock()
+	for key, entry := range sshClientMap {
+		if key.scope != scope {
+			continue
+		}
+		entries = append(entries, entry)
+		delete(sshClientMap, key)
+	}
+	sshClientLock.Unlock()
+	for _, entry := range entries {
+		// client still in handshake is closed by dialer, as it is not in cache anymore
+		select {
+		case <-entry.ready:
+			if entry.client != nil {
+				_ = entry.client.Close()
+			}
+		default:
+		}
+	}
+}
+
+// ssh handler, open direct-tcpip channel on shared ssh connection for each tcp connection
+type SshHandler struct {
+	handlerPrv
+}
+
+func NewSshHandler(scope define.Scope, key HandlerKey, proxy config.Proxy, lAddr net.Addr, rAddr net.Addr, lConn net.Conn) *SshHandler {
+	// ssh server use port 22 as default
+	if proxy.Port == 0 {
+		proxy.Port = sshDefaultPort
+	}
+	// create new handler
+	handler := &SshHandler{
+		handlerPrv: createHandlerPrv(SSH, scope, key, proxy, lAddr, rAddr, lConn),
+	}
+	// add self to private parent
+	handler.saveParent(handler)
+	return handler
+}
+
+// create tunnel between proxy and server
+func (handler *SshHandler) Tunnel() error {
+	client, err := handler.getClient()
+	if err != nil {
+		logger.Warningf("[%s] get ssh client failed, err: %v", handler.typ, err)
+		return err
+	}
+	// remote addr is resolved by ssh server if is domain
+	rConn, err := client.Dial("tcp", handler.rAddr.String())
+	if _, ok := err.(*ssh.OpenChannelError); err != nil && !ok {
+		// connection is broken but not noticed yet, reconnect once
+		logger.Infof("[%s] ssh connection is broken, reconnect, err: %v", handler.typ, err)
+		_ = client.Close()
+		handler.dropClient(client)
+		client, err = handler.getClient()
+		if err != nil {
+			logger.Warningf("[%s] get ssh client failed, err: %v", handler.typ, err)
+			return err
+		}
+		rConn, err = client.Dial("tcp", handler.rAddr.String())
+	}
+	if err != nil {
+		logger.Warningf("[%s] open direct-tcpip channel failed, err: %v", handler.typ, err)
+		return err
+	}
+	logger.Infof("[%s] proxy: tunnel create success, [%s] -> [%s] -> [%s]",
+		handler.typ, handler.lAddr.String(), client.RemoteAddr(), handler.rAddr.String())
+	// save rConn handler
+	handler.rConn = rConn
+	return nil
+}
+
+// key of ssh client, proxy with the same server and auth share one connection
+func (handler *SshHandler) clientKey() sshClientKey {
+	proxy := handler.proxy
+	return sshClientKey{
+		scope:  handler.scope,
+		server: proxy.Server,
+		port:   proxy.Port,
+		user:   proxy.UserName,
+		auth: strings.Join([]string{proxy.Password, proxy.KeyFile, proxy.KeyPassphrase,
+			proxy.AgentSocket, proxy.KnownHosts}, "\x00"),
+	}
+}
+
+// get ssh client from cache or create new one, lock is not held while dial,
+// handlers of the same key wait for the same dial
+func (handler *SshHandler) getClient() (*ssh.Client, error) {
+	key := handler.clientKey()
+	sshClientLock.Lock()
+	entry, ok := sshClientMap[key]
+	if ok {
+		sshClientLock.Unlock()
+		<-entry.ready
+		return entry.client, entry.err
+	}
+	entry = &sshClientEntry{ready: make(chan struct{})}
+	sshClientMap[key] = entry
+	sshClientLock.Unlock()
+
+	client, err := handler.newClient()
+	sshClientLock.Lock()
+	cached := sshClientMap[key] == entry
+	if err != nil && cached {
+		// failed dial is not cached, next handler try again
+		delete(sshClientMap, key)
+	}
+	sshClientLock.Unlock()
+	if err == nil && !cached {
+		// scope closed while dial
+		_ = client.Close()
+		client, err = nil, errors.New("ssh client is closed")
+	}
+	entry.client, entry.err = client, err
+	close(entry.ready)
+	if err != nil {
+		return nil, err
+	}
+	// remove from cache when connection lost
+	go func() {
+		err := client.Wait()
+		logger.Infof("[%s] ssh connection closed, server [%s@%s:%v], reason: %v",
+			handler.typ, key.user, key.server, key.port, err)
+		handler.dropClient(client)
+	}()
+	// dead connection is not always noticed by tcp, send keep alive request
+	go func() {
+		ticker := time.NewTicker(sshKeepAliveInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			if err != nil {
+				_ = client.Close()
+				return
+			}
+		}
+	}()
+	return client, nil
+}
+
+// remove client from cache, new client may be cached already
+func (handler *SshHandler) dropClient(client *ssh.Client) {
+	key := handler.clientKey()
+	sshClientLock.Lock()
+	defer sshClientLock.Unlock()
+	entry, ok := sshClientMap[key]
+	if !ok {
+		return
+	}
+	// entry in dial is not ready
+	select {
+	case <-entry.ready:
+		if entry.client == client {
+			delete(sshClientMap, key)
+		}
+	default:
+	}
+}
+
+// dial and authenticate ssh server
+func (handler *SshHandler) newClient() (*ssh.Client, error) {
+	// agent is only used during handshake
+	var agentConn net.Conn
+	if handler.proxy.AgentSocket != "" {
+		var err error
+		agentConn, err = net.Dial("unix", handler.proxy.AgentSocket)
+		if err != nil {
+			logger.Warningf("[%s] connect ssh agent failed, err: %v", handler.typ, err)
+		} else {
+			defer agentConn.Close()
+		}
+	}
+	cfg, err := handler.newClientConfig(agentConn)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := handler.dialProxy()
+	if err != nil {
+		return nil, err
+	}
+	// deadline of handshake is set when dial
+	addr := net.JoinHostPort(handler.proxy.Server, strconv.Itoa(handler.proxy.Port))
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, cfg)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	logger.Infof("[%s] ssh connection create success, server [%s], version [%s]", handler.typ, addr, sshConn.ServerVersion())
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// make ssh client config with auth methods and host key check, agent is used if connected
+func (handler *SshHandler) newClientConfig(agentConn net.Conn) (*ssh.ClientConfig, error) {
+	proxy := handler.proxy
+	if proxy.UserName == "" {
+		return nil, errors.New("ssh user name is empty")
+	}
+	// host key must be verified, credentials may be sent to a fake server
+	if proxy.KnownHosts == "" {
+		return nil, errors.New("ssh known hosts file is not set")
+	}
+	hostKeyCallback, err := knownhosts.New(proxy.KnownHosts)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &ssh.ClientConfig{
+		User:              proxy.UserName,
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: knownHostKeyAlgorithms(hostKeyCallback, proxy.Server, proxy.Port),
+		Timeout:           10 * time.Second,
+	}
+	// try agent, key file, then password
+	if agentConn != nil {
+		cfg.Auth = append(cfg.Auth, ssh.PublicKeysCallback(agent.NewClient(agentConn).Signers))
+	}
+	if proxy.KeyFile != "" {
+		signer, err := loadSshKey(proxy.KeyFile, proxy.KeyPassphrase)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Auth = append(cfg.Auth, ssh.PublicKeys(signer))
+	}
+	if proxy.Password != "" {
+		cfg.Auth = append(cfg.Auth, ssh.Password(proxy.Password))
+	}
+	if len(cfg.Auth) == 0 {
+		return nil, errors.New("ssh has no auth method, set password key file or agent")
+	}
+	return cfg, nil
+}
+
+// load private key, passphrase is needed if key is encrypted
+func loadSshKey(path string, passphrase string) (ssh.Signer, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if passphrase != "" {
+		return ssh.ParsePrivateKeyWithPassphrase(buf, []byte(passphrase))
+	}
+	signer, err := ssh.ParsePrivateKey(buf)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		return nil, fmt.Errorf("ssh key file %s is encrypted, key passphrase is needed", path)
+	}
+	return signer, err
+}
+
+// get host key algorithms of server in known hosts, so that server offer the key we know
+func knownHostKeyAlgorithms(callback ssh.HostKeyCallback, server string, port int) []string {
+	// check with a random key, key error contains known keys of host
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil
+	}
+	addr := net.JoinHostPort(server, strconv.Itoa(port))
+	err = callback(addr, &net.TCPAddr{IP: net.IPv4zero, Port: port}, key)
+	keyErr, ok := err.(*knownhosts.KeyError)
+	if !ok {
+		return nil
+	}
+	var algorithms []string
+	for _, known := range keyErr.Want {
+		algorithm := known.Key.Type()
+		// rsa key can be used with sha2 signature
+		if algorithm == ssh.KeyAlgoRSA {
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256)
+		}
+		algorithms = append(algorithms, algorithm)
+	}
+	return algorithms
+}
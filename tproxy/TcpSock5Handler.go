@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"time"
 
 	"github.com/linuxdeepin/deepin-network-proxy/config"
 	"github.com/linuxdeepin/deepin-network-proxy/define"
@@ -31,31 +32,48 @@ func NewTcpSock5Handler(scope define.Scope, key HandlerKey, proxy config.Proxy,
 
 // create tunnel between proxy and server
 func (handler *TcpSock5Handler) Tunnel() error {
+	// pre-authenticated connection is ready for connect request
+	if handler.proxy.PoolSize > 0 {
+		rConn := getSock5Pool(&handler.handlerPrv).get()
+		if rConn != nil {
+			if timeout := handler.handshakeTimeout(); timeout != 0 {
+				_ = rConn.SetDeadline(time.Now().Add(timeout))
+			}
+			err := handler.connect(rConn)
+			if err == nil {
+				return nil
+			}
+			_ = rConn.Close()
+			// timeout or refused request is not retried, only connection closed by server
+			if !isStaleConn(err) {
+				return err
+			}
+			logger.Debugf("[%s] pooled connection is broken, dial again, err: %v", handler.typ, err)
+		}
+	}
 	// dial proxy server
 	rConn, err := handler.dialProxy()
 	if err != nil {
 		logger.Warningf("[%s] failed to dial proxy server, err: %v", handler.typ, err)
 		return err
 	}
-	// check type
-	var port uint16
-	var ip net.IP
-	dominname := ""
-	switch addr := handler.rAddr.(type) {
-	case *net.TCPAddr:
-		ip = addr.IP
-	case *DomainAddr:
-		port = uint16(addr.Port)
-		ip = net.IPv4(0x00, 0x00, 0x00, 0x01)
-		dominname = addr.Domain
-	default:
-		logger.Warningf("[%s] tunnel addr type is not tcp", handler.typ)
-		return errors.New("type is not tcp")
+	err = handler.sock5Handshake(rConn)
+	if err == nil {
+		err = handler.connect(rConn)
 	}
+	if err != nil {
+		_ = rConn.Close()
+		return err
+	}
+	return nil
+}
+
+// negotiate method and auth, connection is ready for connect request after that
+func (pr *handlerPrv) sock5Handshake(rConn net.Conn) error {
 	// auth message
 	auth := auth{
-		user:     handler.proxy.UserName,
-		password: handler.proxy.Password,
+		user:     pr.proxy.UserName,
+		password: pr.proxy.Password,
 	}
 	/*
 	    sock5 client hand shake request
@@ -76,9 +94,9 @@ func (handler *TcpSock5Handler) Tunnel() error {
 		buf = append(buf, byte(2))
 	}
 	// sock5 hand shake
-	_, err = rConn.Write(buf)
+	_, err := rConn.Write(buf)
 	if err != nil {
-		logger.Warningf("[%s] hand shake request failed, err: %v", handler.typ, err)
+		logger.Warningf("[%s] hand shake request failed, err: %v", pr.typ, err)
 		return err
 	}
 	/*
@@ -91,16 +109,16 @@ func (handler *TcpSock5Handler) Tunnel() error {
 	*/
 	_, err = rConn.Read(buf)
 	if err != nil {
-		logger.Warningf("[%s] hand shake response failed, err: %v", handler.typ, err)
+		logger.Warningf("[%s] hand shake response failed, err: %v", pr.typ, err)
 		return err
 	}
-	logger.Debugf("[%s] hand shake response success message auth method: %v", handler.typ, buf[1])
+	logger.Debugf("[%s] hand shake response success message auth method: %v", pr.typ, buf[1])
 	if buf[0] != 5 || (buf[1] != 0 && buf[1] != 2) {
 		return fmt.Errorf("sock5 proto is invalid, sock type: %v, method: %v", buf[0], buf[1])
 	}
 	// check if server need auth
 	if buf[1] == 2 {
-		logger.Debugf("[%s] proxy need auth, start authenticating...", handler.typ)
+		logger.Debugf("[%s] proxy need auth, start authenticating...", pr.typ)
 		/*
 		    sock5 auth request
 		  +----+------+----------+------+----------+
@@ -118,21 +136,42 @@ func (handler *TcpSock5Handler) Tunnel() error {
 		// write auth message to writer
 		_, err = rConn.Write(buf)
 		if err != nil {
-			logger.Warningf("[%s] auth request failed, err: %v", handler.typ, err)
+			logger.Warningf("[%s] auth request failed, err: %v", pr.typ, err)
 			return err
 		}
 		buf = make([]byte, 32)
 		_, err = rConn.Read(buf)
 		if err != nil {
-			logger.Warningf("[%s] auth response failed, err: %v", handler.typ, err)
+			logger.Warningf("[%s] auth response failed, err: %v", pr.typ, err)
 			return err
 		}
 		// RFC1929 user/pass auth should return 1, but some sock5 return 5
 		if buf[0] != 5 && buf[0] != 1 {
-			logger.Warningf("[%s] auth response incorrect code, code: %v", handler.typ, buf[0])
+			logger.Warningf("[%s] auth response incorrect code, code: %v", pr.typ, buf[0])
 			return fmt.Errorf("incorrect sock5 auth response, code: %v", buf[0])
 		}
-		logger.Debugf("[%s] auth success, code: %v", handler.typ, buf[0])
+		logger.Debugf("[%s] auth success, code: %v", pr.typ, buf[0])
+	}
+	return nil
+}
+
+// send connect request on authenticated connection, save it as rConn if success
+func (handler *TcpSock5Handler) connect(rConn net.Conn) error {
+	// check type
+	var port uint16
+	var ip net.IP
+	dominname := ""
+	switch addr := handler.rAddr.(type) {
+	case *net.TCPAddr:
+		port = uint16(addr.Port)
+		ip = addr.IP
+	case *DomainAddr:
+		port = uint16(addr.Port)
+		ip = net.IPv4(0x00, 0x00, 0x00, 0x01)
+		dominname = addr.Domain
+	default:
+		logger.Warningf("[%s] tunnel addr type is not tcp", handler.typ)
+		return errors.New("type is not tcp")
 	}
 	/*
 			sock5 connect request
@@ -143,7 +182,7 @@ func (handler *TcpSock5Handler) Tunnel() error {
 		   +----+-----+-------+------+----------+----------+
 	*/
 	// start create tunnel
-	buf = make([]byte, 4)
+	buf := make([]byte, 4)
 	buf[0] = 5
 	buf[1] = 1 // connect
 	buf[2] = 0 // reserved
@@ -175,7 +214,7 @@ func (handler *TcpSock5Handler) Tunnel() error {
 	buf = append(buf, portByte...)
 	// request proxy connect rConn server
 	logger.Debugf("[%s] send connect request, buf: %v", handler.typ, buf)
-	_, err = rConn.Write(buf)
+	_, err := rConn.Write(buf)
 	if err != nil {
 		logger.Warningf("[%s] send connect request failed, err: %v", handler.typ, err)
 		return err
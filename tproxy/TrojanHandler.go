@@ -0,0 +1,91 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package tproxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+
+	"github.com/linuxdeepin/deepin-network-proxy/config"
+	"github.com/linuxdeepin/deepin-network-proxy/define"
+)
+
+/*
+	trojan request, sent over tls
+	+-----------------------+---------+----------------+---------+----------+
+	| hex(SHA224(password)) |  CRLF   | Trojan Request |  CRLF   | Payload  |
+	+-----------------------+---------+----------------+---------+----------+
+	|          56           | X'0D0A' |    Variable    | X'0D0A' | Variable |
+	+-----------------------+---------+----------------+---------+----------+
+
+	trojan request
+	+-----+------+----------+----------+
+	| CMD | ATYP | DST.ADDR | DST.PORT |
+	+-----+------+----------+----------+
+	|  1  |  1   | Variable |    2     |
+	+-----+------+----------+----------+
+*/
+
+const (
+	trojanConnect      = 1
+	trojanUdpAssociate = 3
+)
+
+// make trojan request header
+func trojanHeader(password string, cmd byte, rAddr net.Addr) ([]byte, error) {
+	addr, err := marshalSocksAddr(rAddr)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum224([]byte(password))
+	buf := make([]byte, 0, 56+2+1+len(addr)+2)
+	buf = append(buf, hex.EncodeToString(sum[:])...)
+	buf = append(buf, '\r', '\n', cmd)
+	buf = append(buf, addr...)
+	buf = append(buf, '\r', '\n')
+	return buf, nil
+}
+
+type TrojanHandler struct {
+	handlerPrv
+}
+
+func NewTrojanHandler(scope define.Scope, key HandlerKey, proxy config.Proxy, lAddr net.Addr, rAddr net.Addr, lConn net.Conn) *TrojanHandler {
+	// create new handler
+	handler := &TrojanHandler{
+		handlerPrv: createHandlerPrv(TROJAN, scope, key, proxy, lAddr, rAddr, lConn),
+	}
+	// add self to private parent
+	handler.saveParent(handler)
+	return handler
+}
+
+// create tunnel between proxy and server
+func (handler *TrojanHandler) Tunnel() error {
+	header, err := trojanHeader(handler.proxy.Password, trojanConnect, handler.rAddr)
+	if err != nil {
+		logger.Warningf("[%s] make request header failed, err: %v", handler.typ, err)
+		return err
+	}
+	// dial proxy server, tls is always used
+	rConn, err := handler.dialProxy()
+	if err != nil {
+		logger.Warningf("[%s] failed to dial proxy server, err: %v", handler.typ, err)
+		return err
+	}
+	// server has no response, data is relayed after header
+	_, err = rConn.Write(header)
+	if err != nil {
+		logger.Warningf("[%s] send request header failed, err: %v", handler.typ, err)
+		_ = rConn.Close()
+		return err
+	}
+	logger.Infof("[%s] proxy: tunnel create success, [%s] -> [%s] -> [%s]",
+		handler.typ, handler.lAddr.String(), rConn.RemoteAddr(), handler.rAddr.String())
+	// save rConn handler
+	handler.rConn = rConn
+	return nil
+}
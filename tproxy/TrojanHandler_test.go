@@ -0,0 +1,95 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package tproxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestTrojanHeader(t *testing.T) {
+	header, err := trojanHeader("password", trojanConnect, NewDomainAddr("tcp", "a.com", 443))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// hex of sha224("password")
+	want := "d63dc919e201d7bc4c825630d2cf25fdc93d4b2f0d46706d29038d01" + "\r\n" +
+		"\x01\x03\x05a.com\x01\xbb" + "\r\n"
+	if string(header) != want {
+		t.Errorf("trojan header is %q, want %q", header, want)
+	}
+	if _, err = trojanHeader("password", trojanConnect, NewDomainAddr("tcp", strings.Repeat("a", 256), 443)); err == nil {
+		t.Error("trojan header of long domain success")
+	}
+}
+
+// packets in stream are read one by one, packet larger than buffer is refused
+func TestTrojanPacketConn(t *testing.T) {
+	handler := &UdpTrojanHandler{}
+	rAddr := &net.UDPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 53}
+	// domain is resolved when unpack
+	domain := NewDomainAddr("udp", "localhost", 53)
+	var stream []byte
+	for _, elem := range []struct {
+		addr net.Addr
+		data string
+	}{{rAddr, "hello"}, {domain, "world"}, {rAddr, ""}} {
+		msg, err := handler.pack(elem.addr, []byte(elem.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream = append(stream, msg...)
+	}
+	conn := &trojanPacketConn{reader: bufio.NewReader(bytes.NewReader(stream))}
+	buf := make([]byte, 64)
+	for _, want := range []string{"hello", "world", ""} {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkg, err := handler.unpack(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(pkg.Data) != want {
+			t.Errorf("packet data is %q, want %q", pkg.Data, want)
+		}
+	}
+	if _, err := conn.Read(buf); err != io.EOF {
+		t.Errorf("read end of stream got %v, want %v", err, io.EOF)
+	}
+
+	msg, _ := handler.pack(rAddr, bytes.Repeat([]byte("a"), 100))
+	conn = &trojanPacketConn{reader: bufio.NewReader(bytes.NewReader(msg))}
+	if _, err := conn.Read(buf); err != io.ErrShortBuffer {
+		t.Errorf("read large packet got %v, want %v", err, io.ErrShortBuffer)
+	}
+}
+
+func TestTrojanPack(t *testing.T) {
+	handler := &UdpTrojanHandler{}
+	msg, err := handler.pack(&net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 53}, []byte("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{1, 1, 2, 3, 4, 0, 53, 0, 2, '\r', '\n', 'h', 'i'}
+	if !bytes.Equal(msg, want) {
+		t.Errorf("trojan udp packet is %x, want %x", msg, want)
+	}
+	pkg, err := handler.unpack(msg)
+	if err != nil || pkg.Addr.String() != "1.2.3.4:53" || string(pkg.Data) != "hi" {
+		t.Errorf("unpack packet from %v, data %q, err: %v", pkg.Addr, pkg.Data, err)
+	}
+	if _, err = handler.unpack(msg[:9]); err == nil {
+		t.Error("unpack truncated packet success")
+	}
+	if _, err = handler.pack(NewDomainAddr("udp", strings.Repeat("a", 256), 53), nil); err == nil {
+		t.Error("pack packet of long domain success")
+	}
+}
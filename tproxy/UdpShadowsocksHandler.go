@@ -0,0 +1,199 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package tproxy
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/linuxdeepin/deepin-network-proxy/com"
+	"github.com/linuxdeepin/deepin-network-proxy/config"
+	"github.com/linuxdeepin/deepin-network-proxy/define"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// udp handler, packets are sent to shadowsocks server directly, no association needed
+type UdpShadowsocksHandler struct {
+	udpHandlerPrv
+	cipher *ssCipher
+
+	// 2022 session, packet id increase for each packet
+	sessionID []byte
+	packetID  uint64
+	// 2022 aes header block and chacha aead, both use master key
+	block  cipher.Block
+	xAead  cipher.AEAD
+	wAead  cipher.AEAD
+	rAead  cipher.AEAD
+	rSesID []byte
+}
+
+func NewUdpShadowsocksHandler(scope define.Scope, key HandlerKey, proxy config.Proxy, lAddr net.Addr, rAddr net.Addr, lConn net.Conn) *UdpShadowsocksHandler {
+	// create new handler
+	handler := &UdpShadowsocksHandler{
+		udpHandlerPrv: createUdpHandlerPrv(SHADOWSOCKSUDP, scope, key, proxy, lAddr, rAddr, lConn),
+	}
+	// add self to private parent
+	handler.saveParent(handler)
+	handler.savePacker(handler)
+	return handler
+}
+
+// create tunnel between proxy and server, datagram waiting for tunnel is released when return
+func (handler *UdpShadowsocksHandler) Tunnel() error {
+	return handler.tunnelDone(handler.tunnel())
+}
+
+// prepare cipher and dial udp server
+func (handler *UdpShadowsocksHandler) tunnel() error {
+	var err error
+	handler.cipher, err = newSsCipher(handler.proxy.Method, handler.proxy.Key, handler.proxy.Password)
+	if err != nil {
+		logger.Warningf("[%s] create cipher failed, err: %v", handler.typ, err)
+		return err
+	}
+	if handler.cipher.is2022 {
+		handler.sessionID = randomBytes(8)
+		if handler.cipher.chacha {
+			handler.xAead, err = chacha20poly1305.NewX(handler.cipher.key)
+		} else {
+			handler.block, err = aes.NewCipher(handler.cipher.key)
+			if err == nil {
+				handler.wAead, err = handler.cipher.sessionAead(handler.sessionID)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// udp server is the same as tcp server
+	host, _ := parseProxyServer(handler.proxy.Server)
+	server := net.JoinHostPort(host, strconv.Itoa(handler.proxy.Port))
+	// mark connection, in case captured by proxy again
+	udpConn, err := com.NewMarkDialer(0, define.ProxyMark).Dial("udp", server)
+	if err != nil {
+		logger.Warningf("[%s] dial udp server failed, err: %v", handler.typ, err)
+		return err
+	}
+	logger.Debugf("[%s] proxy: tunnel create success, [%s] -> [%s] -> [%s]",
+		handler.typ, handler.lAddr.String(), server, handler.rAddr.String())
+	return handler.saveRemote(udpConn)
+}
+
+// pack shadowsocks udp packet
+func (handler *UdpShadowsocksHandler) pack(rAddr net.Addr, data []byte) ([]byte, error) {
+	addr, err := marshalSocksAddr(rAddr)
+	if err != nil {
+		return nil, err
+	}
+	c := handler.cipher
+	if !c.is2022 {
+		// SALT sealed(ATYP DST.ADDR DST.PORT PAYLOAD)
+		salt := randomBytes(c.keySize)
+		aead, err := c.sessionAead(salt)
+		if err != nil {
+			return nil, err
+		}
+		plain := append(addr, data...)
+		return aead.Seal(salt, make([]byte, aead.NonceSize()), plain, nil), nil
+	}
+	/*
+		2022 client packet
+		SESSION_ID(8) PACKET_ID(8) TYPE(1) TIMESTAMP(8) PADDING_LENGTH(2) ATYP DST.ADDR DST.PORT PAYLOAD
+	*/
+	header := make([]byte, 16)
+	copy(header, handler.sessionID)
+	binary.BigEndian.PutUint64(header[8:], atomic.AddUint64(&handler.packetID, 1))
+	body := make([]byte, 11, 11+len(addr)+len(data))
+	body[0] = ss2022ClientType
+	binary.BigEndian.PutUint64(body[1:9], uint64(time.Now().Unix()))
+	body = append(body, addr...)
+	body = append(body, data...)
+	if c.chacha {
+		// NONCE(24) sealed(header body)
+		nonce := randomBytes(chacha20poly1305.NonceSizeX)
+		return handler.xAead.Seal(nonce, nonce, append(header, body...), nil), nil
+	}
+	// encrypted header as nonce source, ENCRYPTED_HEADER(16) sealed(body)
+	msg := make([]byte, 16, 16+len(body)+ssTagSize)
+	handler.block.Encrypt(msg, header)
+	return handler.wAead.Seal(msg, header[4:16], body, nil), nil
+}
+
+// unpack shadowsocks udp packet
+func (handler *UdpShadowsocksHandler) unpack(msg []byte) (com.DataPackage, error) {
+	c := handler.cipher
+	if !c.is2022 {
+		if len(msg) < c.keySize+ssTagSize {
+			return com.DataPackage{}, errors.New("shadowsocks udp package is too short")
+		}
+		aead, err := c.sessionAead(msg[:c.keySize])
+		if err != nil {
+			return com.DataPackage{}, err
+		}
+		plain, err := aead.Open(nil, make([]byte, aead.NonceSize()), msg[c.keySize:], nil)
+		if err != nil {
+			return com.DataPackage{}, err
+		}
+		return unmarshalSocksAddr(plain)
+	}
+	/*
+		2022 server packet
+		SESSION_ID(8) PACKET_ID(8) TYPE(1) TIMESTAMP(8) CLIENT_SESSION_ID(8) PADDING_LENGTH(2) PADDING ATYP DST.ADDR DST.PORT PAYLOAD
+	*/
+	var plain []byte
+	var err error
+	if c.chacha {
+		if len(msg) < chacha20poly1305.NonceSizeX+16+ssTagSize {
+			return com.DataPackage{}, errors.New("shadowsocks udp package is too short")
+		}
+		nonce := msg[:chacha20poly1305.NonceSizeX]
+		plain, err = handler.xAead.Open(nil, nonce, msg[chacha20poly1305.NonceSizeX:], nil)
+	} else {
+		if len(msg) < 16+ssTagSize {
+			return com.DataPackage{}, errors.New("shadowsocks udp package is too short")
+		}
+		header := make([]byte, 16)
+		handler.block.Decrypt(header, msg[:16])
+		// server session rarely changes, keep aead of last session
+		if string(header[:8]) != string(handler.rSesID) {
+			handler.rAead, err = c.sessionAead(header[:8])
+			if err != nil {
+				return com.DataPackage{}, err
+			}
+			handler.rSesID = header[:8]
+		}
+		plain, err = handler.rAead.Open(nil, header[4:16], msg[16:], nil)
+		plain = append(header, plain...)
+	}
+	if err != nil {
+		return com.DataPackage{}, err
+	}
+	if len(plain) < 16+1+8+8+2 {
+		return com.DataPackage{}, errors.New("shadowsocks udp package is too short")
+	}
+	if plain[16] != ss2022ServerType {
+		return com.DataPackage{}, fmt.Errorf("shadowsocks udp package type %v is invalid", plain[16])
+	}
+	err = check2022Timestamp(binary.BigEndian.Uint64(plain[17:25]))
+	if err != nil {
+		return com.DataPackage{}, err
+	}
+	if string(plain[25:33]) != string(handler.sessionID) {
+		return com.DataPackage{}, errors.New("shadowsocks udp package session dont match")
+	}
+	paddingLen := int(binary.BigEndian.Uint16(plain[33:35]))
+	if len(plain) < 35+paddingLen {
+		return com.DataPackage{}, errors.New("shadowsocks udp package is too short")
+	}
+	return unmarshalSocksAddr(plain[35+paddingLen:])
+}
@@ -9,119 +9,95 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"strconv"
+	"time"
 
 	"github.com/linuxdeepin/deepin-network-proxy/com"
 	"github.com/linuxdeepin/deepin-network-proxy/config"
 	"github.com/linuxdeepin/deepin-network-proxy/define"
 )
 
+// udp handler, association is shared by all sessions from the same local addr
 type UdpSock5Handler struct {
-	handlerPrv
+	udpHandlerPrv
 	rTcpConn net.Conn
 }
 
 func NewUdpSock5Handler(scope define.Scope, key HandlerKey, proxy config.Proxy, lAddr net.Addr, rAddr net.Addr, lConn net.Conn) *UdpSock5Handler {
 	// create new handler
 	handler := &UdpSock5Handler{
-		handlerPrv: createHandlerPrv(SOCKS5UDP, scope, key, proxy, lAddr, rAddr, lConn),
+		udpHandlerPrv: createUdpHandlerPrv(SOCKS5UDP, scope, key, proxy, lAddr, rAddr, lConn),
 	}
 	// add self to private parent
 	handler.saveParent(handler)
+	handler.savePacker(handler)
 	return handler
 }
 
 // rewrite close
 func (handler *UdpSock5Handler) Close() {
+	handler.udpHandlerPrv.Close()
 	if handler.rTcpConn != nil {
 		_ = handler.rTcpConn.Close()
 	}
-	handler.handlerPrv.Close()
 }
 
-// rewrite read remote
-func (handler *UdpSock5Handler) Read(buf []byte) (int, error) {
-	// check if rConn is nil
-	if handler.rConn == nil {
-		return 0, errors.New("remote handler is nil")
+// pack sock5 udp datagram
+func (handler *UdpSock5Handler) pack(rAddr net.Addr, data []byte) ([]byte, error) {
+	pkgData := com.DataPackage{
+		Addr: rAddr,
+		Data: data,
 	}
-	data := make([]byte, 512)
-	n, err := handler.rConn.Read(data)
-	if err != nil {
-		logger.Warningf("read remote failed, err: %v", err)
-		return n, err
+	msg := com.MarshalPackage(pkgData, "udp")
+	if msg == nil {
+		return nil, fmt.Errorf("marshal udp package failed, remote: %s", rAddr)
 	}
-	pkgData := com.UnMarshalPackage(data)
-	copy(buf, pkgData.Data)
-	return n, nil
+	return msg, nil
 }
 
-// rewrite write remote
-func (handler *UdpSock5Handler) Write(buf []byte) (int, error) {
-	if handler.rConn == nil {
-		return 0, errors.New("remote handler is nil")
-	}
-	pkgData := com.DataPackage{
-		Addr: handler.rAddr,
-		Data: buf,
-	}
-	_, err := handler.rConn.Write(com.MarshalPackage(pkgData, "udp"))
-	if err != nil {
-		return 0, err
-	}
-	return len(buf), nil
+// unpack sock5 udp datagram
+func (handler *UdpSock5Handler) unpack(msg []byte) (com.DataPackage, error) {
+	return com.UnMarshalPackage(msg)
 }
 
 // rewrite communication
 func (handler *UdpSock5Handler) Communicate() {
-	// local -> remote
-	go func() {
-		logger.Debugf("[%s] begin copy data, local [%s] -> remote [%s]", handler.typ, handler.lAddr.String(), handler.rAddr.String())
-		_, err := io.Copy(handler.lConn, handler)
-		if err != nil {
-			logger.Debugf("[%s] stop copy data, local [%s] -x- remote [%s], reason: %v",
-				handler.typ, handler.lAddr.String(), handler.rAddr.String(), err)
-		}
-		handler.Remove()
-	}()
+	handler.udpHandlerPrv.Communicate()
+	_ = handler.rTcpConn.SetDeadline(time.Time{})
 
-	// remote -> local
+	// association terminates when tcp connection closed
 	go func() {
-		logger.Debugf("[%s] begin copy data, remote [%s] -> local [%s]", handler.typ, handler.rAddr.String(), handler.lAddr.String())
-		_, err := io.Copy(handler, handler.lConn)
-		if err != nil {
-			logger.Debugf("[%s] stop copy data, remote [%s] -x- local [%s], reason: %v",
-				handler.typ, handler.rAddr.String(), handler.lAddr.String(), err)
-		}
-		handler.Remove()
+		_, err := io.Copy(ioutil.Discard, handler.rTcpConn)
+		logger.Debugf("[%s] udp association closed, local [%s], reason: %v", handler.typ, handler.lAddr, err)
+		handler.remove()
 	}()
 }
 
-// create tunnel between proxy and server
+// create tunnel between proxy and server, datagram waiting for tunnel is released when return
 func (handler *UdpSock5Handler) Tunnel() error {
+	return handler.tunnelDone(handler.tunnel())
+}
+
+// create udp association
+func (handler *UdpSock5Handler) tunnel() error {
 	// dial proxy server
 	rTcpConn, err := handler.dialProxy()
 	if err != nil {
 		logger.Warningf("[udp] failed to dial proxy server, err: %v", err)
 		return err
 	}
-	// save tcp connection
-	handler.rTcpConn = rTcpConn
-	// check type
-	var port uint16
-	var ip net.IP
-	dominname := ""
-	switch addr := handler.rAddr.(type) {
-	case *net.TCPAddr:
-		ip = addr.IP
-	case *DomainAddr:
-		port = uint16(addr.Port)
-		ip = net.IPv4(0x00, 0x00, 0x00, 0x01)
-		dominname = addr.Domain
-	default:
-		logger.Warning("[udp] tunnel addr type is not udp")
-		return errors.New("type is not udp")
+	// save tcp connection, handler may be closed while dialing
+	handler.sessionLock.Lock()
+	closed := handler.closed
+	if !closed {
+		handler.rTcpConn = rTcpConn
+	}
+	handler.sessionLock.Unlock()
+	if closed {
+		_ = rTcpConn.Close()
+		return errors.New("handler is closed")
 	}
 
 	// auth message
@@ -206,44 +182,15 @@ func (handler *UdpSock5Handler) Tunnel() error {
 		logger.Debugf("[udp] sock5 auth success, code: %v", buf[0])
 	}
 	/*
-			sock5 connect request
+			sock5 udp associate request
 		   +----+-----+-------+------+----------+----------+
 		   |VER | CMD |  RSV  | ATYP | DST.ADDR | DST.PORT |
 		   +----+-----+-------+------+----------+----------+
 		   | 1  |  1  | X'00' |  1   | Variable |    2     |
 		   +----+-----+-------+------+----------+----------+
 	*/
-	// start create tunnel
-	buf = make([]byte, 4)
-	buf[0] = 5
-	buf[1] = 3 // udp
-	buf[2] = 0 // reserved
-	// add addr
-	if dominname == "" {
-		if len(ip) == net.IPv4len && ip.To4() != nil {
-			buf[3] = 1
-			buf = append(buf, ip.To4()...)
-		} else if ip.To16() != nil {
-			buf[3] = 4
-			buf = append(buf, ip.To16()...)
-		} else {
-			return errors.New("ip invalid")
-		}
-	} else {
-		if len(dominname) > 255 {
-			return errors.New("domain name out of max length")
-		}
-		buf[3] = 3
-		buf = append(buf, byte(len(dominname)))
-		buf = append(buf, []byte(dominname)...)
-	}
-	// convert port 2 byte
-	if port == 0 {
-		port = 80
-	}
-	portByte := make([]byte, 2)
-	binary.BigEndian.PutUint16(portByte, port)
-	buf = append(buf, portByte...)
+	// association is shared by all remote addr, local addr seen by proxy server is unknown, use zero as RFC1928
+	buf = []byte{5, 3, 0, 1, 0, 0, 0, 0, 0, 0}
 	// request proxy connect rTcpConn server
 	logger.Debugf("[udp] sock5 send connect request, buf: %v", buf)
 	_, err = rTcpConn.Write(buf)
@@ -292,7 +239,7 @@ func (handler *UdpSock5Handler) Tunnel() error {
 		return errors.New("invalid ip")
 	}
 
-	ip = make([]byte, addrLen)
+	ip := make([]byte, addrLen)
 	_, err = io.ReadFull(rTcpConn, ip)
 	if err != nil {
 		logger.Warningf("[%s] connect response failed, err: %v", handler.typ, err)
@@ -305,12 +252,11 @@ func (handler *UdpSock5Handler) Tunnel() error {
 		logger.Warningf("[%s] connect response failed, err: %v", handler.typ, err)
 		return err
 	}
-	port = binary.BigEndian.Uint16(buf[0:2])
+	port := binary.BigEndian.Uint16(buf[0:2])
 
 	var udpServer *net.UDPAddr
 	if isDomainname {
-		udpServer, err = net.ResolveUDPAddr("udp",
-			net.JoinHostPort(string(ip), strconv.Itoa(int(port))))
+		udpServer, err = com.ResolveMarkUDPAddr(net.JoinHostPort(string(ip), strconv.Itoa(int(port))), define.ProxyMark)
 		if err != nil {
 			return err
 		}
@@ -320,9 +266,17 @@ func (handler *UdpSock5Handler) Tunnel() error {
 			Port: int(port),
 		}
 	}
+	// relay addr is unspecified, use proxy server addr instead
+	if udpServer.IP.IsUnspecified() {
+		host, _, err := net.SplitHostPort(rTcpConn.RemoteAddr().String())
+		if err != nil {
+			return err
+		}
+		udpServer.IP = net.ParseIP(host)
+	}
 
-	// dial rTcpConn udp server
-	udpConn, err := net.Dial("udp", udpServer.String())
+	// dial rTcpConn udp server, mark connection in case captured by proxy again
+	udpConn, err := com.NewMarkDialer(0, define.ProxyMark).Dial("udp", udpServer.String())
 	if err != nil {
 		logger.Warningf("[udp] dial rTcpConn udp failed, err: %v", err)
 		return err
@@ -331,6 +285,5 @@ func (handler *UdpSock5Handler) Tunnel() error {
 	logger.Debugf("[udp] sock5 proxy: tunnel create success, [%s] -> [%s] -> [%s]",
 		handler.lAddr.String(), udpServer.String(), handler.rAddr.String())
 	// save rTcpConn handler
-	handler.rConn = udpConn
-	return nil
+	return handler.saveRemote(udpConn)
 }
@@ -0,0 +1,137 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package tproxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/linuxdeepin/deepin-network-proxy/com"
+	"github.com/linuxdeepin/deepin-network-proxy/config"
+	"github.com/linuxdeepin/deepin-network-proxy/define"
+)
+
+/*
+	trojan udp packet, sent over tls stream after udp associate request
+	+------+----------+----------+--------+---------+----------+
+	| ATYP | DST.ADDR | DST.PORT | Length |  CRLF   | Payload  |
+	+------+----------+----------+--------+---------+----------+
+	|  1   | Variable |    2     |   2    | X'0D0A' | Variable |
+	+------+----------+----------+--------+---------+----------+
+*/
+
+// stream connection which read one udp packet each time
+type trojanPacketConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// read one whole packet
+func (conn *trojanPacketConn) Read(buf []byte) (int, error) {
+	// ATYP and domain length
+	head, err := conn.reader.Peek(2)
+	if err != nil {
+		return 0, err
+	}
+	addrLen, err := socksAddrLen(head)
+	if err != nil {
+		return 0, err
+	}
+	// addr length CRLF
+	if len(buf) < addrLen+4 {
+		return 0, io.ErrShortBuffer
+	}
+	_, err = io.ReadFull(conn.reader, buf[:addrLen+4])
+	if err != nil {
+		return 0, err
+	}
+	size := int(binary.BigEndian.Uint16(buf[addrLen : addrLen+2]))
+	if len(buf) < addrLen+4+size {
+		return 0, io.ErrShortBuffer
+	}
+	_, err = io.ReadFull(conn.reader, buf[addrLen+4:addrLen+4+size])
+	if err != nil {
+		return 0, err
+	}
+	return addrLen + 4 + size, nil
+}
+
+// udp handler, all sessions from the same local addr share one tls stream
+type UdpTrojanHandler struct {
+	udpHandlerPrv
+}
+
+func NewUdpTrojanHandler(scope define.Scope, key HandlerKey, proxy config.Proxy, lAddr net.Addr, rAddr net.Addr, lConn net.Conn) *UdpTrojanHandler {
+	// create new handler
+	handler := &UdpTrojanHandler{
+		udpHandlerPrv: createUdpHandlerPrv(TROJANUDP, scope, key, proxy, lAddr, rAddr, lConn),
+	}
+	// add self to private parent
+	handler.saveParent(handler)
+	handler.savePacker(handler)
+	return handler
+}
+
+// create tunnel between proxy and server, datagram waiting for tunnel is released when return
+func (handler *UdpTrojanHandler) Tunnel() error {
+	return handler.tunnelDone(handler.tunnel())
+}
+
+// send udp associate request
+func (handler *UdpTrojanHandler) tunnel() error {
+	header, err := trojanHeader(handler.proxy.Password, trojanUdpAssociate, handler.rAddr)
+	if err != nil {
+		logger.Warningf("[%s] make request header failed, err: %v", handler.typ, err)
+		return err
+	}
+	// dial proxy server, tls is always used
+	rConn, err := handler.dialProxy()
+	if err != nil {
+		logger.Warningf("[%s] failed to dial proxy server, err: %v", handler.typ, err)
+		return err
+	}
+	_, err = rConn.Write(header)
+	if err != nil {
+		logger.Warningf("[%s] send request header failed, err: %v", handler.typ, err)
+		_ = rConn.Close()
+		return err
+	}
+	logger.Debugf("[%s] proxy: tunnel create success, [%s] -> [%s] -> [%s]",
+		handler.typ, handler.lAddr.String(), rConn.RemoteAddr(), handler.rAddr.String())
+	return handler.saveRemote(&trojanPacketConn{
+		Conn:   rConn,
+		reader: bufio.NewReader(rConn),
+	})
+}
+
+// pack trojan udp packet
+func (handler *UdpTrojanHandler) pack(rAddr net.Addr, data []byte) ([]byte, error) {
+	addr, err := marshalSocksAddr(rAddr)
+	if err != nil {
+		return nil, err
+	}
+	msg := make([]byte, 0, len(addr)+4+len(data))
+	msg = append(msg, addr...)
+	msg = append(msg, byte(len(data)>>8), byte(len(data)), '\r', '\n')
+	return append(msg, data...), nil
+}
+
+// unpack trojan udp packet
+func (handler *UdpTrojanHandler) unpack(msg []byte) (com.DataPackage, error) {
+	addrLen, err := socksAddrLen(msg)
+	if err != nil {
+		return com.DataPackage{}, err
+	}
+	if len(msg) < addrLen+4 {
+		return com.DataPackage{}, errors.New("trojan udp package is too short")
+	}
+	// drop length and CRLF
+	buf := make([]byte, 0, len(msg)-4)
+	buf = append(buf, msg[:addrLen]...)
+	return unmarshalSocksAddr(append(buf, msg[addrLen+4:]...))
+}
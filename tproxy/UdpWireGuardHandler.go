@@ -0,0 +1,135 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package tproxy
+
+import (
+	"io"
+	"net"
+	"sync"
+
+	"github.com/linuxdeepin/deepin-network-proxy/com"
+	"github.com/linuxdeepin/deepin-network-proxy/config"
+	"github.com/linuxdeepin/deepin-network-proxy/define"
+)
+
+// udp socket in netstack as connection, packet is socks addr and payload
+type wgPacketConn struct {
+	net.PacketConn
+	wg    *wgDevice
+	rAddr net.Addr
+	buf   []byte
+
+	// resolved addr to domain, reply is sent back as domain
+	domains     map[string]*DomainAddr
+	domainsLock sync.Mutex
+}
+
+// send payload to addr in packet
+func (conn *wgPacketConn) Write(msg []byte) (int, error) {
+	pkg, err := unmarshalSocksAddr(msg)
+	if err != nil {
+		return 0, err
+	}
+	addr := pkg.Addr
+	if domainAddr, ok := addr.(*DomainAddr); ok {
+		addr, err = conn.wg.resolveUDP(domainAddr)
+		if err != nil {
+			return 0, err
+		}
+		conn.domainsLock.Lock()
+		conn.domains[addr.String()] = domainAddr
+		conn.domainsLock.Unlock()
+	}
+	_, err = conn.WriteTo(pkg.Data, addr)
+	if err != nil {
+		return 0, err
+	}
+	return len(msg), nil
+}
+
+// read one packet, prepend source addr
+func (conn *wgPacketConn) Read(buf []byte) (int, error) {
+	n, addr, err := conn.ReadFrom(conn.buf)
+	if err != nil {
+		return 0, err
+	}
+	conn.domainsLock.Lock()
+	if domainAddr, ok := conn.domains[addr.String()]; ok {
+		addr = domainAddr
+	}
+	conn.domainsLock.Unlock()
+	header, err := marshalSocksAddr(addr)
+	if err != nil {
+		return 0, err
+	}
+	if len(buf) < len(header)+n {
+		return 0, io.ErrShortBuffer
+	}
+	copy(buf, header)
+	copy(buf[len(header):], conn.buf[:n])
+	return len(header) + n, nil
+}
+
+func (conn *wgPacketConn) RemoteAddr() net.Addr {
+	return conn.rAddr
+}
+
+// udp handler, all sessions from the same local addr share one netstack socket
+type UdpWireGuardHandler struct {
+	udpHandlerPrv
+}
+
+func NewUdpWireGuardHandler(scope define.Scope, key HandlerKey, proxy config.Proxy, lAddr net.Addr, rAddr net.Addr, lConn net.Conn) *UdpWireGuardHandler {
+	// create new handler
+	handler := &UdpWireGuardHandler{
+		udpHandlerPrv: createUdpHandlerPrv(WIREGUARDUDP, scope, key, proxy, lAddr, rAddr, lConn),
+	}
+	// add self to private parent
+	handler.saveParent(handler)
+	handler.savePacker(handler)
+	return handler
+}
+
+// create tunnel between proxy and server, datagram waiting for tunnel is released when return
+func (handler *UdpWireGuardHandler) Tunnel() error {
+	return handler.tunnelDone(handler.tunnel())
+}
+
+// listen udp in netstack
+func (handler *UdpWireGuardHandler) tunnel() error {
+	wg, err := handler.getWireGuard()
+	if err != nil {
+		logger.Warningf("[%s] create wireguard device failed, err: %v", handler.typ, err)
+		return err
+	}
+	udpConn, err := wg.tnet.ListenUDP(nil)
+	if err != nil {
+		logger.Warningf("[%s] listen udp in wireguard tunnel failed, err: %v", handler.typ, err)
+		return err
+	}
+	logger.Debugf("[%s] proxy: tunnel create success, [%s] -> [%s]",
+		handler.typ, handler.lAddr.String(), handler.rAddr.String())
+	return handler.saveRemote(&wgPacketConn{
+		PacketConn: udpConn,
+		wg:         wg,
+		rAddr:      handler.rAddr,
+		buf:        make([]byte, udpBufferSize),
+		domains:    make(map[string]*DomainAddr),
+	})
+}
+
+// pack socks addr and payload, sent by netstack socket
+func (handler *UdpWireGuardHandler) pack(rAddr net.Addr, data []byte) ([]byte, error) {
+	addr, err := marshalSocksAddr(rAddr)
+	if err != nil {
+		return nil, err
+	}
+	return append(addr, data...), nil
+}
+
+// unpack socks addr and payload
+func (handler *UdpWireGuardHandler) unpack(msg []byte) (com.DataPackage, error) {
+	return unmarshalSocksAddr(msg)
+}
@@ -0,0 +1,289 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package tproxy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/linuxdeepin/deepin-network-proxy/com"
+	"github.com/linuxdeepin/deepin-network-proxy/config"
+	"github.com/linuxdeepin/deepin-network-proxy/define"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+const (
+	wgDefaultMTU = 1420
+	// dial timeout in tunnel
+	wgDialTimeout = 10 * time.Second
+)
+
+// userspace wireguard device with netstack, flows are dialed in netstack
+type wgDevice struct {
+	dev  *device.Device
+	tnet *netstack.Net
+	// resolve domain in tunnel
+	dns bool
+	// config contents the device is created from
+	ident string
+}
+
+// one device for each scope, two devices with the same private key fight over handshakes with peer
+var wgDeviceMap = make(map[define.Scope]*wgDevice)
+var wgDeviceLock sync.Mutex
+
+// close wireguard device of scope
+func CloseWireGuard(scope define.Scope) {
+	wgDeviceLock.Lock()
+	defer wgDeviceLock.Unlock()
+	wg, ok := wgDeviceMap[scope]
+	if !ok {
+		return
+	}
+	wg.dev.Close()
+	delete(wgDeviceMap, scope)
+	logger.Debugf("[%s] wireguard device closed", scope)
+}
+
+// ident of device config, config reloaded with the same contents keep the device
+func wgDeviceIdent(cfg *config.WireGuardConfig, proxy config.Proxy) string {
+	return fmt.Sprintf("%+v|%s|%d", *cfg, proxy.Server, proxy.Port)
+}
+
+// get wireguard device, create if not exist, old device is closed if config changed
+func (pr *handlerPrv) getWireGuard() (*wgDevice, error) {
+	cfg := pr.proxy.WireGuard
+	if cfg == nil {
+		return nil, errors.New("wireguard config is not set")
+	}
+	ident := wgDeviceIdent(cfg, pr.proxy)
+	wgDeviceLock.Lock()
+	defer wgDeviceLock.Unlock()
+	if wg, ok := wgDeviceMap[pr.scope]; ok {
+		if wg.ident == ident {
+			return wg, nil
+		}
+		// flows in old device is broken, peer only keep the latest session anyway
+		wg.dev.Close()
+		delete(wgDeviceMap, pr.scope)
+		logger.Infof("[%s] wireguard config changed, old device closed", pr.scope)
+	}
+	wg, err := newWgDevice(cfg, pr.proxy)
+	if err != nil {
+		return nil, err
+	}
+	wg.ident = ident
+	wgDeviceMap[pr.scope] = wg
+	logger.Infof("[%s] wireguard device is up, address: %v", pr.scope, cfg.Address)
+	return wg, nil
+}
+
+// create netstack and wireguard device
+func newWgDevice(cfg *config.WireGuardConfig, proxy config.Proxy) (*wgDevice, error) {
+	var addrs []netip.Addr
+	for _, elem := range cfg.Address {
+		// allow cidr as wg-quick
+		if prefix, err := netip.ParsePrefix(elem); err == nil {
+			addrs = append(addrs, prefix.Addr())
+			continue
+		}
+		addr, err := netip.ParseAddr(elem)
+		if err != nil {
+			return nil, fmt.Errorf("wireguard address [%s] is invalid", elem)
+		}
+		addrs = append(addrs, addr)
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("wireguard address is empty")
+	}
+	var dns []netip.Addr
+	for _, elem := range cfg.DNS {
+		addr, err := netip.ParseAddr(elem)
+		if err != nil {
+			return nil, fmt.Errorf("wireguard dns [%s] is invalid", elem)
+		}
+		dns = append(dns, addr)
+	}
+	mtu := cfg.MTU
+	if mtu == 0 {
+		mtu = wgDefaultMTU
+	}
+	uapi, err := wgUapiConfig(cfg, proxy)
+	if err != nil {
+		return nil, err
+	}
+	tunDev, tnet, err := netstack.CreateNetTUN(addrs, dns, mtu)
+	if err != nil {
+		return nil, err
+	}
+	dev := device.NewDevice(tunDev, conn.NewDefaultBind(), &device.Logger{
+		Verbosef: logger.Debugf,
+		Errorf:   logger.Warningf,
+	})
+	err = dev.IpcSet(uapi)
+	if err == nil {
+		err = dev.Up()
+	}
+	if err != nil {
+		dev.Close()
+		return nil, err
+	}
+	return &wgDevice{
+		dev:  dev,
+		tnet: tnet,
+		dns:  len(dns) != 0,
+	}, nil
+}
+
+// make uapi config of device
+func wgUapiConfig(cfg *config.WireGuardConfig, proxy config.Proxy) (string, error) {
+	if len(cfg.Peers) == 0 {
+		return "", errors.New("wireguard peer is empty")
+	}
+	var buf strings.Builder
+	key, err := wgHexKey(cfg.PrivateKey)
+	if err != nil {
+		return "", fmt.Errorf("wireguard private key is invalid, err: %v", err)
+	}
+	buf.WriteString("private_key=" + key + "\n")
+	// mark udp packet of device, in case captured by proxy again
+	buf.WriteString("fwmark=" + strconv.Itoa(define.ProxyMark) + "\n")
+	buf.WriteString("replace_peers=true\n")
+	for index, peer := range cfg.Peers {
+		key, err = wgHexKey(peer.PublicKey)
+		if err != nil {
+			return "", fmt.Errorf("wireguard public key is invalid, err: %v", err)
+		}
+		buf.WriteString("public_key=" + key + "\n")
+		if peer.PresharedKey != "" {
+			key, err = wgHexKey(peer.PresharedKey)
+			if err != nil {
+				return "", fmt.Errorf("wireguard preshared key is invalid, err: %v", err)
+			}
+			buf.WriteString("preshared_key=" + key + "\n")
+		}
+		// first peer use proxy server as endpoint if not set
+		endpoint := peer.Endpoint
+		if endpoint == "" && index == 0 && proxy.Server != "" {
+			host, _ := parseProxyServer(proxy.Server)
+			endpoint = net.JoinHostPort(host, strconv.Itoa(proxy.Port))
+		}
+		if endpoint != "" {
+			// uapi only accept ip
+			addr, err := com.ResolveMarkUDPAddr(endpoint, define.ProxyMark)
+			if err != nil {
+				return "", fmt.Errorf("wireguard endpoint [%s] is invalid, err: %v", endpoint, err)
+			}
+			buf.WriteString("endpoint=" + addr.String() + "\n")
+		}
+		if peer.KeepAlive != 0 {
+			buf.WriteString("persistent_keepalive_interval=" + strconv.Itoa(peer.KeepAlive) + "\n")
+		}
+		buf.WriteString("replace_allowed_ips=true\n")
+		allowedIPs := peer.AllowedIPs
+		if len(allowedIPs) == 0 {
+			allowedIPs = []string{"0.0.0.0/0", "::/0"}
+		}
+		for _, elem := range allowedIPs {
+			buf.WriteString("allowed_ip=" + elem + "\n")
+		}
+	}
+	return buf.String(), nil
+}
+
+// key is base64 in config, but hex in uapi
+func wgHexKey(key string) (string, error) {
+	buf, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return "", err
+	}
+	if len(buf) != device.NoisePublicKeySize {
+		return "", fmt.Errorf("key size should be %v, but %v", device.NoisePublicKeySize, len(buf))
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// dial tcp in tunnel
+func (wg *wgDevice) dialTCP(rAddr net.Addr) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), wgDialTimeout)
+	defer cancel()
+	switch addr := rAddr.(type) {
+	case *net.TCPAddr:
+		return wg.tnet.DialContextTCP(ctx, addr)
+	case *DomainAddr:
+		// resolve by dns in tunnel, system resolver is outside tunnel and leak domain
+		if !wg.dns {
+			return nil, fmt.Errorf("wireguard dns is not set, cant resolve domain [%s] in tunnel", addr.Domain)
+		}
+		return wg.tnet.DialContext(ctx, "tcp", net.JoinHostPort(addr.Domain, strconv.Itoa(addr.Port)))
+	default:
+		return nil, fmt.Errorf("addr type %T is not supported", rAddr)
+	}
+}
+
+// resolve domain by dns in tunnel for udp
+func (wg *wgDevice) resolveUDP(addr *DomainAddr) (*net.UDPAddr, error) {
+	if !wg.dns {
+		return nil, fmt.Errorf("wireguard dns is not set, cant resolve domain [%s] in tunnel", addr.Domain)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), wgDialTimeout)
+	defer cancel()
+	hosts, err := wg.tnet.LookupContextHost(ctx, addr.Domain)
+	if err != nil {
+		return nil, err
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("domain [%s] has no address", addr.Domain)
+	}
+	ip := net.ParseIP(hosts[0])
+	if ip == nil {
+		return nil, fmt.Errorf("domain [%s] resolve to invalid address %s", addr.Domain, hosts[0])
+	}
+	return &net.UDPAddr{IP: ip, Port: addr.Port}, nil
+}
+
+type WireGuardHandler struct {
+	handlerPrv
+}
+
+func NewWireGuardHandler(scope define.Scope, key HandlerKey, proxy config.Proxy, lAddr net.Addr, rAddr net.Addr, lConn net.Conn) *WireGuardHandler {
+	// create new handler
+	handler := &WireGuardHandler{
+		handlerPrv: createHandlerPrv(WIREGUARD, scope, key, proxy, lAddr, rAddr, lConn),
+	}
+	// add self to private parent
+	handler.saveParent(handler)
+	return handler
+}
+
+// create tunnel between proxy and server
+func (handler *WireGuardHandler) Tunnel() error {
+	wg, err := handler.getWireGuard()
+	if err != nil {
+		logger.Warningf("[%s] create wireguard device failed, err: %v", handler.typ, err)
+		return err
+	}
+	rConn, err := wg.dialTCP(handler.rAddr)
+	if err != nil {
+		logger.Warningf("[%s] dial in wireguard tunnel failed, err: %v", handler.typ, err)
+		return err
+	}
+	logger.Infof("[%s] proxy: tunnel create success, [%s] -> [%s]",
+		handler.typ, handler.lAddr.String(), handler.rAddr.String())
+	// save rConn handler
+	handler.rConn = rConn
+	return nil
+}
@@ -0,0 +1,89 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package tproxy
+
+import (
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/linuxdeepin/deepin-network-proxy/config"
+	"github.com/linuxdeepin/deepin-network-proxy/define"
+)
+
+func TestWgHexKey(t *testing.T) {
+	raw := make([]byte, 32)
+	for index := range raw {
+		raw[index] = byte(index)
+	}
+	key, err := wgHexKey(base64.StdEncoding.EncodeToString(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f" {
+		t.Errorf("hex key is %s", key)
+	}
+	if _, err = wgHexKey(base64.StdEncoding.EncodeToString(raw[:16])); err == nil {
+		t.Error("short key should be refused")
+	}
+	if _, err = wgHexKey("not base64"); err == nil {
+		t.Error("invalid base64 should be refused")
+	}
+}
+
+// first peer use proxy server as endpoint, allowed ips default to all
+func TestWgUapiConfig(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	cfg := &config.WireGuardConfig{
+		PrivateKey: key,
+		Peers: []config.WireGuardPeer{
+			{PublicKey: key, PresharedKey: key, KeepAlive: 25},
+			{PublicKey: key, Endpoint: "10.0.0.1:51820", AllowedIPs: []string{"10.0.0.0/24"}},
+		},
+	}
+	uapi, err := wgUapiConfig(cfg, config.Proxy{Server: "1.2.3.4", Port: 51820})
+	if err != nil {
+		t.Fatal(err)
+	}
+	zero := strings.Repeat("00", 32)
+	want := "private_key=" + zero + "\n" +
+		"fwmark=" + strconv.Itoa(define.ProxyMark) + "\n" +
+		"replace_peers=true\n" +
+		"public_key=" + zero + "\n" +
+		"preshared_key=" + zero + "\n" +
+		"endpoint=1.2.3.4:51820\n" +
+		"persistent_keepalive_interval=25\n" +
+		"replace_allowed_ips=true\n" +
+		"allowed_ip=0.0.0.0/0\n" +
+		"allowed_ip=::/0\n" +
+		"public_key=" + zero + "\n" +
+		"endpoint=10.0.0.1:51820\n" +
+		"replace_allowed_ips=true\n" +
+		"allowed_ip=10.0.0.0/24\n"
+	if uapi != want {
+		t.Errorf("uapi is\n%s\nwant\n%s", uapi, want)
+	}
+
+	cfg.Peers = nil
+	if _, err = wgUapiConfig(cfg, config.Proxy{}); err == nil {
+		t.Error("config without peer should be refused")
+	}
+}
+
+// reloaded config with the same contents keep device, changed contents not
+func TestWgDeviceIdent(t *testing.T) {
+	proxy := config.Proxy{Server: "1.2.3.4", Port: 51820}
+	cfg := config.WireGuardConfig{PrivateKey: "a", Address: []string{"10.0.0.2"}}
+	reloaded := cfg
+	reloaded.Address = []string{"10.0.0.2"}
+	if wgDeviceIdent(&cfg, proxy) != wgDeviceIdent(&reloaded, proxy) {
+		t.Error("ident of the same contents should be equal")
+	}
+	reloaded.PrivateKey = "b"
+	if wgDeviceIdent(&cfg, proxy) == wgDeviceIdent(&reloaded, proxy) {
+		t.Error("ident of changed key should differ")
+	}
+}
@@ -0,0 +1,444 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package tproxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	capture payload of matched handlers to pcapng file, for debugging app which break under proxy.
+	payload is not captured from wire, each read and write is written as synthesized raw ip packet,
+	client side flow is between app and original destination, upstream flow is between proxy and proxy server,
+	tcp flow begin with handshake and carry continuous sequence, so that stream can be followed
+*/
+
+const (
+	// pcapng block types
+	pcapngSectionHeader  = 0x0A0D0D0A
+	pcapngInterface      = 0x00000001
+	pcapngEnhancedPacket = 0x00000006
+
+	pcapngByteOrderMagic = 0x1A2B3C4D
+	pcapngLinkTypeRaw    = 101
+
+	// payload of one packet, ip length field is 16 bits
+	captureMaxPayload = 65535 - 60 - 20
+
+	captureDefaultSize    = 100 * 1024 * 1024
+	captureDefaultTimeout = 10 * time.Minute
+)
+
+// handler is captured if match all fields, empty field match any
+type CaptureFilter struct {
+	Exe    string
+	Domain string // suffix match, example.com match www.example.com
+	Key    HandlerKey
+}
+
+type Capture struct {
+	filter  CaptureFilter
+	path    string
+	maxSize int64
+
+	lock   sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	size   int64
+	closed bool
+	timer  *time.Timer
+}
+
+// create capture file and write header, capture stop at max size or timeout, 0 as default
+func NewCapture(path string, filter CaptureFilter, maxSize int64, timeout time.Duration) (*Capture, error) {
+	if maxSize <= 0 {
+		maxSize = captureDefaultSize
+	}
+	if timeout <= 0 {
+		timeout = captureDefaultTimeout
+	}
+	// payload may contain secret, only root can read
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	capture := &Capture{
+		filter:  filter,
+		path:    path,
+		maxSize: maxSize,
+		file:    file,
+		writer:  bufio.NewWriter(file),
+	}
+	// section header, section length unknown
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb, pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[4:], 1)
+	binary.LittleEndian.PutUint64(shb[8:], ^uint64(0))
+	// interface of raw ip, no snap length
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb, pcapngLinkTypeRaw)
+	capture.timer = time.AfterFunc(timeout, func() {
+		logger.Infof("capture [%s] timeout", path)
+		_ = capture.Close()
+	})
+	capture.lock.Lock()
+	capture.writeBlock(pcapngSectionHeader, shb)
+	capture.writeBlock(pcapngInterface, idb)
+	capture.lock.Unlock()
+	logger.Infof("capture [%s] start, filter: %+v", path, filter)
+	return capture, nil
+}
+
+// file path
+func (capture *Capture) Path() string {
+	return capture.path
+}
+
+// check if handler should be captured, closed capture match nothing
+func (capture *Capture) Match(exe string, domain string, key HandlerKey) bool {
+	capture.lock.Lock()
+	closed := capture.closed
+	capture.lock.Unlock()
+	if closed {
+		return false
+	}
+	filter := capture.filter
+	if filter.Exe != "" && filter.Exe != exe {
+		return false
+	}
+	if filter.Domain != "" && domain != filter.Domain && !strings.HasSuffix(domain, "."+filter.Domain) {
+		return false
+	}
+	if filter.Key.SrcAddr != "" && filter.Key.SrcAddr != key.SrcAddr {
+		return false
+	}
+	if filter.Key.DstAddr != "" && filter.Key.DstAddr != key.DstAddr {
+		return false
+	}
+	return true
+}
+
+// check if filter need executable of handler
+func (capture *Capture) NeedExe() bool {
+	return capture.filter.Exe != ""
+}
+
+// stop capture and flush file
+func (capture *Capture) Close() error {
+	capture.lock.Lock()
+	defer capture.lock.Unlock()
+	if capture.closed {
+		return nil
+	}
+	capture.closed = true
+	capture.timer.Stop()
+	err := capture.writer.Flush()
+	if closeErr := capture.file.Close(); err == nil {
+		err = closeErr
+	}
+	logger.Infof("capture [%s] stop, size: %v", capture.path, capture.size)
+	return err
+}
+
+// write block with type and total length, body is padded to 32 bits, capture is closed if reach max size,
+// lock should be held
+func (capture *Capture) writeBlock(typ uint32, body []byte) {
+	pad := (4 - len(body)%4) % 4
+	total := 12 + len(body) + pad
+	if capture.size+int64(total) > capture.maxSize {
+		logger.Infof("capture [%s] reach max size", capture.path)
+		capture.closed = true
+		capture.timer.Stop()
+		_ = capture.writer.Flush()
+		_ = capture.file.Close()
+		return
+	}
+	head := make([]byte, 8)
+	binary.LittleEndian.PutUint32(head, typ)
+	binary.LittleEndian.PutUint32(head[4:], uint32(total))
+	_, _ = capture.writer.Write(head)
+	_, _ = capture.writer.Write(body)
+	_, _ = capture.writer.Write(make([]byte, pad))
+	_, _ = capture.writer.Write(head[4:])
+	capture.size += int64(total)
+}
+
+// write packet as enhanced packet block of interface 0
+func (capture *Capture) writePacket(packet []byte) {
+	capture.lock.Lock()
+	defer capture.lock.Unlock()
+	if capture.closed {
+		return
+	}
+	ts := uint64(time.Now().UnixNano() / int64(time.Microsecond))
+	body := make([]byte, 20, 20+len(packet))
+	binary.LittleEndian.PutUint32(body[4:], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(ts))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(body[16:], uint32(len(packet)))
+	capture.writeBlock(pcapngEnhancedPacket, append(body, packet...))
+}
+
+// endpoints of flow and tcp sequence of each direction
+type captureFlow struct {
+	capture *Capture
+	tcp     bool
+	client  captureAddr
+	server  captureAddr
+
+	lock sync.Mutex
+	seq  [2]uint32 // client to server, server to client
+	fin  [2]bool
+}
+
+type captureAddr struct {
+	ip   net.IP
+	port int
+}
+
+const (
+	tcpFlagFin = 0x01
+	tcpFlagSyn = 0x02
+	tcpFlagPsh = 0x08
+	tcpFlagAck = 0x10
+)
+
+// create flow between ip addrs, nil if addr has no ip
+func (capture *Capture) newFlow(client net.Addr, server net.Addr) *captureFlow {
+	flow := &captureFlow{capture: capture}
+	var ok bool
+	flow.tcp, flow.client, ok = parseCaptureAddr(client)
+	if !ok {
+		return nil
+	}
+	_, flow.server, ok = parseCaptureAddr(server)
+	if !ok {
+		return nil
+	}
+	// ip version of both side should be the same
+	if flow.client.ip.To4() == nil || flow.server.ip.To4() == nil {
+		flow.client.ip = flow.client.ip.To16()
+		flow.server.ip = flow.server.ip.To16()
+	} else {
+		flow.client.ip = flow.client.ip.To4()
+		flow.server.ip = flow.server.ip.To4()
+	}
+	if flow.tcp {
+		// handshake, isn of client and server
+		flow.seq = [2]uint32{1000, 2000}
+		flow.send(false, tcpFlagSyn, nil)
+		flow.seq[0]++
+		flow.send(true, tcpFlagSyn|tcpFlagAck, nil)
+		flow.seq[1]++
+		flow.send(false, tcpFlagAck, nil)
+	}
+	return flow
+}
+
+func parseCaptureAddr(addr net.Addr) (bool, captureAddr, bool) {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return true, captureAddr{ip: addr.IP, port: addr.Port}, addr.IP != nil
+	case *net.UDPAddr:
+		return false, captureAddr{ip: addr.IP, port: addr.Port}, addr.IP != nil
+	}
+	return false, captureAddr{}, false
+}
+
+// write payload in direction, split if larger than one packet
+func (flow *captureFlow) write(fromServer bool, payload []byte) {
+	flow.lock.Lock()
+	defer flow.lock.Unlock()
+	for len(payload) != 0 {
+		size := len(payload)
+		if size > captureMaxPayload {
+			size = captureMaxPayload
+		}
+		flow.send(fromServer, tcpFlagPsh|tcpFlagAck, payload[:size])
+		if fromServer {
+			flow.seq[1] += uint32(size)
+		} else {
+			flow.seq[0] += uint32(size)
+		}
+		payload = payload[size:]
+	}
+}
+
+// write fin in direction, only once
+func (flow *captureFlow) close(fromServer bool) {
+	if !flow.tcp {
+		return
+	}
+	flow.lock.Lock()
+	defer flow.lock.Unlock()
+	index := 0
+	if fromServer {
+		index = 1
+	}
+	if flow.fin[index] {
+		return
+	}
+	flow.fin[index] = true
+	flow.send(fromServer, tcpFlagFin|tcpFlagAck, nil)
+	flow.seq[index]++
+}
+
+// build ip packet and write to capture
+func (flow *captureFlow) send(fromServer bool, flags byte, payload []byte) {
+	src, dst := flow.client, flow.server
+	seq, ack := flow.seq[0], flow.seq[1]
+	if fromServer {
+		src, dst = dst, src
+		seq, ack = ack, seq
+	}
+	var segment []byte
+	var proto byte
+	if flow.tcp {
+		proto = 6
+		segment = make([]byte, 20, 20+len(payload))
+		binary.BigEndian.PutUint16(segment, uint16(src.port))
+		binary.BigEndian.PutUint16(segment[2:], uint16(dst.port))
+		binary.BigEndian.PutUint32(segment[4:], seq)
+		if flags&tcpFlagAck != 0 {
+			binary.BigEndian.PutUint32(segment[8:], ack)
+		}
+		segment[12] = 5 << 4
+		segment[13] = flags
+		binary.BigEndian.PutUint16(segment[14:], 65535)
+		segment = append(segment, payload...)
+	} else {
+		proto = 17
+		segment = make([]byte, 8, 8+len(payload))
+		binary.BigEndian.PutUint16(segment, uint16(src.port))
+		binary.BigEndian.PutUint16(segment[2:], uint16(dst.port))
+		binary.BigEndian.PutUint16(segment[4:], uint16(8+len(payload)))
+		segment = append(segment, payload...)
+	}
+	// checksum with pseudo header
+	pseudo := make([]byte, 0, 40)
+	pseudo = append(pseudo, src.ip...)
+	pseudo = append(pseudo, dst.ip...)
+	pseudo = append(pseudo, 0, proto, byte(len(segment)>>8), byte(len(segment)))
+	sumOffset := 16
+	if !flow.tcp {
+		sumOffset = 6
+	}
+	binary.BigEndian.PutUint16(segment[sumOffset:], checksum(pseudo, segment))
+
+	var packet []byte
+	if len(src.ip) == net.IPv4len {
+		packet = make([]byte, 20, 20+len(segment))
+		packet[0] = 0x45
+		binary.BigEndian.PutUint16(packet[2:], uint16(20+len(segment)))
+		packet[6] = 0x40 // dont fragment
+		packet[8] = 64
+		packet[9] = proto
+		copy(packet[12:], src.ip)
+		copy(packet[16:], dst.ip)
+		binary.BigEndian.PutUint16(packet[10:], checksum(packet[:20]))
+	} else {
+		packet = make([]byte, 40, 40+len(segment))
+		packet[0] = 0x60
+		binary.BigEndian.PutUint16(packet[4:], uint16(len(segment)))
+		packet[6] = proto
+		packet[7] = 64
+		copy(packet[8:], src.ip)
+		copy(packet[24:], dst.ip)
+	}
+	flow.capture.writePacket(append(packet, segment...))
+}
+
+// internet checksum of all data
+func checksum(data ...[]byte) uint16 {
+	var sum uint32
+	for _, buf := range data {
+		for i := 0; i+1 < len(buf); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(buf[i:]))
+		}
+		if len(buf)%2 == 1 {
+			sum += uint32(buf[len(buf)-1]) << 8
+		}
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// conn which write payload of each read and write to flow
+type captureConn struct {
+	net.Conn
+	flow *captureFlow
+	// data read from conn is sent by server, as upstream conn
+	readFromServer bool
+}
+
+func (conn *captureConn) Read(buf []byte) (int, error) {
+	n, err := conn.Conn.Read(buf)
+	if n > 0 {
+		conn.flow.write(conn.readFromServer, buf[:n])
+	}
+	if err != nil {
+		conn.flow.close(conn.readFromServer)
+	}
+	return n, err
+}
+
+func (conn *captureConn) Write(buf []byte) (int, error) {
+	n, err := conn.Conn.Write(buf)
+	if n > 0 {
+		conn.flow.write(!conn.readFromServer, buf[:n])
+	}
+	return n, err
+}
+
+// keep half close of tcp
+func (conn *captureConn) CloseWrite() error {
+	conn.flow.close(!conn.readFromServer)
+	return closeWrite(conn.Conn)
+}
+
+func (conn *captureConn) Close() error {
+	conn.flow.close(!conn.readFromServer)
+	return conn.Conn.Close()
+}
+
+// capture client side conn, data read from it is sent by app at lAddr to rAddr
+func (capture *Capture) WrapLocal(lConn net.Conn, lAddr net.Addr, rAddr net.Addr) net.Conn {
+	flow := capture.newFlow(lAddr, rAddr)
+	if flow == nil {
+		return lConn
+	}
+	return &captureConn{Conn: lConn, flow: flow}
+}
+
+// capture upstream conn, data read from it is sent by proxy server
+func (capture *Capture) wrapRemote(rConn net.Conn) net.Conn {
+	flow := capture.newFlow(rConn.LocalAddr(), rConn.RemoteAddr())
+	if flow == nil {
+		return rConn
+	}
+	return &captureConn{Conn: rConn, flow: flow, readFromServer: true}
+}
+
+// capture udp datagram between local and remote
+func (capture *Capture) writeDatagram(lAddr net.Addr, rAddr net.Addr, fromRemote bool, data []byte) {
+	flow := capture.newFlow(lAddr, rAddr)
+	if flow == nil {
+		return
+	}
+	flow.write(fromRemote, data)
+}
@@ -0,0 +1,113 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package tproxy
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// read packets of enhanced packet blocks
+func readPcapng(t *testing.T, path string) [][]byte {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var packets [][]byte
+	for len(buf) != 0 {
+		if len(buf) < 12 {
+			t.Fatalf("block is truncated, left: %v", len(buf))
+		}
+		typ := binary.LittleEndian.Uint32(buf)
+		total := int(binary.LittleEndian.Uint32(buf[4:]))
+		if total%4 != 0 || total > len(buf) || binary.LittleEndian.Uint32(buf[total-4:]) != uint32(total) {
+			t.Fatalf("block length %v is invalid", total)
+		}
+		if typ == pcapngEnhancedPacket {
+			size := binary.LittleEndian.Uint32(buf[20:])
+			packets = append(packets, buf[28:28+size])
+		}
+		buf = buf[total:]
+	}
+	return packets
+}
+
+// tcp flow start with handshake, payload of both directions is in order with valid checksum
+func TestCaptureTCP(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.pcapng")
+	capture, err := NewCapture(path, CaptureFilter{}, 0, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lAddr := &net.TCPAddr{IP: net.IP{192, 168, 1, 2}, Port: 50000}
+	rAddr := &net.TCPAddr{IP: net.IP{1, 2, 3, 4}, Port: 443}
+	client, server := net.Pipe()
+	conn := capture.WrapLocal(server, lAddr, rAddr)
+	go func() {
+		_, _ = client.Write([]byte("hello"))
+		buf := make([]byte, 5)
+		_, _ = client.Read(buf)
+	}()
+	buf := make([]byte, 5)
+	if _, err := conn.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	if err := capture.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	packets := readPcapng(t, path)
+	// syn, syn-ack, ack, data, data, fin
+	wantFlags := []byte{tcpFlagSyn, tcpFlagSyn | tcpFlagAck, tcpFlagAck,
+		tcpFlagPsh | tcpFlagAck, tcpFlagPsh | tcpFlagAck, tcpFlagFin | tcpFlagAck}
+	wantData := []string{"", "", "", "hello", "world", ""}
+	if len(packets) != len(wantFlags) {
+		t.Fatalf("captured %v packets, want %v", len(packets), len(wantFlags))
+	}
+	for index, packet := range packets {
+		if packet[0] != 0x45 || checksum(packet[:20]) != 0 {
+			t.Fatalf("packet %v has invalid ip header", index)
+		}
+		segment := packet[20:]
+		pseudo := append(append([]byte{}, packet[12:20]...), 0, 6, 0, byte(len(segment)))
+		if checksum(pseudo, segment) != 0 {
+			t.Errorf("packet %v has invalid tcp checksum", index)
+		}
+		if segment[13] != wantFlags[index] || string(segment[20:]) != wantData[index] {
+			t.Errorf("packet %v flags %x data %q, want %x %q", index, segment[13], segment[20:], wantFlags[index], wantData[index])
+		}
+	}
+	// reply from server continue sequence of syn-ack
+	if seq := binary.BigEndian.Uint32(packets[4][24:]); seq != 2001 {
+		t.Errorf("reply seq is %v, want 2001", seq)
+	}
+}
+
+func TestCaptureMatch(t *testing.T) {
+	capture := &Capture{filter: CaptureFilter{Exe: "/usr/bin/curl", Domain: "example.com"}}
+	tests := []struct {
+		exe    string
+		domain string
+		match  bool
+	}{
+		{"/usr/bin/curl", "example.com", true},
+		{"/usr/bin/curl", "www.example.com", true},
+		{"/usr/bin/curl", "badexample.com", false},
+		{"/usr/bin/wget", "example.com", false},
+	}
+	for _, test := range tests {
+		if capture.Match(test.exe, test.domain, HandlerKey{}) != test.match {
+			t.Errorf("match %s %s should be %v", test.exe, test.domain, test.match)
+		}
+	}
+}
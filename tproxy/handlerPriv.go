@@ -5,19 +5,23 @@
 package tproxy
 
 import (
+	"context"
 	"errors"
-	"io"
 	"net"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/linuxdeepin/deepin-network-proxy/com"
 	"github.com/linuxdeepin/deepin-network-proxy/config"
 	"github.com/linuxdeepin/deepin-network-proxy/define"
 )
 
 // handler private, data of handler
 
+var errIdleTimeout = errors.New("idle timeout")
+
 type handlerPrv struct {
 	typ ProtoTyp
 
@@ -36,6 +40,21 @@ type handlerPrv struct {
 	key    HandlerKey
 	mgr    *HandlerMgr
 
+	// limit of scope and executable, tunnel is counted in them until closed
+	limiters []*Limiter
+
+	// called once with traffic when relay stopped, first error is close reason
+	closeHook func(upload int64, download int64, reason error)
+	upload    int64
+	download  int64
+	reason    error
+
+	// payload is captured if set
+	capture *Capture
+
+	// when handler created, as start of connection
+	start time.Time
+
 	// delete mark, in case if delete twice, not use this time
 	deleted bool
 	lock    sync.Mutex
@@ -59,6 +78,8 @@ func createHandlerPrv(typ ProtoTyp, scope define.Scope, key HandlerKey, proxy co
 
 		// delete mark
 		deleted: false,
+
+		start: time.Now(),
 	}
 }
 
@@ -67,6 +88,81 @@ func (pr *handlerPrv) saveParent(parent BaseHandler) {
 	pr.parent = parent
 }
 
+// save limiters, handler release them when closed
+func (pr *handlerPrv) SetLimiters(limiters []*Limiter) {
+	pr.lock.Lock()
+	defer pr.lock.Unlock()
+	pr.limiters = limiters
+}
+
+// get limiters without taking them
+func (pr *handlerPrv) getLimiters() []*Limiter {
+	pr.lock.Lock()
+	defer pr.lock.Unlock()
+	return pr.limiters
+}
+
+// take limiters, in case release twice
+func (pr *handlerPrv) takeLimiters() []*Limiter {
+	pr.lock.Lock()
+	defer pr.lock.Unlock()
+	limiters := pr.limiters
+	pr.limiters = nil
+	return limiters
+}
+
+// capture payload of upstream, client side conn is wrapped by caller
+func (pr *handlerPrv) SetCapture(capture *Capture) {
+	pr.capture = capture
+}
+
+// save hook called when relay stopped
+func (pr *handlerPrv) SetCloseHook(hook func(upload int64, download int64, reason error)) {
+	pr.lock.Lock()
+	defer pr.lock.Unlock()
+	pr.closeHook = hook
+}
+
+// keep first error as close reason, error after that is caused by close usually
+func (pr *handlerPrv) setReason(err error) {
+	pr.lock.Lock()
+	defer pr.lock.Unlock()
+	if pr.reason == nil {
+		pr.reason = err
+	}
+}
+
+// call close hook with traffic, only once
+func (pr *handlerPrv) report() {
+	pr.lock.Lock()
+	hook := pr.closeHook
+	pr.closeHook = nil
+	pr.lock.Unlock()
+	if hook == nil {
+		return
+	}
+	hook(atomic.LoadInt64(&pr.upload), atomic.LoadInt64(&pr.download), pr.getReason())
+}
+
+// current state of handler, traffic is counted until now
+func (pr *handlerPrv) Stat() define.HandlerStat {
+	return define.HandlerStat{
+		Proto:       pr.typ.String(),
+		Proxy:       pr.proxy.Name,
+		Source:      pr.lAddr.String(),
+		Destination: pr.rAddr.String(),
+		Start:       pr.start,
+		Upload:      atomic.LoadInt64(&pr.upload),
+		Download:    atomic.LoadInt64(&pr.download),
+	}
+}
+
+func (pr *handlerPrv) getReason() error {
+	pr.lock.Lock()
+	defer pr.lock.Unlock()
+	return pr.reason
+}
+
 // add private to manager and save manager
 func (pr *handlerPrv) AddMgr(mgr *HandlerMgr) {
 	// check parent
@@ -79,18 +175,80 @@ func (pr *handlerPrv) AddMgr(mgr *HandlerMgr) {
 	mgr.AddHandler(pr.typ, pr.key, pr.parent)
 }
 
-// tcp connect to remote server
+// connect to proxy server, through transport if set
 func (pr *handlerPrv) dialProxy() (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if pr.proxy.Transport != nil && pr.proxy.Transport.Type != "" {
+		conn, err = pr.dialTransport()
+	} else {
+		conn, err = pr.dialServer()
+	}
+	if err != nil {
+		return nil, err
+	}
+	// dead server dont hang handshake, deadline is cleared when communicate
+	if timeout := pr.handshakeTimeout(); timeout != 0 {
+		_ = conn.SetDeadline(time.Now().Add(timeout))
+	}
+	return conn, nil
+}
+
+// resolve ipv4 of domain locally, dns query is marked, in case captured by proxy again
+func (pr *handlerPrv) resolveIP4(domain string) (net.IP, error) {
+	resolver := com.NewMarkResolver(pr.handshakeTimeout(), define.ProxyMark)
+	ctx := context.Background()
+	if timeout := pr.handshakeTimeout(); timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	ips, err := resolver.LookupIP(ctx, "ip4", domain)
+	if err != nil {
+		return nil, err
+	}
+	return ips[0], nil
+}
+
+// tcp connect to remote server
+func (pr *handlerPrv) dialServer() (net.Conn, error) {
 	proxy := pr.proxy
+	// server may be as https://proxy.com
+	host, useTLS := parseProxyServer(proxy.Server)
+	// trojan and h2 transport always run over tls
+	useTLS = useTLS || proxy.TLS != nil || pr.typ == TROJAN || pr.typ == TROJANUDP
+	useTLS = useTLS || (proxy.Transport != nil && proxy.Transport.Type == transportH2)
 	if proxy.Port == 0 {
 		proxy.Port = 80
+		if useTLS {
+			proxy.Port = 443
+		}
+	}
+	server := net.JoinHostPort(host, strconv.Itoa(proxy.Port))
+	// mark connection and dns query of server domain, in case captured by proxy again
+	dialer := com.NewMarkDialer(pr.handshakeTimeout(), define.ProxyMark)
+	dialer.KeepAlive = pr.tcpKeepAlive()
+	if dialer.KeepAlive == 0 {
+		dialer.KeepAlive = -1
 	}
-	server := proxy.Server + ":" + strconv.Itoa(proxy.Port)
-	conn, err := net.DialTimeout("tcp", server, 3*time.Second)
+	conn, err := dialer.Dial("tcp", server)
 	if err != nil {
 		logger.Warningf("[%s] dial proxy server failed, err: %v", pr.typ, err)
 		return nil, err
 	}
+	// capture raw bytes with proxy server, before tls
+	if pr.capture != nil {
+		conn = pr.capture.wrapRemote(conn)
+	}
+	// credentials and target dont cross network in clear text
+	if useTLS {
+		tlsConn, err := pr.wrapTLS(conn, host)
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
 	logger.Infof("[%s] dial proxy server success, local [%s] -> remote [%s]", pr.typ, conn.LocalAddr(), conn.RemoteAddr())
 	return conn, nil
 }
@@ -145,36 +303,80 @@ func (pr *handlerPrv) ReadLocal(buf []byte) error {
 	return nil
 }
 
-// communicate lConn and rConn
+// communicate lConn and rConn, one direction may be half-closed while the other goes on
 func (pr *handlerPrv) Communicate() {
-	go func() {
-		logger.Infof("[%s] begin copy data, remote [%s] -> local [%s]", pr.typ, pr.rAddr.String(), pr.lAddr.String())
-		_, err := io.Copy(pr.rConn, pr.lConn)
-		if err != nil {
-			logger.Infof("[%s] stop copy data, remote [%s] -x- local [%s], reason: %v", pr.typ, pr.rAddr.String(), pr.lAddr.String(), err)
+	// handshake is done
+	_ = pr.rConn.SetDeadline(time.Time{})
+	pr.setKeepAlive(pr.lConn)
+	act := newRelayActivity()
+	limiters := pr.getLimiters()
+	// directions not finished yet
+	left := int32(2)
+	var wg sync.WaitGroup
+	copyData := func(dst net.Conn, src net.Conn, from net.Addr, to net.Addr, buckets []*tokenBucket, count *int64) {
+		defer wg.Done()
+		logger.Infof("[%s] begin copy data, [%s] -> [%s]", pr.typ, from.String(), to.String())
+		_, err := relay(dst, src, act, buckets, count)
+		if err == nil {
+			// src send EOF, pass it to dst
+			err = closeWrite(dst)
+			if err == nil && atomic.AddInt32(&left, -1) != 0 {
+				logger.Debugf("[%s] half close, [%s] -> [%s]", pr.typ, from.String(), to.String())
+				return
+			}
+			// dst cant be half closed, close tunnel as normal end
+			if errors.Is(err, errCloseWriteUnsupported) {
+				logger.Debugf("[%s] close tunnel, [%s] cant be half closed", pr.typ, to.String())
+				err = nil
+			}
 		}
-		// mark deleted, but not actually deleted at this time, only set a mark
-		if pr.isDeleted() {
-			return
+		// error after tunnel closed is caused by close, not a reason
+		if err != nil && !pr.isDeleted() {
+			pr.setReason(err)
+			logger.Infof("[%s] stop copy data, [%s] -x- [%s], reason: %v", pr.typ, from.String(), to.String(), err)
 		}
-		pr.setDeleted(true)
-		// remove handler from map
-		pr.Remove()
-	}()
+		pr.finish()
+	}
+	wg.Add(2)
+	go copyData(pr.rConn, pr.lConn, pr.lAddr, pr.rAddr, uploadBuckets(limiters), &pr.upload)
+	go copyData(pr.lConn, pr.rConn, pr.rAddr, pr.lAddr, downloadBuckets(limiters), &pr.download)
+	// traffic is complete after both directions stopped
 	go func() {
-		logger.Infof("[%s] begin copy data, local [%s] -> remote [%s]", pr.typ, pr.lAddr.String(), pr.rAddr.String())
-		_, err := io.Copy(pr.lConn, pr.rConn)
-		if err != nil {
-			logger.Infof("[%s] stop copy data, local [%s] -x- remote [%s], reason: %v", pr.typ, pr.lAddr.String(), pr.rAddr.String(), err)
-		}
-		// mark deleted, but not actually deleted at this time, only set a mark
+		wg.Wait()
+		pr.report()
+	}()
+	if timeout := pr.idleTimeout(); timeout != 0 {
+		go pr.watchIdle(act, timeout)
+	}
+}
+
+// close tunnel if no data in timeout
+func (pr *handlerPrv) watchIdle(act *relayActivity, timeout time.Duration) {
+	ticker := time.NewTicker(relayCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
 		if pr.isDeleted() {
 			return
 		}
-		pr.setDeleted(true)
-		// remove handler from map
-		pr.Remove()
-	}()
+		if act.idle() < timeout {
+			continue
+		}
+		logger.Infof("[%s] tunnel idle timeout, local [%s] -x- remote [%s]", pr.typ, pr.lAddr.String(), pr.rAddr.String())
+		pr.setReason(errIdleTimeout)
+		pr.finish()
+		return
+	}
+}
+
+// remove handler once relay stopped
+func (pr *handlerPrv) finish() {
+	// mark deleted, but not actually deleted at this time, only set a mark
+	if pr.isDeleted() {
+		return
+	}
+	pr.setDeleted(true)
+	// remove handler from map
+	pr.Remove()
 }
 
 // mark deleted, not used this time
@@ -194,6 +396,7 @@ func (pr *handlerPrv) isDeleted() bool {
 
 // close handler
 func (pr *handlerPrv) Close() {
+	ReleaseLimiters(pr.takeLimiters())
 	if pr.lConn != nil {
 		_ = pr.lConn.Close()
 	}
@@ -0,0 +1,199 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package tproxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/linuxdeepin/deepin-network-proxy/com"
+)
+
+const (
+	// buffer size of relay stream
+	relayBufferSize = 32 * 1024
+	// interval to check idle tunnel, spliced stream record activity in this interval too
+	relayCheckInterval = 5 * time.Second
+
+	defaultHandshakeTimeout = 30 * time.Second
+	defaultIdleTimeout      = 300 * time.Second
+	defaultTcpKeepAlive     = 30 * time.Second
+)
+
+var errRelayLimited = errors.New("relay is limited")
+
+// stream as websocket and mux cant be half closed, tunnel is closed instead
+var errCloseWriteUnsupported = errors.New("close write is not supported")
+
+// buffers of stream relay and udp relay, shared by all handlers
+var relayBufferPool = com.NewBufferPool(relayBufferSize)
+var udpBufferPool = com.NewBufferPool(udpBufferSize + udpHeaderSize)
+
+// seconds in config as duration, 0 as default, negative as disabled
+func configDuration(seconds int, def time.Duration) time.Duration {
+	if seconds == 0 {
+		return def
+	}
+	if seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// timeout of dial and proto handshake with proxy server, 0 if disabled
+func (pr *handlerPrv) handshakeTimeout() time.Duration {
+	return configDuration(pr.proxy.HandshakeTimeout, defaultHandshakeTimeout)
+}
+
+// timeout of tunnel without data, 0 if disabled
+func (pr *handlerPrv) idleTimeout() time.Duration {
+	return configDuration(pr.proxy.IdleTimeout, defaultIdleTimeout)
+}
+
+// tcp keepalive period, 0 if disabled
+func (pr *handlerPrv) tcpKeepAlive() time.Duration {
+	return configDuration(pr.proxy.TcpKeepAlive, defaultTcpKeepAlive)
+}
+
+// set tcp keepalive of connection as config
+func (pr *handlerPrv) setKeepAlive(conn net.Conn) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	period := pr.tcpKeepAlive()
+	if period == 0 {
+		_ = tcpConn.SetKeepAlive(false)
+		return
+	}
+	_ = tcpConn.SetKeepAlive(true)
+	_ = tcpConn.SetKeepAlivePeriod(period)
+}
+
+// last time data relayed in any direction of tunnel
+type relayActivity struct {
+	last int64
+}
+
+func newRelayActivity() *relayActivity {
+	act := &relayActivity{}
+	act.touch()
+	return act
+}
+
+func (act *relayActivity) touch() {
+	atomic.StoreInt64(&act.last, time.Now().UnixNano())
+}
+
+// duration since last data
+func (act *relayActivity) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&act.last)))
+}
+
+// hide ReadFrom of writer, so that io.CopyBuffer use the given buffer
+type writerOnly struct {
+	io.Writer
+}
+
+// hide WriteTo of reader, so that io.CopyBuffer use the given buffer
+type readerOnly struct {
+	io.Reader
+}
+
+// count bytes written, hide ReadFrom of writer too
+type countWriter struct {
+	io.Writer
+	count *int64
+}
+
+func (writer countWriter) Write(buf []byte) (int, error) {
+	n, err := writer.Writer.Write(buf)
+	atomic.AddInt64(writer.count, int64(n))
+	return n, err
+}
+
+// record activity of each read, hide WriteTo too
+type activeReader struct {
+	io.Reader
+	act *relayActivity
+}
+
+func (reader activeReader) Read(buf []byte) (int, error) {
+	n, err := reader.Reader.Read(buf)
+	if n > 0 {
+		reader.act.touch()
+	}
+	return n, err
+}
+
+// copy data from src to dst until EOF, wait for tokens of buckets if limited,
+// splice between tcp sockets if data need no transform and not limited, use pooled buffer otherwise,
+// bytes are added to count while copying, so that live connection show its traffic
+func relay(dst net.Conn, src net.Conn, act *relayActivity, buckets []*tokenBucket, count *int64) (int64, error) {
+	var written int64
+	if tcpDst, ok := dst.(*net.TCPConn); ok && !limited(buckets) {
+		if tcpSrc, ok := src.(*net.TCPConn); ok {
+			n, err := spliceRelay(tcpDst, tcpSrc, act, buckets, count)
+			if err != errRelayLimited {
+				return n, err
+			}
+			// limit is set while splicing, go on with buffer
+			written = n
+		}
+	}
+	buf := relayBufferPool.Get()
+	defer relayBufferPool.Put(buf)
+	var reader io.Reader = activeReader{Reader: src, act: act}
+	if len(buckets) != 0 {
+		reader = limitReader{Reader: reader, buckets: buckets}
+	}
+	n, err := io.CopyBuffer(countWriter{Writer: dst, count: count}, reader, *buf)
+	return written + n, err
+}
+
+// ReadFrom of tcp use splice(2) on linux, data stay in kernel,
+// read deadline wake it up periodically to record activity and check limit
+func spliceRelay(dst *net.TCPConn, src *net.TCPConn, act *relayActivity, buckets []*tokenBucket, count *int64) (int64, error) {
+	var written int64
+	for {
+		_ = src.SetReadDeadline(time.Now().Add(relayCheckInterval))
+		n, err := dst.ReadFrom(src)
+		written += n
+		if n > 0 {
+			atomic.AddInt64(count, n)
+			act.touch()
+		}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			if limited(buckets) {
+				_ = src.SetReadDeadline(time.Time{})
+				return written, errRelayLimited
+			}
+			continue
+		}
+		return written, err
+	}
+}
+
+// any bucket has rate
+func limited(buckets []*tokenBucket) bool {
+	for _, bucket := range buckets {
+		if bucket.burst() > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// shutdown write side only, peer read EOF but can still send
+func closeWrite(conn net.Conn) error {
+	writeCloser, ok := conn.(interface{ CloseWrite() error })
+	if !ok {
+		return errCloseWriteUnsupported
+	}
+	return writeCloser.CloseWrite()
+}
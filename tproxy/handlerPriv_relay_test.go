@@ -0,0 +1,210 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package tproxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/linuxdeepin/deepin-network-proxy/config"
+	"github.com/linuxdeepin/deepin-network-proxy/define"
+)
+
+// conn which is not *net.TCPConn, relay can not splice
+type wrappedConn struct {
+	net.Conn
+}
+
+// relay pipe over loopback, writer -> src -relay-> dst -> sink
+type relayPipe struct {
+	writer net.Conn
+	src    net.Conn
+	dst    net.Conn
+	sink   net.Conn
+}
+
+func newRelayPipe(t testing.TB) *relayPipe {
+	accept := func() (net.Conn, net.Conn) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		client, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client, server
+	}
+	pipe := &relayPipe{}
+	pipe.writer, pipe.src = accept()
+	pipe.dst, pipe.sink = accept()
+	return pipe
+}
+
+func (pipe *relayPipe) close() {
+	_ = pipe.writer.Close()
+	_ = pipe.src.Close()
+	_ = pipe.dst.Close()
+	_ = pipe.sink.Close()
+}
+
+// data is the same after relay, with and without splice
+func TestRelay(t *testing.T) {
+	data := bytes.Repeat([]byte("deepin-network-proxy"), 64*1024)
+	for _, wrap := range []bool{false, true} {
+		pipe := newRelayPipe(t)
+		go func() {
+			_, _ = pipe.writer.Write(data)
+			_ = pipe.writer.Close()
+		}()
+		go func() {
+			var dst, src net.Conn = pipe.dst, pipe.src
+			if wrap {
+				dst, src = wrappedConn{dst}, wrappedConn{src}
+			}
+			var count int64
+			_, _ = relay(dst, src, newRelayActivity(), nil, &count)
+			_ = pipe.dst.Close()
+		}()
+		recv, err := ioutil.ReadAll(pipe.sink)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(recv, data) {
+			t.Errorf("wrap: %v, relay data dont match, len: %v, want: %v", wrap, len(recv), len(data))
+		}
+		pipe.close()
+	}
+}
+
+// local half-close request, remote can still send response, as ssh host cmd < file
+func TestCommunicateHalfClose(t *testing.T) {
+	// writer as local app, sink as remote server
+	pipe := newRelayPipe(t)
+	defer pipe.close()
+	handler := NewTrojanHandler(define.Global, HandlerKey{SrcAddr: "test"}, config.Proxy{},
+		pipe.src.RemoteAddr(), pipe.dst.RemoteAddr(), pipe.src)
+	handler.rConn = pipe.dst
+	handler.AddMgr(NewHandlerMgr(define.Global))
+	traffic := make(chan [2]int64, 1)
+	handler.SetCloseHook(func(upload int64, download int64, reason error) {
+		traffic <- [2]int64{upload, download}
+	})
+	handler.Communicate()
+
+	_, _ = pipe.writer.Write([]byte("request"))
+	_ = pipe.writer.(*net.TCPConn).CloseWrite()
+	req, err := ioutil.ReadAll(pipe.sink)
+	if err != nil || string(req) != "request" {
+		t.Fatalf("remote read request failed, data: %q, err: %v", req, err)
+	}
+	_, _ = pipe.sink.Write([]byte("response"))
+	_ = pipe.sink.Close()
+	resp, err := ioutil.ReadAll(pipe.writer)
+	if err != nil || string(resp) != "response" {
+		t.Fatalf("local read response failed, data: %q, err: %v", resp, err)
+	}
+	// traffic is reported after both directions closed
+	if got := <-traffic; got != [2]int64{7, 8} {
+		t.Errorf("traffic is %v, want [7 8]", got)
+	}
+}
+
+// remote cant be half closed, tunnel is closed without error reason
+func TestCommunicateCloseWriteUnsupported(t *testing.T) {
+	pipe := newRelayPipe(t)
+	defer pipe.close()
+	handler := NewTrojanHandler(define.Global, HandlerKey{SrcAddr: "test"}, config.Proxy{},
+		pipe.src.RemoteAddr(), pipe.dst.RemoteAddr(), pipe.src)
+	handler.rConn = wrappedConn{pipe.dst}
+	handler.AddMgr(NewHandlerMgr(define.Global))
+	reasons := make(chan error, 1)
+	handler.SetCloseHook(func(upload int64, download int64, reason error) {
+		reasons <- reason
+	})
+	handler.Communicate()
+
+	_, _ = pipe.writer.Write([]byte("request"))
+	_ = pipe.writer.(*net.TCPConn).CloseWrite()
+	req, err := ioutil.ReadAll(pipe.sink)
+	if err != nil || string(req) != "request" {
+		t.Fatalf("remote read request failed, data: %q, err: %v", req, err)
+	}
+	if reason := <-reasons; reason != nil {
+		t.Errorf("close reason is %v, want nil", reason)
+	}
+}
+
+// cpu time of process, user and system
+func cpuTime() time.Duration {
+	var usage syscall.Rusage
+	_ = syscall.Getrusage(syscall.RUSAGE_SELF, &usage)
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+// relay b.N chunks, report throughput and cpu time per GB,
+// writer and sink run in the same process, cost of them is the same in each case
+func benchmarkRelay(b *testing.B, copyFn func(dst net.Conn, src net.Conn) (int64, error)) {
+	const chunk = 64 * 1024
+	pipe := newRelayPipe(b)
+	defer pipe.close()
+	go func() {
+		buf := make([]byte, chunk)
+		for i := 0; i < b.N; i++ {
+			_, _ = pipe.writer.Write(buf)
+		}
+		_ = pipe.writer.Close()
+	}()
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, pipe.sink)
+		close(done)
+	}()
+	b.SetBytes(chunk)
+	b.ResetTimer()
+	start := cpuTime()
+	_, err := copyFn(pipe.dst, pipe.src)
+	if err != nil {
+		b.Fatal(err)
+	}
+	_ = pipe.dst.Close()
+	<-done
+	b.StopTimer()
+	gb := float64(b.N) * chunk / (1 << 30)
+	b.ReportMetric((cpuTime()-start).Seconds()/gb, "cpu-s/GB")
+}
+
+// before: io.Copy allocate buffer for each relay, data copied in user space
+func BenchmarkRelayCopy(b *testing.B) {
+	benchmarkRelay(b, func(dst net.Conn, src net.Conn) (int64, error) {
+		return io.Copy(writerOnly{dst}, readerOnly{src})
+	})
+}
+
+// after: transformed stream use pooled buffer
+func BenchmarkRelayPooled(b *testing.B) {
+	benchmarkRelay(b, func(dst net.Conn, src net.Conn) (int64, error) {
+		var count int64
+		return relay(wrappedConn{dst}, wrappedConn{src}, newRelayActivity(), nil, &count)
+	})
+}
+
+// after: plain tcp stream is spliced
+func BenchmarkRelaySplice(b *testing.B) {
+	benchmarkRelay(b, func(dst net.Conn, src net.Conn) (int64, error) {
+		var count int64
+		return relay(dst, src, newRelayActivity(), nil, &count)
+	})
+}
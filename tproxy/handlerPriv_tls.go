@@ -0,0 +1,174 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package tproxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/linuxdeepin/deepin-network-proxy/config"
+)
+
+// tls config of proxy server, key is contents of config and host, build once and share session cache
+var tlsConfigMap sync.Map
+
+// drop cached tls config, reloaded cert and key file will be read again
+func ClearTLSConfigs() {
+	tlsConfigMap.Range(func(key, value interface{}) bool {
+		tlsConfigMap.Delete(key)
+		return true
+	})
+}
+
+// split scheme from server, as https://proxy.com -> proxy.com, true
+func parseProxyServer(server string) (string, bool) {
+	if strings.HasPrefix(server, "https://") {
+		return strings.TrimSuffix(strings.TrimPrefix(server, "https://"), "/"), true
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(server, "http://"), "/"), false
+}
+
+// wrap connection to proxy server with tls
+func (pr *handlerPrv) wrapTLS(conn net.Conn, host string) (net.Conn, error) {
+	cfg, err := getTLSConfig(pr.proxy.TLS, host)
+	if err != nil {
+		logger.Warningf("[%s] make tls config failed, err: %v", pr.typ, err)
+		return nil, err
+	}
+	// h2 transport must negotiate h2
+	if pr.proxy.Transport != nil && pr.proxy.Transport.Type == transportH2 {
+		cfg = cfg.Clone()
+		cfg.NextProtos = []string{"h2"}
+	}
+	tlsConn := tls.Client(conn, cfg)
+	// dont wait forever if server not speak tls
+	if timeout := pr.handshakeTimeout(); timeout != 0 {
+		_ = tlsConn.SetDeadline(time.Now().Add(timeout))
+	}
+	err = tlsConn.Handshake()
+	if err != nil {
+		logger.Warningf("[%s] tls handshake with proxy server failed, err: %v", pr.typ, err)
+		return nil, err
+	}
+	_ = tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// get tls config from cache or build new one
+func getTLSConfig(cfg *config.TLSConfig, host string) (*tls.Config, error) {
+	// https:// without tls section, use default
+	if cfg == nil {
+		return &tls.Config{ServerName: host}, nil
+	}
+	// config is reloaded as new pointer, use contents as key
+	key := fmt.Sprintf("%+v|%s", *cfg, host)
+	if value, ok := tlsConfigMap.Load(key); ok {
+		return value.(*tls.Config), nil
+	}
+	tlsCfg, err := newTLSConfig(cfg, host)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfigMap.Store(key, tlsCfg)
+	return tlsCfg, nil
+}
+
+// build tls config
+func newTLSConfig(cfg *config.TLSConfig, host string) (*tls.Config, error) {
+	tlsCfg := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+		NextProtos:         cfg.ALPN,
+	}
+	if tlsCfg.ServerName == "" {
+		tlsCfg.ServerName = host
+	}
+	// ca bundle
+	if cfg.CAFile != "" {
+		buf, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(buf) {
+			return nil, fmt.Errorf("no certificate found in ca file %s", cfg.CAFile)
+		}
+		tlsCfg.RootCAs = pool
+	}
+	// client certificate
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	// public key pinning and certificate fingerprint
+	pins := make(map[string]bool)
+	for _, pin := range cfg.PinSHA256 {
+		pins[strings.TrimPrefix(pin, "sha256/")] = true
+	}
+	fingerprint := strings.ToLower(strings.ReplaceAll(cfg.Fingerprint, ":", ""))
+	if len(pins) != 0 || fingerprint != "" {
+		tlsCfg.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			if fingerprint != "" {
+				err := verifyFingerprint(fingerprint, rawCerts)
+				if err != nil {
+					return err
+				}
+			}
+			if len(pins) != 0 {
+				return verifyPins(pins, rawCerts, verifiedChains)
+			}
+			return nil
+		}
+	}
+	return tlsCfg, nil
+}
+
+// check if leaf cert match fingerprint
+func verifyFingerprint(fingerprint string, rawCerts [][]byte) error {
+	if len(rawCerts) == 0 {
+		return errors.New("proxy server has no certificate")
+	}
+	sum := sha256.Sum256(rawCerts[0])
+	if hex.EncodeToString(sum[:]) != fingerprint {
+		return errors.New("proxy server certificate dont match fingerprint")
+	}
+	return nil
+}
+
+// check if any cert match pins, only leaf is checked when chain is not verified
+func verifyPins(pins map[string]bool, rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	var certs []*x509.Certificate
+	for _, chain := range verifiedChains {
+		certs = append(certs, chain...)
+	}
+	if len(certs) == 0 && len(rawCerts) != 0 {
+		leaf, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		certs = append(certs, leaf)
+	}
+	for _, cert := range certs {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		if pins[base64.StdEncoding.EncodeToString(sum[:])] {
+			return nil
+		}
+	}
+	return errors.New("proxy server certificate dont match any pin")
+}
@@ -0,0 +1,564 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package tproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/linuxdeepin/deepin-network-proxy/define"
+	"github.com/xtaci/smux"
+)
+
+const (
+	transportWS = "ws"
+	transportH2 = "h2"
+
+	// magic of websocket accept key, RFC6455
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	// websocket opcode
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+// shared transport connection is kept for each proxy in scope
+type transportKey struct {
+	scope define.Scope
+	ident string
+}
+
+// session in cache, ready is closed when dial and handshake finished
+type muxSessionEntry struct {
+	ready   chan struct{}
+	session *smux.Session
+	err     error
+}
+
+var muxSessionMap = make(map[transportKey]*muxSessionEntry)
+var h2TransportMap = make(map[transportKey]*http.Transport)
+var transportLock sync.Mutex
+
+// key of shared transport, config reloaded with the same contents keep the connection
+func (pr *handlerPrv) transportKey() transportKey {
+	ident := fmt.Sprintf("%+v|%s|%d", *pr.proxy.Transport, pr.proxy.Server, pr.proxy.Port)
+	if pr.proxy.TLS != nil {
+		ident += fmt.Sprintf("|%+v", *pr.proxy.TLS)
+	}
+	return transportKey{scope: pr.scope, ident: ident}
+}
+
+// close shared transport connections of scope
+func CloseTransport(scope define.Scope) {
+	transportLock.Lock()
+	defer transportLock.Unlock()
+	for key, entry := range muxSessionMap {
+		if key.scope != scope {
+			continue
+		}
+		delete(muxSessionMap, key)
+		// session still in dial is closed by dialer, as it is not in cache anymore
+		select {
+		case <-entry.ready:
+			if entry.session != nil {
+				_ = entry.session.Close()
+			}
+		default:
+		}
+	}
+	for key, transport := range h2TransportMap {
+		if key.scope != scope {
+			continue
+		}
+		transport.CloseIdleConnections()
+		delete(h2TransportMap, key)
+	}
+	logger.Debugf("[%s] shared transport closed", scope)
+}
+
+// connect to proxy server through transport
+func (pr *handlerPrv) dialTransport() (net.Conn, error) {
+	cfg := pr.proxy.Transport
+	switch cfg.Type {
+	case transportWS:
+		if cfg.Mux {
+			return pr.dialMux()
+		}
+		return pr.dialWebSocket()
+	case transportH2:
+		return pr.dialH2()
+	default:
+		return nil, fmt.Errorf("transport [%s] is not supported", cfg.Type)
+	}
+}
+
+// host and path of transport request
+func (pr *handlerPrv) transportTarget() (string, string) {
+	cfg := pr.proxy.Transport
+	host, _ := parseProxyServer(pr.proxy.Server)
+	if cfg.Host != "" {
+		host = cfg.Host
+	}
+	path := cfg.Path
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return host, path
+}
+
+// dial server and upgrade to websocket
+func (pr *handlerPrv) dialWebSocket() (net.Conn, error) {
+	conn, err := pr.dialServer()
+	if err != nil {
+		return nil, err
+	}
+	wsConn, err := pr.wsHandshake(conn)
+	if err != nil {
+		logger.Warningf("[%s] websocket handshake failed, err: %v", pr.typ, err)
+		_ = conn.Close()
+		return nil, err
+	}
+	return wsConn, nil
+}
+
+// send websocket upgrade request and check response
+func (pr *handlerPrv) wsHandshake(conn net.Conn) (net.Conn, error) {
+	host, path := pr.transportTarget()
+	req, err := http.NewRequest(http.MethodGet, "http://"+host+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range pr.proxy.Transport.Headers {
+		req.Header.Set(key, value)
+	}
+	key := base64.StdEncoding.EncodeToString(randomBytes(16))
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	// dont wait forever if server not speak http
+	if timeout := pr.handshakeTimeout(); timeout != 0 {
+		_ = conn.SetDeadline(time.Now().Add(timeout))
+	}
+	err = req.Write(conn)
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("websocket upgrade failed, status: %s", resp.Status)
+	}
+	sum := sha1.Sum([]byte(key + wsGUID))
+	if resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(sum[:]) {
+		return nil, errors.New("websocket accept key is invalid")
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return &wsConn{
+		Conn:   conn,
+		reader: reader,
+	}, nil
+}
+
+// open stream on shared websocket connection, create connection if not exist
+func (pr *handlerPrv) dialMux() (net.Conn, error) {
+	stream, err := pr.openMuxStream()
+	if err != nil {
+		return nil, err
+	}
+	// shared connection carry streams of other handlers, only capture stream of self
+	if pr.capture != nil {
+		return pr.capture.wrapRemote(stream), nil
+	}
+	return stream, nil
+}
+
+// open stream on shared session, reconnect once if session is broken
+func (pr *handlerPrv) openMuxStream() (net.Conn, error) {
+	session, err := pr.getMuxSession()
+	if err != nil {
+		return nil, err
+	}
+	stream, err := session.OpenStream()
+	if err == nil {
+		return stream, nil
+	}
+	logger.Infof("[%s] open mux stream failed, reconnect, err: %v", pr.typ, err)
+	_ = session.Close()
+	dropMuxSession(pr.transportKey(), session)
+	session, err = pr.getMuxSession()
+	if err != nil {
+		return nil, err
+	}
+	return session.OpenStream()
+}
+
+// get session from cache or create new one, lock is not held while dial,
+// handlers of the same key wait for the same dial
+func (pr *handlerPrv) getMuxSession() (*smux.Session, error) {
+	key := pr.transportKey()
+	for {
+		transportLock.Lock()
+		entry, ok := muxSessionMap[key]
+		if !ok {
+			break
+		}
+		transportLock.Unlock()
+		<-entry.ready
+		if entry.err != nil {
+			return nil, entry.err
+		}
+		if !entry.session.IsClosed() {
+			return entry.session, nil
+		}
+		dropMuxSession(key, entry.session)
+	}
+	entry := &muxSessionEntry{ready: make(chan struct{})}
+	muxSessionMap[key] = entry
+	transportLock.Unlock()
+
+	session, err := pr.newMuxSession()
+	transportLock.Lock()
+	cached := muxSessionMap[key] == entry
+	if err != nil && cached {
+		// failed dial is not cached, next handler try again
+		delete(muxSessionMap, key)
+	}
+	transportLock.Unlock()
+	if err == nil && !cached {
+		// scope closed while dial
+		_ = session.Close()
+		session, err = nil, errors.New("mux session is closed")
+	}
+	entry.session, entry.err = session, err
+	close(entry.ready)
+	return session, err
+}
+
+// dial websocket connection and create session on it
+func (pr *handlerPrv) newMuxSession() (*smux.Session, error) {
+	// dont keep the handler itself, and dont capture shared connection
+	server := &handlerPrv{typ: pr.typ, scope: pr.scope, proxy: pr.proxy}
+	conn, err := server.dialWebSocket()
+	if err != nil {
+		return nil, err
+	}
+	session, err := smux.Client(conn, smux.DefaultConfig())
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return session, nil
+}
+
+// remove session from cache, new session may be cached already
+func dropMuxSession(key transportKey, session *smux.Session) {
+	transportLock.Lock()
+	defer transportLock.Unlock()
+	entry, ok := muxSessionMap[key]
+	if !ok {
+		return
+	}
+	// entry in dial is not ready
+	select {
+	case <-entry.ready:
+		if entry.session == session {
+			delete(muxSessionMap, key)
+		}
+	default:
+	}
+}
+
+// get shared http2 transport, streams share one connection
+func (pr *handlerPrv) getH2Transport() *http.Transport {
+	key := pr.transportKey()
+	transportLock.Lock()
+	defer transportLock.Unlock()
+	if transport, ok := h2TransportMap[key]; ok {
+		return transport
+	}
+	// dont keep the handler itself, and dont capture shared connection
+	server := &handlerPrv{typ: pr.typ, scope: pr.scope, proxy: pr.proxy}
+	transport := &http.Transport{
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return server.dialServer()
+		},
+		ForceAttemptHTTP2: true,
+		IdleConnTimeout:   90 * time.Second,
+	}
+	h2TransportMap[key] = transport
+	return transport
+}
+
+// open http2 stream, request body and response body as connection
+func (pr *handlerPrv) dialH2() (net.Conn, error) {
+	host, path := pr.transportTarget()
+	method := pr.proxy.Transport.Method
+	if method == "" {
+		method = http.MethodPut
+	}
+	reader, writer := io.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, method, "https://"+host+path, reader)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	for key, value := range pr.proxy.Transport.Headers {
+		req.Header.Set(key, value)
+	}
+	// h2 always use tls
+	server, _ := parseProxyServer(pr.proxy.Server)
+	port := pr.proxy.Port
+	if port == 0 {
+		port = 443
+	}
+	conn := &h2Conn{
+		writer: writer,
+		cancel: cancel,
+		ready:  make(chan struct{}),
+		rAddr:  NewDomainAddr("tcp", server, port),
+	}
+	// server may wait for data before response, dont block on response
+	transport := pr.getH2Transport()
+	go func() {
+		resp, err := transport.RoundTrip(req)
+		if err == nil && resp.StatusCode != http.StatusOK {
+			_ = resp.Body.Close()
+			err = fmt.Errorf("http2 transport failed, status: %s", resp.Status)
+		}
+		if err != nil {
+			logger.Warningf("[%s] http2 transport request failed, err: %v", pr.typ, err)
+			_ = reader.CloseWithError(err)
+		}
+		conn.resp = resp
+		conn.respErr = err
+		close(conn.ready)
+	}()
+	return conn, nil
+}
+
+// websocket client connection, data is sent in binary frame
+type wsConn struct {
+	net.Conn
+	reader *bufio.Reader
+	// payload left of current frame
+	remain int64
+
+	writeLock sync.Mutex
+}
+
+// read payload of data frames
+func (conn *wsConn) Read(buf []byte) (int, error) {
+	for conn.remain == 0 {
+		err := conn.nextFrame()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(buf)) > conn.remain {
+		buf = buf[:conn.remain]
+	}
+	n, err := conn.reader.Read(buf)
+	conn.remain -= int64(n)
+	return n, err
+}
+
+// read frame header, control frame is handled at once
+func (conn *wsConn) nextFrame() error {
+	head := make([]byte, 8)
+	_, err := io.ReadFull(conn.reader, head[:2])
+	if err != nil {
+		return err
+	}
+	opcode := head[0] & 0x0F
+	// server frame must not be masked
+	if head[1]&0x80 != 0 {
+		return errors.New("websocket frame from server is masked")
+	}
+	length := int64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		_, err = io.ReadFull(conn.reader, head[:2])
+		length = int64(binary.BigEndian.Uint16(head[:2]))
+	case 127:
+		_, err = io.ReadFull(conn.reader, head)
+		length = int64(binary.BigEndian.Uint64(head))
+	}
+	if err != nil {
+		return err
+	}
+	switch opcode {
+	case wsOpContinuation, wsOpText, wsOpBinary:
+		conn.remain = length
+		return nil
+	case wsOpClose:
+		return io.EOF
+	case wsOpPing, wsOpPong:
+		payload := make([]byte, length)
+		_, err = io.ReadFull(conn.reader, payload)
+		if err != nil || opcode == wsOpPong {
+			return err
+		}
+		return conn.writeFrame(wsOpPong, payload)
+	default:
+		return fmt.Errorf("websocket opcode %v is invalid", opcode)
+	}
+}
+
+// write data in one binary frame
+func (conn *wsConn) Write(buf []byte) (int, error) {
+	err := conn.writeFrame(wsOpBinary, buf)
+	if err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+// write one masked frame
+func (conn *wsConn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 2, 14+len(payload))
+	frame[0] = 0x80 | opcode
+	switch size := len(payload); {
+	case size < 126:
+		frame[1] = 0x80 | byte(size)
+	case size <= 0xFFFF:
+		frame[1] = 0x80 | 126
+		frame = append(frame, byte(size>>8), byte(size))
+	default:
+		frame[1] = 0x80 | 127
+		frame = append(frame, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(frame[len(frame)-8:], uint64(size))
+	}
+	mask := randomBytes(4)
+	frame = append(frame, mask...)
+	offset := len(frame)
+	frame = append(frame, payload...)
+	for i := range payload {
+		frame[offset+i] ^= mask[i%4]
+	}
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+	_, err := conn.Conn.Write(frame)
+	return err
+}
+
+// send close frame before close
+func (conn *wsConn) Close() error {
+	_ = conn.writeFrame(wsOpClose, []byte{0x03, 0xE8})
+	return conn.Conn.Close()
+}
+
+// http2 stream as connection, request body is write side and response body is read side
+type h2Conn struct {
+	writer *io.PipeWriter
+	cancel context.CancelFunc
+	rAddr  net.Addr
+
+	// closed when response arrived or failed
+	ready   chan struct{}
+	resp    *http.Response
+	respErr error
+
+	// stream is canceled when deadline exceeded
+	deadlineLock sync.Mutex
+	deadline     *time.Timer
+	expired      int32
+}
+
+func (conn *h2Conn) Read(buf []byte) (int, error) {
+	<-conn.ready
+	if conn.respErr != nil {
+		return 0, conn.deadlineErr(conn.respErr)
+	}
+	n, err := conn.resp.Body.Read(buf)
+	return n, conn.deadlineErr(err)
+}
+
+func (conn *h2Conn) Write(buf []byte) (int, error) {
+	n, err := conn.writer.Write(buf)
+	return n, conn.deadlineErr(err)
+}
+
+// end request body, response body can still be read
+func (conn *h2Conn) CloseWrite() error {
+	return conn.writer.Close()
+}
+
+// close request body and cancel stream
+func (conn *h2Conn) Close() error {
+	_ = conn.writer.Close()
+	conn.cancel()
+	select {
+	case <-conn.ready:
+		if conn.resp != nil {
+			_ = conn.resp.Body.Close()
+		}
+	default:
+	}
+	return nil
+}
+
+func (conn *h2Conn) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (conn *h2Conn) RemoteAddr() net.Addr {
+	return conn.rAddr
+}
+
+// blocked read and write of stream cant be waked up, stream is canceled when deadline exceeded
+func (conn *h2Conn) SetDeadline(t time.Time) error {
+	conn.deadlineLock.Lock()
+	defer conn.deadlineLock.Unlock()
+	if conn.deadline != nil {
+		conn.deadline.Stop()
+		conn.deadline = nil
+	}
+	if t.IsZero() {
+		return nil
+	}
+	conn.deadline = time.AfterFunc(time.Until(t), func() {
+		atomic.StoreInt32(&conn.expired, 1)
+		_ = conn.Close()
+	})
+	return nil
+}
+
+func (conn *h2Conn) SetReadDeadline(t time.Time) error {
+	return conn.SetDeadline(t)
+}
+
+func (conn *h2Conn) SetWriteDeadline(t time.Time) error {
+	return conn.SetDeadline(t)
+}
+
+// error of canceled stream is timeout if deadline exceeded
+func (conn *h2Conn) deadlineErr(err error) error {
+	if err != nil && atomic.LoadInt32(&conn.expired) != 0 {
+		return os.ErrDeadlineExceeded
+	}
+	return err
+}
@@ -0,0 +1,216 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package tproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/linuxdeepin/deepin-network-proxy/config"
+	"github.com/linuxdeepin/deepin-network-proxy/define"
+)
+
+// read one frame sent by client, payload is unmasked
+func readClientFrame(t *testing.T, reader io.Reader) (byte, []byte) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(reader, head); err != nil {
+		t.Fatal(err)
+	}
+	if head[1]&0x80 == 0 {
+		t.Fatal("websocket frame from client is not masked")
+	}
+	length := int(head[1] & 0x7F)
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		_, _ = io.ReadFull(reader, ext)
+		length = int(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		_, _ = io.ReadFull(reader, ext)
+		length = int(binary.BigEndian.Uint64(ext))
+	}
+	mask := make([]byte, 4)
+	_, _ = io.ReadFull(reader, mask)
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		t.Fatal(err)
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return head[0] & 0x0F, payload
+}
+
+// client frame is masked, server frame is read with ping answered and close as eof
+func TestWsConnFrame(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	conn := &wsConn{Conn: client, reader: bufio.NewReader(client)}
+
+	data := bytes.Repeat([]byte("a"), 300)
+	go func() { _, _ = conn.Write(data) }()
+	opcode, payload := readClientFrame(t, server)
+	if opcode != wsOpBinary || !bytes.Equal(payload, data) {
+		t.Fatalf("client frame is %v %q, want binary %q", opcode, payload, data)
+	}
+
+	// ping, then binary frame with 16 bit length, then close
+	go func() {
+		_, _ = server.Write([]byte{0x80 | wsOpPing, 2, 'h', 'i'})
+		frame := []byte{0x80 | wsOpBinary, 126, 0, 200}
+		_, _ = server.Write(append(frame, bytes.Repeat([]byte("b"), 200)...))
+		_, _ = server.Write([]byte{0x80 | wsOpClose, 0})
+	}()
+	done := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(conn)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- buf
+	}()
+	opcode, payload = readClientFrame(t, server)
+	if opcode != wsOpPong || string(payload) != "hi" {
+		t.Errorf("answer of ping is %v %q, want pong %q", opcode, payload, "hi")
+	}
+	if buf := <-done; !bytes.Equal(buf, bytes.Repeat([]byte("b"), 200)) {
+		t.Errorf("read %q from server", buf)
+	}
+}
+
+func TestWsHandshake(t *testing.T) {
+	pr := &handlerPrv{proxy: config.Proxy{
+		Server: "proxy.example",
+		Transport: &config.TransportConfig{
+			Type:    transportWS,
+			Path:    "tunnel",
+			Headers: map[string]string{"X-Token": "abc"},
+		},
+	}}
+	for _, valid := range []bool{true, false} {
+		client, server := net.Pipe()
+		go func() {
+			req, err := http.ReadRequest(bufio.NewReader(server))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if req.Host != "proxy.example" || req.URL.Path != "/tunnel" || req.Header.Get("X-Token") != "abc" {
+				t.Errorf("upgrade request is %v %v %v", req.Host, req.URL, req.Header)
+			}
+			sum := sha1.Sum([]byte(req.Header.Get("Sec-WebSocket-Key") + wsGUID))
+			accept := base64.StdEncoding.EncodeToString(sum[:])
+			if !valid {
+				accept = "invalid"
+			}
+			_, _ = io.WriteString(server, "HTTP/1.1 101 Switching Protocols\r\n"+
+				"Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: "+accept+"\r\n\r\n")
+		}()
+		_, err := pr.wsHandshake(client)
+		if valid && err != nil {
+			t.Errorf("handshake failed, err: %v", err)
+		}
+		if !valid && err == nil {
+			t.Errorf("handshake with invalid accept key success")
+		}
+		_ = client.Close()
+		_ = server.Close()
+	}
+}
+
+// h2 stream is full duplex, shared transport is removed when scope closed
+func TestH2Conn(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.URL.Path != "/tunnel" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		buf := make([]byte, 1024)
+		for {
+			n, err := r.Body.Read(buf)
+			if n > 0 {
+				_, _ = w.Write(bytes.ToUpper(buf[:n]))
+				w.(http.Flusher).Flush()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	pr := &handlerPrv{typ: TROJAN, scope: define.Global, proxy: config.Proxy{
+		Server: "127.0.0.1",
+		Transport: &config.TransportConfig{
+			Type: transportH2,
+			Path: "tunnel",
+			Host: strings.TrimPrefix(srv.URL, "https://"),
+		},
+	}}
+	// test server dont need mark
+	transportLock.Lock()
+	h2TransportMap[pr.transportKey()] = srv.Client().Transport.(*http.Transport)
+	transportLock.Unlock()
+	defer CloseTransport(define.Global)
+
+	conn, err := pr.dialH2()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 16)
+	for _, msg := range []string{"hello", "world"} {
+		if _, err = conn.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		n, err := io.ReadAtLeast(conn, buf, len(msg))
+		if err != nil || string(buf[:n]) != strings.ToUpper(msg) {
+			t.Fatalf("read %q, want %q, err: %v", buf[:n], strings.ToUpper(msg), err)
+		}
+	}
+	// request body end, server finish response
+	if err = conn.(*h2Conn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if rest, err := ioutil.ReadAll(conn); err != nil || len(rest) != 0 {
+		t.Errorf("read %q after close write, err: %v", rest, err)
+	}
+	// server wait for data, read is stopped by deadline
+	idle, err := pr.dialH2()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	_ = idle.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err = idle.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("read after deadline got err: %v", err)
+	}
+
+	CloseTransport(define.Global)
+	transportLock.Lock()
+	_, ok := h2TransportMap[pr.transportKey()]
+	transportLock.Unlock()
+	if ok {
+		t.Error("shared transport is kept after scope closed")
+	}
+}
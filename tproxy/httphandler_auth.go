@@ -0,0 +1,552 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package tproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+// http proxy auth scheme, pinned by config or chosen from challenge
+const (
+	httpAuthBasic  = "basic"
+	httpAuthDigest = "digest"
+	httpAuthNTLM   = "ntlm"
+)
+
+// max rounds of 407 challenge, ntlm need negotiate and authenticate
+const httpAuthMaxRound = 3
+
+// send connect request to proxy server, answer 407 challenge until tunnel created,
+// proxy server may close connection after challenge, so connection may be replaced
+func (pr *handlerPrv) httpConnect(rConn net.Conn, host string) (net.Conn, error) {
+	auth, hasAuth := pr.httpAuth()
+	authMsg := pr.httpPreemptiveAuth()
+	for round := 0; ; round++ {
+		// create http head
+		req := &http.Request{
+			Method: http.MethodConnect,
+			Host:   host,
+			URL: &url.URL{
+				Host: host,
+			},
+			Header: http.Header{},
+		}
+		if authMsg != "" {
+			req.Header.Add("Proxy-Authorization", authMsg)
+		}
+		// send connect request to rConn to create tunnel, header carry credentials, dont log it
+		logger.Infof("[%s] send connect request, host [%s], round: %v", pr.typ, host, round)
+		err := req.Write(rConn)
+		if err != nil {
+			logger.Warningf("[%s] write http tunnel request failed, err: %v", pr.typ, err)
+			_ = rConn.Close()
+			return nil, err
+		}
+		// read response
+		reader := bufio.NewReader(rConn)
+		resp, err := http.ReadResponse(reader, req)
+		if err != nil {
+			logger.Warningf("[%s] read response failed, err: %v", pr.typ, err)
+			_ = rConn.Close()
+			return nil, err
+		}
+		logger.Debug(resp.Status)
+		// check if connect success
+		if resp.StatusCode == http.StatusOK {
+			_ = resp.Body.Close()
+			return rConn, nil
+		}
+		if resp.StatusCode != http.StatusProxyAuthRequired || !hasAuth || round >= httpAuthMaxRound {
+			_ = resp.Body.Close()
+			_ = rConn.Close()
+			return nil, fmt.Errorf("proxy response error, status code: %v, message: %s",
+				resp.StatusCode, resp.Status)
+		}
+		// drain body, so that connection can be reused
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+		authMsg, _, err = answerHttpChallenge(resp.Header.Values("Proxy-Authenticate"), strings.ToLower(pr.proxy.AuthScheme),
+			auth, http.MethodConnect, host)
+		if err != nil {
+			logger.Warningf("[%s] answer proxy challenge failed, err: %v", pr.typ, err)
+			_ = rConn.Close()
+			return nil, err
+		}
+		// proxy server close connection after challenge, dial again
+		if resp.Close {
+			_ = rConn.Close()
+			// ntlm authenticate the connection which receive challenge, cant continue on new one
+			if isNtlmAuthenticate(authMsg) {
+				logger.Warningf("[%s] proxy server close connection during ntlm handshake", pr.typ)
+				return nil, errNtlmConnClosed
+			}
+			rConn, err = pr.dialProxy()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// get auth message of proxy, return false if dont need auth
+func (pr *handlerPrv) httpAuth() (auth, bool) {
+	auth := auth{
+		user:     pr.proxy.UserName,
+		password: pr.proxy.Password,
+	}
+	return auth, auth.user != "" && auth.password != ""
+}
+
+// auth message sent preemptively, basic only when pinned,
+// password is not sent in clear text to proxy which offer digest or ntlm
+func (pr *handlerPrv) httpPreemptiveAuth() string {
+	auth, hasAuth := pr.httpAuth()
+	if !hasAuth {
+		return ""
+	}
+	switch strings.ToLower(pr.proxy.AuthScheme) {
+	case httpAuthBasic:
+		return basicAuth(auth)
+	case httpAuthNTLM:
+		return "NTLM " + base64.StdEncoding.EncodeToString(ntlmNegotiate())
+	}
+	return ""
+}
+
+// make answer for challenge of request, scheme is chosen from challenge if not pinned,
+// digest challenge is returned too, so that following request can answer without challenge again
+func answerHttpChallenge(challenges []string, scheme string, auth auth, method string, uri string) (string, *digestChallenge, error) {
+	// scheme -> params
+	offers := make(map[string]string)
+	for _, challenge := range splitChallenges(challenges) {
+		name := challenge
+		var params string
+		if index := strings.IndexByte(challenge, ' '); index > 0 {
+			name = challenge[:index]
+			params = strings.TrimSpace(challenge[index+1:])
+		}
+		offers[strings.ToLower(name)] = params
+	}
+	// choose the strongest one
+	if scheme == "" {
+		for _, elem := range []string{httpAuthNTLM, httpAuthDigest, httpAuthBasic} {
+			if _, ok := offers[elem]; ok {
+				scheme = elem
+				break
+			}
+		}
+	}
+	params, ok := offers[scheme]
+	if !ok {
+		return "", nil, fmt.Errorf("proxy dont offer auth scheme [%s], challenges: %v", scheme, challenges)
+	}
+	switch scheme {
+	case httpAuthBasic:
+		return basicAuth(auth), nil, nil
+	case httpAuthDigest:
+		digest, err := newDigestChallenge(parseAuthParams(params))
+		if err != nil {
+			return "", nil, err
+		}
+		msg, err := digest.answer(auth, method, uri)
+		if err != nil {
+			return "", nil, err
+		}
+		return msg, digest, nil
+	case httpAuthNTLM:
+		// first round, start negotiate
+		if params == "" {
+			return "NTLM " + base64.StdEncoding.EncodeToString(ntlmNegotiate()), nil, nil
+		}
+		challenge, err := base64.StdEncoding.DecodeString(params)
+		if err != nil {
+			return "", nil, err
+		}
+		msg, err := ntlmAuthenticate(auth, challenge)
+		if err != nil {
+			return "", nil, err
+		}
+		return "NTLM " + base64.StdEncoding.EncodeToString(msg), nil, nil
+	default:
+		return "", nil, fmt.Errorf("auth scheme [%s] is not supported", scheme)
+	}
+}
+
+// split challenges of headers, one header may contain several challenges joined by comma,
+// as Basic realm="proxy", Digest realm="proxy, inc", nonce="abc"
+func splitChallenges(headers []string) []string {
+	var challenges []string
+	for _, header := range headers {
+		// split by comma out of quote
+		var parts []string
+		quoted := false
+		start := 0
+		for index := 0; index < len(header); index++ {
+			switch header[index] {
+			case '\\':
+				if quoted {
+					index++
+				}
+			case '"':
+				quoted = !quoted
+			case ',':
+				if !quoted {
+					parts = append(parts, header[start:index])
+					start = index + 1
+				}
+			}
+		}
+		parts = append(parts, header[start:])
+		for _, part := range parts {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			// part start with scheme name begin new challenge, otherwise it is param of last one
+			if len(challenges) == 0 || isChallengeStart(part) {
+				challenges = append(challenges, part)
+				continue
+			}
+			challenges[len(challenges)-1] += ", " + part
+		}
+	}
+	return challenges
+}
+
+// check if part start with scheme name, param is as key=value or key = value
+func isChallengeStart(part string) bool {
+	index := strings.IndexByte(part, ' ')
+	if index < 0 {
+		return !strings.Contains(part, "=")
+	}
+	if strings.Contains(part[:index], "=") {
+		return false
+	}
+	return !strings.HasPrefix(strings.TrimLeft(part[index:], " "), "=")
+}
+
+// basic auth, RFC7617
+func basicAuth(auth auth) string {
+	authMsg := auth.user + ":" + auth.password
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(authMsg))
+}
+
+// parse auth params, as realm="proxy", nonce="abc", qop="auth,auth-int"
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for s != "" {
+		// key
+		index := strings.IndexByte(s, '=')
+		if index < 0 {
+			break
+		}
+		key := strings.ToLower(strings.Trim(s[:index], " ,"))
+		s = strings.TrimLeft(s[index+1:], " ")
+		// value, may be quoted and contains comma
+		var value string
+		if strings.HasPrefix(s, "\"") {
+			var buf strings.Builder
+			index = 1
+			for ; index < len(s) && s[index] != '"'; index++ {
+				if s[index] == '\\' && index+1 < len(s) {
+					index++
+				}
+				buf.WriteByte(s[index])
+			}
+			value = buf.String()
+			// skip close quote
+			if index < len(s) {
+				index++
+			}
+			s = s[index:]
+		} else {
+			index = strings.IndexByte(s, ',')
+			if index < 0 {
+				index = len(s)
+			}
+			value = strings.TrimSpace(s[:index])
+			s = s[index:]
+		}
+		params[key] = value
+		s = strings.TrimLeft(s, " ,")
+	}
+	return params
+}
+
+// digest challenge, RFC7616, nonce is reused by following requests with increased nonce count
+type digestChallenge struct {
+	realm     string
+	nonce     string
+	opaque    string
+	hasOpaque bool
+	algorithm string
+	qop       string
+	nc        uint32
+}
+
+// check digest challenge, only qop auth is supported, auth-int need hash of body
+func newDigestChallenge(params map[string]string) (*digestChallenge, error) {
+	digest := &digestChallenge{
+		realm:     params["realm"],
+		nonce:     params["nonce"],
+		algorithm: params["algorithm"],
+	}
+	if digest.nonce == "" {
+		return nil, errors.New("digest challenge has no nonce")
+	}
+	if digest.algorithm == "" {
+		digest.algorithm = "MD5"
+	}
+	for _, elem := range strings.Split(params["qop"], ",") {
+		if strings.TrimSpace(elem) == "auth" {
+			digest.qop = "auth"
+		}
+	}
+	if params["qop"] != "" && digest.qop == "" {
+		return nil, fmt.Errorf("digest qop [%s] is not supported", params["qop"])
+	}
+	digest.opaque, digest.hasOpaque = params["opaque"]
+	return digest, nil
+}
+
+// make authorization of request, each answer use next nonce count and new cnonce
+func (digest *digestChallenge) answer(auth auth, method string, uri string) (string, error) {
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	cnonce := hex.EncodeToString(buf)
+	digest.nc++
+	nc := fmt.Sprintf("%08x", digest.nc)
+	response, err := digestResponse(digest.algorithm, auth.user, digest.realm, auth.password, method, uri,
+		digest.nonce, cnonce, nc, digest.qop)
+	if err != nil {
+		return "", err
+	}
+	msg := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", algorithm=%s, response="%s"`,
+		auth.user, digest.realm, digest.nonce, uri, digest.algorithm, response)
+	if digest.qop != "" {
+		msg += fmt.Sprintf(`, qop=%s, nc=%s, cnonce="%s"`, digest.qop, nc, cnonce)
+	}
+	if digest.hasOpaque {
+		msg += fmt.Sprintf(`, opaque="%s"`, digest.opaque)
+	}
+	return msg, nil
+}
+
+// calculate digest response
+func digestResponse(algorithm, user, realm, password, method, uri, nonce, cnonce, nc, qop string) (string, error) {
+	var newHash func() hash.Hash
+	switch strings.ToUpper(strings.TrimSuffix(strings.ToLower(algorithm), "-sess")) {
+	case "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		return "", fmt.Errorf("digest algorithm [%s] is not supported", algorithm)
+	}
+	h := func(s string) string {
+		hs := newHash()
+		hs.Write([]byte(s))
+		return hex.EncodeToString(hs.Sum(nil))
+	}
+	ha1 := h(user + ":" + realm + ":" + password)
+	if strings.HasSuffix(strings.ToLower(algorithm), "-sess") {
+		ha1 = h(ha1 + ":" + nonce + ":" + cnonce)
+	}
+	ha2 := h(method + ":" + uri)
+	// RFC2069 compatible
+	if qop == "" {
+		return h(ha1 + ":" + nonce + ":" + ha2), nil
+	}
+	return h(ha1 + ":" + nonce + ":" + nc + ":" + cnonce + ":" + qop + ":" + ha2), nil
+}
+
+/*
+	ntlm auth, MS-NLMP, only NTLMv2 response is supported
+
+	client -> NEGOTIATE_MESSAGE -> server
+	client <- CHALLENGE_MESSAGE <- server
+	client -> AUTHENTICATE_MESSAGE -> server
+*/
+
+const (
+	ntlmNegotiateUnicode      = 0x00000001
+	ntlmNegotiateOEM          = 0x00000002
+	ntlmRequestTarget         = 0x00000004
+	ntlmNegotiateNTLM         = 0x00000200
+	ntlmNegotiateAlwaysSign   = 0x00008000
+	ntlmNegotiateExtendedSec  = 0x00080000
+	ntlmNegotiateTargetInfo   = 0x00800000
+	ntlmNegotiate128          = 0x20000000
+	ntlmNegotiate56           = 0x80000000
+	ntlmNegotiateDefaultFlags = ntlmNegotiateUnicode | ntlmNegotiateOEM | ntlmRequestTarget | ntlmNegotiateNTLM |
+		ntlmNegotiateAlwaysSign | ntlmNegotiateExtendedSec | ntlmNegotiate128 | ntlmNegotiate56
+)
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+// ntlm av pair id of timestamp
+const ntlmAvTimestamp = 7
+
+// NEGOTIATE_MESSAGE, domain and workstation are not supplied
+func ntlmNegotiate() []byte {
+	buf := make([]byte, 32)
+	copy(buf, ntlmSignature)
+	binary.LittleEndian.PutUint32(buf[8:], 1)
+	binary.LittleEndian.PutUint32(buf[12:], ntlmNegotiateDefaultFlags)
+	return buf
+}
+
+// ntlm handshake need the same connection, proxy server close it before authenticate
+var errNtlmConnClosed = errors.New("proxy server close connection during ntlm handshake")
+
+// check if auth message is ntlm AUTHENTICATE_MESSAGE
+func isNtlmAuthenticate(authMsg string) bool {
+	if !strings.HasPrefix(authMsg, "NTLM ") {
+		return false
+	}
+	msg, err := base64.StdEncoding.DecodeString(authMsg[len("NTLM "):])
+	if err != nil || len(msg) < 12 || !bytes.Equal(msg[:8], ntlmSignature) {
+		return false
+	}
+	return binary.LittleEndian.Uint32(msg[8:]) == 3
+}
+
+// AUTHENTICATE_MESSAGE according to CHALLENGE_MESSAGE
+func ntlmAuthenticate(auth auth, challenge []byte) ([]byte, error) {
+	if len(challenge) < 32 || !bytes.Equal(challenge[:8], ntlmSignature) ||
+		binary.LittleEndian.Uint32(challenge[8:]) != 2 {
+		return nil, errors.New("ntlm challenge message is invalid")
+	}
+	flags := binary.LittleEndian.Uint32(challenge[20:])
+	serverChallenge := challenge[24:32]
+	// target info
+	var targetInfo []byte
+	if flags&ntlmNegotiateTargetInfo != 0 && len(challenge) >= 48 {
+		size := int(binary.LittleEndian.Uint16(challenge[40:]))
+		offset := int(binary.LittleEndian.Uint32(challenge[44:]))
+		if offset+size > len(challenge) {
+			return nil, errors.New("ntlm challenge target info out of range")
+		}
+		targetInfo = challenge[offset : offset+size]
+	}
+	// user may be as domain\user
+	user := auth.user
+	var domain string
+	if index := strings.IndexByte(user, '\\'); index >= 0 {
+		domain = user[:index]
+		user = user[index+1:]
+	}
+	// use server timestamp if exist
+	timestamp := ntlmTimestamp(targetInfo)
+	if timestamp == nil {
+		timestamp = make([]byte, 8)
+		binary.LittleEndian.PutUint64(timestamp, uint64(time.Now().UnixNano()/100+116444736000000000))
+	}
+	clientChallenge := make([]byte, 8)
+	_, err := rand.Read(clientChallenge)
+	if err != nil {
+		return nil, err
+	}
+	lmResp, ntResp := ntlmV2Response(user, domain, auth.password, serverChallenge, clientChallenge, timestamp, targetInfo)
+
+	/*
+		AUTHENTICATE_MESSAGE
+		signature(8) type(4) LM(8) NT(8) domain(8) user(8) workstation(8) session key(8) flags(4) payload
+	*/
+	payloads := [][]byte{lmResp, ntResp, ntlmUnicode(domain), ntlmUnicode(user), nil, nil}
+	buf := make([]byte, 64)
+	copy(buf, ntlmSignature)
+	binary.LittleEndian.PutUint32(buf[8:], 3)
+	offset := len(buf)
+	for index, payload := range payloads {
+		pos := 12 + index*8
+		binary.LittleEndian.PutUint16(buf[pos:], uint16(len(payload)))
+		binary.LittleEndian.PutUint16(buf[pos+2:], uint16(len(payload)))
+		binary.LittleEndian.PutUint32(buf[pos+4:], uint32(offset))
+		offset += len(payload)
+	}
+	binary.LittleEndian.PutUint32(buf[60:], flags&ntlmNegotiateDefaultFlags)
+	for _, payload := range payloads {
+		buf = append(buf, payload...)
+	}
+	return buf, nil
+}
+
+// calculate LMv2 and NTLMv2 response
+func ntlmV2Response(user, domain, password string, serverChallenge, clientChallenge, timestamp, targetInfo []byte) ([]byte, []byte) {
+	// NTOWFv2
+	ntHash := md4.New()
+	ntHash.Write(ntlmUnicode(password))
+	v2Hash := ntlmHmac(ntHash.Sum(nil), ntlmUnicode(strings.ToUpper(user)+domain))
+	// LMv2
+	lmResp := append(ntlmHmac(v2Hash, serverChallenge, clientChallenge), clientChallenge...)
+	// NTLMv2 client challenge blob
+	blob := []byte{1, 1, 0, 0, 0, 0, 0, 0}
+	blob = append(blob, timestamp...)
+	blob = append(blob, clientChallenge...)
+	blob = append(blob, 0, 0, 0, 0)
+	blob = append(blob, targetInfo...)
+	blob = append(blob, 0, 0, 0, 0)
+	ntProof := ntlmHmac(v2Hash, serverChallenge, blob)
+	return lmResp, append(ntProof, blob...)
+}
+
+// get timestamp from target info av pairs
+func ntlmTimestamp(targetInfo []byte) []byte {
+	for len(targetInfo) >= 4 {
+		id := binary.LittleEndian.Uint16(targetInfo)
+		size := int(binary.LittleEndian.Uint16(targetInfo[2:]))
+		if len(targetInfo) < 4+size {
+			return nil
+		}
+		if id == ntlmAvTimestamp && size == 8 {
+			return targetInfo[4:12]
+		}
+		targetInfo = targetInfo[4+size:]
+	}
+	return nil
+}
+
+func ntlmHmac(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(md5.New, key)
+	for _, elem := range data {
+		mac.Write(elem)
+	}
+	return mac.Sum(nil)
+}
+
+// utf16 little endian
+func ntlmUnicode(s string) []byte {
+	codes := utf16.Encode([]rune(s))
+	buf := make([]byte, len(codes)*2)
+	for index, code := range codes {
+		binary.LittleEndian.PutUint16(buf[index*2:], code)
+	}
+	return buf
+}
@@ -0,0 +1,102 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package tproxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/hex"
+	"testing"
+)
+
+// example from RFC7616 section 3.9.1
+func TestDigestResponse(t *testing.T) {
+	nonce := "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v"
+	cnonce := "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ"
+	results := map[string]string{
+		"MD5":     "8ca523f5e9506fed4657c9700eebdbec",
+		"SHA-256": "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1",
+	}
+	for algorithm, result := range results {
+		resp, err := digestResponse(algorithm, "Mufasa", "http-auth@example.org", "Circle of Life",
+			"GET", "/dir/index.html", nonce, cnonce, "00000001", "auth")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp != result {
+			t.Errorf("digest %s response is %s, want %s", algorithm, resp, result)
+		}
+	}
+}
+
+// example from MS-NLMP section 4.2.4
+func TestNtlmV2Response(t *testing.T) {
+	serverChallenge, _ := hex.DecodeString("0123456789abcdef")
+	clientChallenge, _ := hex.DecodeString("aaaaaaaaaaaaaaaa")
+	targetInfo, _ := hex.DecodeString("02000c0044006f006d00610069006e0001000c00530065007200760065007200000000")
+	lmResp, ntResp := ntlmV2Response("User", "Domain", "Password", serverChallenge, clientChallenge, make([]byte, 8), targetInfo)
+
+	lmWant, _ := hex.DecodeString("86c35097ac9cec102554764a57cccc19aaaaaaaaaaaaaaaa")
+	if !bytes.Equal(lmResp, lmWant) {
+		t.Errorf("lmv2 response is %x, want %x", lmResp, lmWant)
+	}
+	// proof str is followed by client challenge blob
+	blobWant, _ := hex.DecodeString("01010000000000000000000000000000aaaaaaaaaaaaaaaa00000000")
+	blobWant = append(blobWant, targetInfo...)
+	blobWant = append(blobWant, 0, 0, 0, 0)
+	if !bytes.Equal(ntResp[16:], blobWant) {
+		t.Errorf("ntlmv2 blob is %x, want %x", ntResp[16:], blobWant)
+	}
+	// proof str is hmac of ResponseKeyNT from section 4.2.4.1.1 over server challenge and blob
+	keyNT, _ := hex.DecodeString("0c868a403bfd7a93a3001ef22ef02e3f")
+	mac := hmac.New(md5.New, keyNT)
+	mac.Write(serverChallenge)
+	mac.Write(blobWant)
+	if proofWant := mac.Sum(nil); !bytes.Equal(ntResp[:16], proofWant) {
+		t.Errorf("ntproofstr is %x, want %x", ntResp[:16], proofWant)
+	}
+}
+
+func TestParseAuthParams(t *testing.T) {
+	params := parseAuthParams(`realm="proxy, inc", nonce="abc\"d", qop="auth,auth-int", algorithm=SHA-256, stale=false`)
+	want := map[string]string{
+		"realm":     "proxy, inc",
+		"nonce":     `abc"d`,
+		"qop":       "auth,auth-int",
+		"algorithm": "SHA-256",
+		"stale":     "false",
+	}
+	for key, value := range want {
+		if params[key] != value {
+			t.Errorf("param %s is %q, want %q", key, params[key], value)
+		}
+	}
+}
+
+func TestSplitChallenges(t *testing.T) {
+	challenges := splitChallenges([]string{
+		`Basic realm="proxy, inc", Digest realm = "proxy", nonce="a,b", qop=auth`,
+		`NTLM TlRMTVNTUAACAAAA==`,
+	})
+	want := []string{
+		`Basic realm="proxy, inc"`,
+		`Digest realm = "proxy", nonce="a,b", qop=auth`,
+		`NTLM TlRMTVNTUAACAAAA==`,
+	}
+	if len(challenges) != len(want) {
+		t.Fatalf("challenges are %q, want %q", challenges, want)
+	}
+	for index := range want {
+		if challenges[index] != want[index] {
+			t.Errorf("challenge %d is %q, want %q", index, challenges[index], want[index])
+		}
+	}
+	// digest in joined header is chosen over basic
+	_, digest, err := answerHttpChallenge(challenges[:2], "", auth{user: "user", password: "password"}, "GET", "/")
+	if err != nil || digest == nil || digest.nonce != "a,b" {
+		t.Errorf("answer joined challenge got %+v, err: %v", digest, err)
+	}
+}
@@ -6,21 +6,37 @@ package tproxy
 
 import (
 	"bufio"
-	"encoding/base64"
-	"fmt"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
-	"net/url"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/linuxdeepin/deepin-network-proxy/config"
 	"github.com/linuxdeepin/deepin-network-proxy/define"
 )
 
-// not use now
-// write for env proxy
+// http handler which read request from local,
+// connect request use tunnel, plain http request is forwarded as proxy request one by one
 
 type HttpHandlerEProxy struct {
 	handlerPrv
+
+	// reader of local and remote, may buffer data
+	lReader *bufio.Reader
+	rReader *bufio.Reader
+
+	// plain http request is forwarded, not use tunnel
+	forward bool
+	lReq    *http.Request
+	// basic or ntlm message, ntlm is cleared after connection authenticated
+	authMsg string
+	// digest answer is computed for each request, nonce count increase
+	digest *digestChallenge
 }
 
 func NewHttpHandlerEProxy(scope define.Scope, key HandlerKey, proxy config.Proxy, lAddr net.Addr, rAddr net.Addr, lConn net.Conn) *HttpHandlerEProxy {
@@ -31,76 +47,313 @@ func NewHttpHandlerEProxy(scope define.Scope, key HandlerKey, proxy config.Proxy
 	return handler
 }
 
+// http methods, use to check if data is http request
+var httpMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+	http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace,
+}
+
+// check if local data begin with http request line
+func isHttpRequest(reader *bufio.Reader) bool {
+	// longest method is 7 bytes, with a space
+	buf, _ := reader.Peek(8)
+	for _, method := range httpMethods {
+		if bytes.HasPrefix(buf, []byte(method+" ")) {
+			return true
+		}
+	}
+	return false
+}
+
+// set request already read from local, Tunnel will not read again
+func (handler *HttpHandlerEProxy) SetRequest(req *http.Request) {
+	handler.lReq = req
+}
+
 func (handler *HttpHandlerEProxy) Tunnel() error {
-	br := bufio.NewReader(handler.lConn)
-	lReq, err := http.ReadRequest(br)
+	handler.lReader = bufio.NewReader(handler.lConn)
+	lReq := handler.lReq
+	if lReq == nil {
+		// server first protocol or short data dont hang check, not http if timeout
+		if timeout := handler.handshakeTimeout(); timeout != 0 {
+			_ = handler.lConn.SetReadDeadline(time.Now().Add(timeout))
+		}
+		// not http, use connect tunnel to origin remote addr
+		if !isHttpRequest(handler.lReader) {
+			_ = handler.lConn.SetReadDeadline(time.Time{})
+			logger.Debugf("[http] data is not http request, use tunnel, remote [%s]", handler.rAddr)
+			return handler.tunnel(handler.rAddr.String(), false)
+		}
+		var err error
+		lReq, err = http.ReadRequest(handler.lReader)
+		_ = handler.lConn.SetReadDeadline(time.Time{})
+		if err != nil {
+			logger.Warningf("[http] read local request failed, err: %v", err)
+			return err
+		}
+	}
+	// connect request from local, reply after tunnel created
+	if lReq.Method == http.MethodConnect {
+		return handler.tunnel(lReq.Host, true)
+	}
+	// plain http request, forward later
+	rConn, err := handler.dialProxy()
 	if err != nil {
-		logger.Warning(err)
+		logger.Warningf("[http] failed to dial proxy server, err: %v", err)
 		return err
 	}
+	handler.rConn = rConn
+	handler.rReader = bufio.NewReader(rConn)
+	handler.forward = true
+	handler.lReq = lReq
+	handler.authMsg = handler.httpPreemptiveAuth()
+	logger.Infof("[http] proxy: forward mode, [%s] -> [%s] -> [%s]",
+		handler.lAddr.String(), rConn.RemoteAddr(), handler.rAddr.String())
+	return nil
+}
 
+// create connect tunnel, reply local if request is from local
+func (handler *HttpHandlerEProxy) tunnel(host string, reply bool) error {
 	// dial proxy server
 	rConn, err := handler.dialProxy()
 	if err != nil {
 		logger.Warningf("[http] failed to dial proxy server, err: %v", err)
 		return err
 	}
-	// auth
-	auth := auth{
-		user:     handler.proxy.UserName,
-		password: handler.proxy.Password,
+	// send connect request and auth if needed, connection may be replaced
+	rConn, err = handler.httpConnect(rConn, host)
+	if err != nil {
+		logger.Warningf("[http] create http tunnel failed, err: %v", err)
+		if reply {
+			_, _ = handler.lConn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+		}
+		return err
 	}
-	if lReq.Method == http.MethodConnect {
+	if reply {
 		_, err = handler.lConn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
 		if err != nil {
 			logger.Warningf("[http] write 200 failed, err: %v", err)
+			_ = rConn.Close()
+			return err
+		}
+	}
+	// data may be buffered when read request
+	if handler.lReader.Buffered() != 0 {
+		buf, _ := handler.lReader.Peek(handler.lReader.Buffered())
+		_, err = rConn.Write(buf)
+		if err != nil {
+			_ = rConn.Close()
 			return err
 		}
 	}
+	logger.Infof("[http] proxy: tunnel create success, [%s] -> [%s] -> [%s]",
+		handler.lAddr.String(), rConn.RemoteAddr(), handler.rAddr.String())
+	// save rConn handler
+	handler.rConn = rConn
+	return nil
+}
+
+// rewrite communication
+func (handler *HttpHandlerEProxy) Communicate() {
+	if !handler.forward {
+		handler.handlerPrv.Communicate()
+		return
+	}
+	handler.setKeepAlive(handler.lConn)
+	go func() {
+		handler.forwardAll()
+		handler.Remove()
+		handler.report()
+	}()
+}
+
+// forward request one by one until connection closed
+func (handler *HttpHandlerEProxy) forwardAll() {
+	req := handler.lReq
+	for {
+		resp, err := handler.roundTrip(req)
+		if err != nil {
+			handler.setReason(err)
+			logger.Infof("[http] forward request failed, remote [%s], err: %v", handler.rAddr, err)
+			_, _ = handler.lConn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+			return
+		}
+		err = resp.Write(limitWriter{
+			Writer:  countWriter{Writer: handler.lConn, count: &handler.download},
+			buckets: downloadBuckets(handler.getLimiters()),
+		})
+		_ = resp.Body.Close()
+		if err != nil {
+			handler.setReason(err)
+			logger.Infof("[http] write response failed, local [%s], err: %v", handler.lAddr, err)
+			return
+		}
+		// websocket and other upgrade, copy raw data from now on
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			handler.relay()
+			return
+		}
+		// keep alive
+		if req.Close || resp.Close {
+			return
+		}
+		// idle connection between requests is closed as tunnel without data
+		if timeout := handler.idleTimeout(); timeout != 0 {
+			_ = handler.lConn.SetReadDeadline(time.Now().Add(timeout))
+		}
+		req, err = http.ReadRequest(handler.lReader)
+		_ = handler.lConn.SetReadDeadline(time.Time{})
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				handler.setReason(errIdleTimeout)
+				logger.Debugf("[http] local connection is idle, close, local [%s]", handler.lAddr)
+				return
+			}
+			if err != io.EOF {
+				handler.setReason(err)
+				logger.Infof("[http] read local request failed, local [%s], err: %v", handler.lAddr, err)
+			}
+			return
+		}
+	}
+}
 
-	// create http head
-	req := &http.Request{
-		Method: http.MethodConnect,
-		Host:   lReq.Host,
-		URL: &url.URL{
-			Host: lReq.Host,
-		},
-		Header: http.Header{},
+// send request to proxy server as proxy request, answer 407 challenge if request has no body
+func (handler *HttpHandlerEProxy) roundTrip(req *http.Request) (*http.Response, error) {
+	// request from transparent local is origin form, use absolute uri
+	if req.URL.Host == "" {
+		req.URL.Host = req.Host
+		if req.URL.Host == "" {
+			req.URL.Host = handler.rAddr.String()
+		}
+	}
+	if req.URL.Scheme == "" {
+		req.URL.Scheme = "http"
 	}
-	// check if need auth
-	if auth.user != "" && auth.password != "" {
-		authMsg := auth.user + ":" + auth.password
-		req.Header.Add("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(authMsg)))
+	// hop by hop header of local proxy request
+	req.Header.Del("Proxy-Authorization")
+	req.Header.Del("Proxy-Connection")
+	auth, hasAuth := handler.httpAuth()
+	noBody := req.ContentLength == 0 && len(req.TransferEncoding) == 0
+	uri := req.URL.String()
+	retried := false
+	// answer of challenge in last round
+	var answer string
+	for round := 0; ; round++ {
+		// connection kept alive may be closed by proxy server while idle
+		reused := handler.rConn != nil
+		if handler.rConn == nil {
+			rConn, err := handler.dialProxy()
+			if err != nil {
+				return nil, err
+			}
+			handler.rConn = rConn
+			handler.rReader = bufio.NewReader(rConn)
+		}
+		authMsg := answer
+		if authMsg == "" && handler.digest != nil {
+			var err error
+			authMsg, err = handler.digest.answer(auth, req.Method, uri)
+			if err != nil {
+				return nil, err
+			}
+		} else if authMsg == "" {
+			authMsg = handler.authMsg
+		}
+		if authMsg != "" {
+			req.Header.Set("Proxy-Authorization", authMsg)
+		}
+		resp, err := handler.sendRequest(req)
+		if err != nil {
+			// request without body can be sent again on new connection, only once
+			if reused && noBody && !retried && isStaleConn(err) {
+				logger.Debugf("[http] kept alive connection closed by proxy server, retry, err: %v", err)
+				retried = true
+				handler.resetRemote()
+				round--
+				continue
+			}
+			return nil, err
+		}
+		// body may be large, handshake timeout only cover response header
+		_ = handler.rConn.SetDeadline(time.Time{})
+		if resp.StatusCode != http.StatusProxyAuthRequired || !hasAuth || !noBody || round >= httpAuthMaxRound {
+			// ntlm authenticate connection, dont need send again
+			if strings.HasPrefix(handler.authMsg, "NTLM ") && resp.StatusCode != http.StatusProxyAuthRequired {
+				handler.authMsg = ""
+			}
+			return resp, nil
+		}
+		// drain body, so that connection can be reused
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+		answer, handler.digest, err = answerHttpChallenge(resp.Header.Values("Proxy-Authenticate"),
+			strings.ToLower(handler.proxy.AuthScheme), auth, req.Method, uri)
+		if err != nil {
+			return nil, err
+		}
+		// basic and ntlm is sent again by following request, digest is computed by request
+		handler.authMsg = ""
+		if handler.digest == nil {
+			handler.authMsg = answer
+		}
+		// server close connection after challenge, dial again
+		if resp.Close {
+			handler.resetRemote()
+			// ntlm authenticate the connection which receive challenge, cant continue on new one
+			if isNtlmAuthenticate(answer) {
+				handler.authMsg = ""
+				return nil, errNtlmConnClosed
+			}
+		}
 	}
+}
 
-	// send connect request to rConn to create tunnel
-	logger.Infof("[http] req is %v", req)
-	err = req.Write(rConn)
+// write request to proxy server and read response header
+func (handler *HttpHandlerEProxy) sendRequest(req *http.Request) (*http.Response, error) {
+	err := req.WriteProxy(limitWriter{
+		Writer:  countWriter{Writer: handler.rConn, count: &handler.upload},
+		buckets: uploadBuckets(handler.getLimiters()),
+	})
 	if err != nil {
-		logger.Warningf("[http] write http tunnel request failed, err: %v", err)
-		return err
+		return nil, err
 	}
-	logger.Info("[http] write req success")
-	// read response
-	reader := bufio.NewReader(rConn)
-	resp, err := http.ReadResponse(reader, req)
-	if err != nil {
-		logger.Warningf("[http] read response failed, err: %v", err)
-		return err
-	} else {
-		logger.Info("[http] read response success")
+	return http.ReadResponse(handler.rReader, req)
+}
+
+// error of connection closed or reset by peer, request may be sent again on new connection
+func isStaleConn(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// close remote connection, next request will dial again
+func (handler *HttpHandlerEProxy) resetRemote() {
+	if handler.rConn == nil {
+		return
 	}
-	logger.Debug(resp.Status)
-	// close body
-	defer resp.Body.Close()
-	// check if connect success
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("proxy response error, status code: %v, message: %s",
-			resp.StatusCode, resp.Status)
+	_ = handler.rConn.Close()
+	handler.rConn = nil
+	handler.rReader = nil
+}
+
+// copy raw data after protocol switched
+func (handler *HttpHandlerEProxy) relay() {
+	rConn := handler.rConn
+	if rConn == nil {
+		return
 	}
-	logger.Infof("[http] proxy: tunnel create success, [%s] -> [%s] -> [%s]",
-		handler.lAddr.String(), rConn.RemoteAddr(), handler.rAddr.String())
-	// save rConn handler
-	handler.rConn = rConn
-	return nil
+	limiters := handler.getLimiters()
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(countWriter{Writer: rConn, count: &handler.upload},
+			limitReader{Reader: handler.lReader, buckets: uploadBuckets(limiters)})
+		_ = rConn.Close()
+		close(done)
+	}()
+	_, _ = io.Copy(countWriter{Writer: handler.lConn, count: &handler.download},
+		limitReader{Reader: handler.rReader, buckets: downloadBuckets(limiters)})
+	// wake up upload, so that traffic is complete when reported
+	_ = handler.lConn.Close()
+	<-done
 }
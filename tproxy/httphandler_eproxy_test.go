@@ -0,0 +1,95 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package tproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/linuxdeepin/deepin-network-proxy/config"
+	"github.com/linuxdeepin/deepin-network-proxy/define"
+)
+
+// digest proxy server, first connection is closed after two requests as idle keep-alive timeout,
+// nonce count of each authorized request is sent to channel
+func serveDigestProxy(t *testing.T, listener net.Listener, counts chan<- string) {
+	const nonce = "dcd98b7102dd2f0e8b11d0f600bfb0c093"
+	for index := 0; ; index++ {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		reader := bufio.NewReader(conn)
+		for served := 0; index != 0 || served < 2; {
+			req, err := http.ReadRequest(reader)
+			if err != nil {
+				break
+			}
+			header := req.Header.Get("Proxy-Authorization")
+			if !strings.HasPrefix(header, "Digest ") {
+				_, _ = fmt.Fprintf(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n"+
+					"Proxy-Authenticate: Digest realm=\"proxy\", nonce=\"%s\", qop=\"auth\"\r\nContent-Length: 0\r\n\r\n", nonce)
+				continue
+			}
+			params := parseAuthParams(strings.TrimPrefix(header, "Digest "))
+			resp, _ := digestResponse("MD5", "user", "proxy", "pass", req.Method, params["uri"],
+				nonce, params["cnonce"], params["nc"], "auth")
+			if resp != params["response"] || params["uri"] != req.URL.String() {
+				t.Errorf("digest authorization is invalid, %s", header)
+			}
+			counts <- params["nc"]
+			_, _ = conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+			served++
+		}
+		_ = conn.Close()
+	}
+}
+
+// digest answer is computed for each request, request is sent again if kept alive connection closed
+func TestEProxyDigestKeepAlive(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	counts := make(chan string, 8)
+	go serveDigestProxy(t, listener, counts)
+	proxy := config.Proxy{
+		Server:   "127.0.0.1",
+		Port:     listener.Addr().(*net.TCPAddr).Port,
+		UserName: "user",
+		Password: "pass",
+	}
+	rAddr := &net.TCPAddr{IP: net.IP{1, 2, 3, 4}, Port: 80}
+	handler := NewHttpHandlerEProxy(define.Global, HandlerKey{}, proxy, rAddr, rAddr, nil)
+	defer handler.Close()
+	// nonce is reused on new connection, count keep increasing
+	last := ""
+	for index := 0; index < 3; index++ {
+		req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("http://deepin.org/%d", index), nil)
+		resp, err := handler.roundTrip(req)
+		if err != nil {
+			if index == 0 {
+				t.Skipf("dial proxy failed, mark may need privilege, err: %v", err)
+			}
+			t.Fatalf("request %d failed, err: %v", index, err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+			t.Fatalf("request %d response is %v %q", index, resp.StatusCode, body)
+		}
+		nc := <-counts
+		if index == 0 && nc != "00000001" || nc <= last {
+			t.Errorf("request %d nonce count is %s, last is %s", index, nc, last)
+		}
+		last = nc
+	}
+}
@@ -0,0 +1,240 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package tproxy
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/linuxdeepin/deepin-network-proxy/config"
+)
+
+/*
+	limit of scope or executable, shared by all tunnels of it.
+	bandwidth is limited by token bucket, which refill at rate and hold one second of tokens,
+	limit is changed in place, so that running tunnels follow new limit at once
+*/
+
+var ErrConnLimit = errors.New("max connections reached")
+
+// token bucket, rate in bytes per second, 0 as unlimited
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   int64
+	tokens int64
+	last   time.Time
+}
+
+// set rate, bucket start full
+func (bucket *tokenBucket) setRate(rate int64) {
+	bucket.lock.Lock()
+	defer bucket.lock.Unlock()
+	if rate < 0 {
+		rate = 0
+	}
+	if bucket.rate == rate {
+		return
+	}
+	bucket.rate = rate
+	bucket.tokens = rate
+	bucket.last = time.Now()
+}
+
+// max bytes taken at once, 0 as unlimited
+func (bucket *tokenBucket) burst() int64 {
+	bucket.lock.Lock()
+	defer bucket.lock.Unlock()
+	return bucket.rate
+}
+
+// add tokens since last time, at most one second of tokens, lock is held by caller
+func (bucket *tokenBucket) refill() {
+	now := time.Now()
+	bucket.tokens += int64(now.Sub(bucket.last)) * bucket.rate / int64(time.Second)
+	bucket.last = now
+	if bucket.tokens > bucket.rate {
+		bucket.tokens = bucket.rate
+	}
+}
+
+// check if n tokens can be taken without borrowing
+func (bucket *tokenBucket) available(n int64) bool {
+	bucket.lock.Lock()
+	defer bucket.lock.Unlock()
+	if bucket.rate == 0 {
+		return true
+	}
+	bucket.refill()
+	return bucket.tokens >= n
+}
+
+// take n tokens, tokens may be borrowed, return duration to wait until debt is paid
+func (bucket *tokenBucket) take(n int64) time.Duration {
+	bucket.lock.Lock()
+	defer bucket.lock.Unlock()
+	if bucket.rate == 0 {
+		return 0
+	}
+	bucket.refill()
+	bucket.tokens -= n
+	if bucket.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-bucket.tokens * int64(time.Second) / bucket.rate)
+}
+
+type Limiter struct {
+	upload   tokenBucket // local to remote
+	download tokenBucket // remote to local
+
+	maxConns int32
+	conns    int32
+}
+
+func NewLimiter() *Limiter {
+	return &Limiter{}
+}
+
+// update limit, connections over new max are kept
+func (limiter *Limiter) SetLimit(limit config.LimitConfig) {
+	limiter.upload.setRate(limit.Upload)
+	limiter.download.setRate(limit.Download)
+	atomic.StoreInt32(&limiter.maxConns, int32(limit.MaxConns))
+}
+
+// count of tunnels
+func (limiter *Limiter) Conns() int {
+	return int(atomic.LoadInt32(&limiter.conns))
+}
+
+// count one tunnel, fail if max reached
+func (limiter *Limiter) acquire() bool {
+	for {
+		conns := atomic.LoadInt32(&limiter.conns)
+		max := atomic.LoadInt32(&limiter.maxConns)
+		if max > 0 && conns >= max {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&limiter.conns, conns, conns+1) {
+			return true
+		}
+	}
+}
+
+func (limiter *Limiter) release() {
+	atomic.AddInt32(&limiter.conns, -1)
+}
+
+// count tunnel in all limiters, nothing is counted if any max reached
+func AcquireLimiters(limiters []*Limiter) error {
+	for index, limiter := range limiters {
+		if limiter.acquire() {
+			continue
+		}
+		ReleaseLimiters(limiters[:index])
+		return ErrConnLimit
+	}
+	return nil
+}
+
+func ReleaseLimiters(limiters []*Limiter) {
+	for _, limiter := range limiters {
+		limiter.release()
+	}
+}
+
+// wait for tokens of all buckets after each read
+type limitReader struct {
+	io.Reader
+	buckets []*tokenBucket
+}
+
+func (reader limitReader) Read(buf []byte) (int, error) {
+	// dont read more than one second of data, or the wait is too long
+	for _, bucket := range reader.buckets {
+		if burst := bucket.burst(); burst > 0 && int64(len(buf)) > burst {
+			buf = buf[:burst]
+		}
+	}
+	n, err := reader.Reader.Read(buf)
+	if n > 0 {
+		waitBuckets(reader.buckets, n)
+	}
+	return n, err
+}
+
+// wait for tokens of all buckets after each write, large buffer is written in pieces
+type limitWriter struct {
+	io.Writer
+	buckets []*tokenBucket
+}
+
+func (writer limitWriter) Write(buf []byte) (int, error) {
+	var written int
+	for len(buf) > 0 {
+		piece := buf
+		for _, bucket := range writer.buckets {
+			if burst := bucket.burst(); burst > 0 && int64(len(piece)) > burst {
+				piece = piece[:burst]
+			}
+		}
+		n, err := writer.Writer.Write(piece)
+		written += n
+		if n > 0 {
+			waitBuckets(writer.buckets, n)
+		}
+		if err != nil {
+			return written, err
+		}
+		buf = buf[n:]
+	}
+	return written, nil
+}
+
+// take n tokens of all buckets, wait for the longest debt
+func waitBuckets(buckets []*tokenBucket, n int) {
+	var wait time.Duration
+	for _, bucket := range buckets {
+		if d := bucket.take(int64(n)); d > wait {
+			wait = d
+		}
+	}
+	time.Sleep(wait)
+}
+
+// take n tokens of all buckets only if all have enough, datagram is dropped instead of waiting,
+// or one slow session blocks all others sharing the socket
+func admitBuckets(buckets []*tokenBucket, n int) bool {
+	for _, bucket := range buckets {
+		if !bucket.available(int64(n)) {
+			return false
+		}
+	}
+	for _, bucket := range buckets {
+		bucket.take(int64(n))
+	}
+	return true
+}
+
+// upload buckets of limiters
+func uploadBuckets(limiters []*Limiter) []*tokenBucket {
+	buckets := make([]*tokenBucket, 0, len(limiters))
+	for _, limiter := range limiters {
+		buckets = append(buckets, &limiter.upload)
+	}
+	return buckets
+}
+
+// download buckets of limiters
+func downloadBuckets(limiters []*Limiter) []*tokenBucket {
+	buckets := make([]*tokenBucket, 0, len(limiters))
+	for _, limiter := range limiters {
+		buckets = append(buckets, &limiter.download)
+	}
+	return buckets
+}
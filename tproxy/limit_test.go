@@ -0,0 +1,114 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package tproxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/linuxdeepin/deepin-network-proxy/config"
+	"github.com/linuxdeepin/deepin-network-proxy/define"
+)
+
+func TestTokenBucket(t *testing.T) {
+	var bucket tokenBucket
+	if wait := bucket.take(1 << 20); wait != 0 {
+		t.Errorf("unlimited bucket wait %v", wait)
+	}
+	bucket.setRate(1000)
+	// bucket start full
+	if wait := bucket.take(1000); wait != 0 {
+		t.Errorf("full bucket wait %v", wait)
+	}
+	// borrow half second
+	if wait := bucket.take(500); wait < 400*time.Millisecond || wait > 500*time.Millisecond {
+		t.Errorf("empty bucket wait %v, want about 500ms", wait)
+	}
+}
+
+// tunnel is not counted if any limiter reach max
+func TestAcquireLimiters(t *testing.T) {
+	scope, app := NewLimiter(), NewLimiter()
+	app.SetLimit(config.LimitConfig{MaxConns: 1})
+	limiters := []*Limiter{scope, app}
+	if err := AcquireLimiters(limiters); err != nil {
+		t.Fatal(err)
+	}
+	if err := AcquireLimiters(limiters); err != ErrConnLimit {
+		t.Fatalf("acquire over max got %v, want %v", err, ErrConnLimit)
+	}
+	if scope.Conns() != 1 || app.Conns() != 1 {
+		t.Errorf("conns is %v %v, want 1 1", scope.Conns(), app.Conns())
+	}
+	ReleaseLimiters(limiters)
+	if err := AcquireLimiters(limiters); err != nil {
+		t.Errorf("acquire after release failed, err: %v", err)
+	}
+}
+
+// udp datagram over rate is refused, tokens are not borrowed
+func TestAdmitBuckets(t *testing.T) {
+	var scope, app tokenBucket
+	scope.setRate(1000)
+	buckets := []*tokenBucket{&scope, &app}
+	if !admitBuckets(buckets, 600) {
+		t.Fatal("datagram under rate is refused")
+	}
+	if admitBuckets(buckets, 600) {
+		t.Fatal("datagram over rate is admitted")
+	}
+	// refused datagram take nothing
+	if !admitBuckets(buckets, 300) {
+		t.Error("datagram under left tokens is refused")
+	}
+}
+
+// relay of handler follow upload limit, bucket start full and the rest wait for refill
+func TestCommunicateLimit(t *testing.T) {
+	const rate = 64 * 1024
+	pipe := newRelayPipe(t)
+	defer pipe.close()
+	handler := NewTrojanHandler(define.Global, HandlerKey{SrcAddr: "test"}, config.Proxy{},
+		pipe.src.RemoteAddr(), pipe.dst.RemoteAddr(), pipe.src)
+	handler.rConn = pipe.dst
+	handler.AddMgr(NewHandlerMgr(define.Global))
+	limiter := NewLimiter()
+	limiter.SetLimit(config.LimitConfig{Upload: rate})
+	handler.SetLimiters([]*Limiter{limiter})
+	handler.Communicate()
+
+	data := make([]byte, 2*rate)
+	start := time.Now()
+	go func() {
+		_, _ = pipe.writer.Write(data)
+		_ = pipe.writer.(*net.TCPConn).CloseWrite()
+	}()
+	n, err := io.Copy(ioutil.Discard, pipe.sink)
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("remote read %v bytes, want %v, err: %v", n, len(data), err)
+	}
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond {
+		t.Errorf("relay %v bytes at %v/s took %v, want about 1s", len(data), rate, elapsed)
+	}
+}
+
+// writer split large buffer by burst and wait for tokens
+func TestLimitWriter(t *testing.T) {
+	var bucket tokenBucket
+	bucket.setRate(1000)
+	var buf bytes.Buffer
+	start := time.Now()
+	n, err := limitWriter{Writer: &buf, buckets: []*tokenBucket{&bucket}}.Write(make([]byte, 1500))
+	if err != nil || n != 1500 || buf.Len() != 1500 {
+		t.Fatalf("write %v bytes, buffer %v, err: %v", n, buf.Len(), err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("write 1500 bytes at 1000/s took %v, want about 500ms", elapsed)
+	}
+}
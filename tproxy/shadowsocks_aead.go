@@ -0,0 +1,384 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package tproxy
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"lukechampine.com/blake3"
+)
+
+/*
+	shadowsocks aead, SIP004 and SIP022 (2022-blake3)
+
+	tcp stream
+	+--------+-----------------+---------------------+-----------------+---------------------+
+	|  SALT  | LENGTH(sealed)  | PAYLOAD(sealed)     | LENGTH(sealed)  | PAYLOAD(sealed)     | ...
+	+--------+-----------------+---------------------+-----------------+---------------------+
+
+	udp packet
+	+--------+----------------------------------------+
+	|  SALT  | ATYP DST.ADDR DST.PORT PAYLOAD(sealed) |
+	+--------+----------------------------------------+
+*/
+
+const (
+	ssAes128Gcm     = "aes-128-gcm"
+	ssAes256Gcm     = "aes-256-gcm"
+	ssChacha20      = "chacha20-ietf-poly1305"
+	ss2022Aes128Gcm = "2022-blake3-aes-128-gcm"
+	ss2022Aes256Gcm = "2022-blake3-aes-256-gcm"
+	ss2022Chacha20  = "2022-blake3-chacha20-poly1305"
+
+	// max payload size of one chunk
+	ssMaxPayload     = 0x3FFF
+	ss2022MaxPayload = 0xFFFF
+	// tag size of all aead cipher
+	ssTagSize = 16
+
+	// 2022 header type
+	ss2022ClientType = 0
+	ss2022ServerType = 1
+	// 2022 timestamp difference allowed
+	ss2022MaxTimeDiff = 30 * time.Second
+	// 2022 padding of request without initial payload
+	ss2022MaxPadding = 900
+)
+
+// shadowsocks cipher, key is master key
+type ssCipher struct {
+	method  string
+	key     []byte
+	keySize int
+	is2022  bool
+	chacha  bool
+}
+
+// create cipher by method, 2022 method use base64 key, others derive key from password if key is empty
+func newSsCipher(method string, key string, password string) (*ssCipher, error) {
+	c := &ssCipher{method: method}
+	switch method {
+	case ssAes128Gcm:
+		c.keySize = 16
+	case ssAes256Gcm:
+		c.keySize = 32
+	case ssChacha20:
+		c.keySize = 32
+		c.chacha = true
+	case ss2022Aes128Gcm:
+		c.keySize = 16
+		c.is2022 = true
+	case ss2022Aes256Gcm:
+		c.keySize = 32
+		c.is2022 = true
+	case ss2022Chacha20:
+		c.keySize = 32
+		c.is2022 = true
+		c.chacha = true
+	default:
+		return nil, fmt.Errorf("shadowsocks method [%s] is not supported", method)
+	}
+	if key != "" {
+		buf, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, fmt.Errorf("shadowsocks key is not base64, err: %v", err)
+		}
+		if len(buf) != c.keySize {
+			return nil, fmt.Errorf("shadowsocks key size of [%s] should be %v, but %v", method, c.keySize, len(buf))
+		}
+		c.key = buf
+		return c, nil
+	}
+	if c.is2022 {
+		return nil, fmt.Errorf("shadowsocks method [%s] need base64 key", method)
+	}
+	if password == "" {
+		return nil, errors.New("shadowsocks key and password are both empty")
+	}
+	c.key = evpBytesToKey(password, c.keySize)
+	return c, nil
+}
+
+// derive key from password as openssl EVP_BytesToKey with md5
+func evpBytesToKey(password string, size int) []byte {
+	var key, prev []byte
+	for len(key) < size {
+		h := md5.New()
+		h.Write(prev)
+		h.Write([]byte(password))
+		prev = h.Sum(nil)
+		key = append(key, prev...)
+	}
+	return key[:size]
+}
+
+// derive session subkey from salt
+func (c *ssCipher) subKey(salt []byte) []byte {
+	subKey := make([]byte, c.keySize)
+	if c.is2022 {
+		material := append(append([]byte(nil), c.key...), salt...)
+		blake3.DeriveKey(subKey, "shadowsocks 2022 session subkey", material)
+		return subKey
+	}
+	_, _ = io.ReadFull(hkdf.New(sha1.New, c.key, salt, []byte("ss-subkey")), subKey)
+	return subKey
+}
+
+// create aead with key
+func (c *ssCipher) aead(key []byte) (cipher.AEAD, error) {
+	if c.chacha {
+		return chacha20poly1305.New(key)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// create aead of session
+func (c *ssCipher) sessionAead(salt []byte) (cipher.AEAD, error) {
+	return c.aead(c.subKey(salt))
+}
+
+// max payload of one chunk
+func (c *ssCipher) maxPayload() int {
+	if c.is2022 {
+		return ss2022MaxPayload
+	}
+	return ssMaxPayload
+}
+
+// increase nonce as little endian counter
+func increaseNonce(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+// random bytes
+func randomBytes(size int) []byte {
+	buf := make([]byte, size)
+	_, _ = rand.Read(buf)
+	return buf
+}
+
+// check 2022 timestamp
+func check2022Timestamp(ts uint64) error {
+	diff := time.Since(time.Unix(int64(ts), 0))
+	if diff > ss2022MaxTimeDiff || diff < -ss2022MaxTimeDiff {
+		return fmt.Errorf("shadowsocks timestamp is out of range, diff: %v", diff)
+	}
+	return nil
+}
+
+// connection to shadowsocks server, data is sealed in chunks
+type ssConn struct {
+	net.Conn
+	cipher *ssCipher
+
+	// write side
+	wAead  cipher.AEAD
+	wNonce []byte
+	wSalt  []byte
+	wBuf   []byte
+
+	// read side
+	rAead    cipher.AEAD
+	rNonce   []byte
+	rBuf     []byte
+	rPending []byte
+}
+
+func newSsConn(conn net.Conn, c *ssCipher) *ssConn {
+	return &ssConn{
+		Conn:   conn,
+		cipher: c,
+	}
+}
+
+// seal one block with write aead and append to dst
+func (conn *ssConn) seal(dst []byte, plain []byte) []byte {
+	dst = conn.wAead.Seal(dst, conn.wNonce, plain, nil)
+	increaseNonce(conn.wNonce)
+	return dst
+}
+
+// read and open one block with read aead
+func (conn *ssConn) open(size int) ([]byte, error) {
+	if cap(conn.rBuf) < size+ssTagSize {
+		conn.rBuf = make([]byte, size+ssTagSize)
+	}
+	buf := conn.rBuf[:size+ssTagSize]
+	_, err := io.ReadFull(conn.Conn, buf)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := conn.rAead.Open(buf[:0], conn.rNonce, buf, nil)
+	if err != nil {
+		return nil, err
+	}
+	increaseNonce(conn.rNonce)
+	return plain, nil
+}
+
+// send request header with remote addr, payload is sent later
+func (conn *ssConn) writeHeader(rAddr net.Addr) error {
+	addr, err := marshalSocksAddr(rAddr)
+	if err != nil {
+		return err
+	}
+	conn.wSalt = randomBytes(conn.cipher.keySize)
+	conn.wAead, err = conn.cipher.sessionAead(conn.wSalt)
+	if err != nil {
+		return err
+	}
+	conn.wNonce = make([]byte, conn.wAead.NonceSize())
+	buf := append([]byte(nil), conn.wSalt...)
+	if !conn.cipher.is2022 {
+		buf = conn.appendChunk(buf, addr)
+		_, err = conn.Conn.Write(buf)
+		return err
+	}
+	/*
+		2022 request header
+		fixed length header: TYPE(1) TIMESTAMP(8) LENGTH(2)
+		variable length header: ATYP DST.ADDR DST.PORT PADDING_LENGTH(2) PADDING
+	*/
+	padding, _ := rand.Int(rand.Reader, big.NewInt(ss2022MaxPadding))
+	paddingLen := int(padding.Int64()) + 1
+	variable := make([]byte, 0, len(addr)+2+paddingLen)
+	variable = append(variable, addr...)
+	variable = append(variable, byte(paddingLen>>8), byte(paddingLen))
+	variable = append(variable, make([]byte, paddingLen)...)
+	fixed := make([]byte, 11)
+	fixed[0] = ss2022ClientType
+	binary.BigEndian.PutUint64(fixed[1:9], uint64(time.Now().Unix()))
+	binary.BigEndian.PutUint16(fixed[9:11], uint16(len(variable)))
+	buf = conn.seal(buf, fixed)
+	buf = conn.seal(buf, variable)
+	_, err = conn.Conn.Write(buf)
+	return err
+}
+
+// seal payload as length chunk and payload chunk
+func (conn *ssConn) appendChunk(dst []byte, payload []byte) []byte {
+	length := []byte{byte(len(payload) >> 8), byte(len(payload))}
+	dst = conn.seal(dst, length)
+	return conn.seal(dst, payload)
+}
+
+// rewrite write, split data into chunks
+func (conn *ssConn) Write(buf []byte) (int, error) {
+	maxPayload := conn.cipher.maxPayload()
+	written := 0
+	for len(buf) > 0 {
+		size := len(buf)
+		if size > maxPayload {
+			size = maxPayload
+		}
+		conn.wBuf = conn.appendChunk(conn.wBuf[:0], buf[:size])
+		_, err := conn.Conn.Write(conn.wBuf)
+		if err != nil {
+			return written, err
+		}
+		written += size
+		buf = buf[size:]
+	}
+	return written, nil
+}
+
+// chunks are complete after each write, pass half close to server
+func (conn *ssConn) CloseWrite() error {
+	return closeWrite(conn.Conn)
+}
+
+// read response salt and header
+func (conn *ssConn) readHeader() error {
+	salt := make([]byte, conn.cipher.keySize)
+	_, err := io.ReadFull(conn.Conn, salt)
+	if err != nil {
+		return err
+	}
+	conn.rAead, err = conn.cipher.sessionAead(salt)
+	if err != nil {
+		return err
+	}
+	conn.rNonce = make([]byte, conn.rAead.NonceSize())
+	if !conn.cipher.is2022 {
+		return nil
+	}
+	/*
+		2022 response header
+		fixed length header: TYPE(1) TIMESTAMP(8) REQUEST_SALT LENGTH(2)
+	*/
+	keySize := conn.cipher.keySize
+	fixed, err := conn.open(1 + 8 + keySize + 2)
+	if err != nil {
+		return err
+	}
+	if fixed[0] != ss2022ServerType {
+		return fmt.Errorf("shadowsocks response type %v is invalid", fixed[0])
+	}
+	err = check2022Timestamp(binary.BigEndian.Uint64(fixed[1:9]))
+	if err != nil {
+		return err
+	}
+	if string(fixed[9:9+keySize]) != string(conn.wSalt) {
+		return errors.New("shadowsocks response salt dont match request")
+	}
+	// first payload chunk has no length chunk
+	length := int(binary.BigEndian.Uint16(fixed[9+keySize:]))
+	payload, err := conn.open(length)
+	if err != nil {
+		return err
+	}
+	conn.rPending = payload
+	return nil
+}
+
+// rewrite read, open chunks
+func (conn *ssConn) Read(buf []byte) (int, error) {
+	if conn.rAead == nil {
+		err := conn.readHeader()
+		if err != nil {
+			return 0, err
+		}
+	}
+	for len(conn.rPending) == 0 {
+		lengthBuf, err := conn.open(2)
+		if err != nil {
+			return 0, err
+		}
+		length := int(binary.BigEndian.Uint16(lengthBuf))
+		if !conn.cipher.is2022 {
+			length &= ssMaxPayload
+		}
+		conn.rPending, err = conn.open(length)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(buf, conn.rPending)
+	conn.rPending = conn.rPending[n:]
+	return n, nil
+}
@@ -0,0 +1,273 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package tproxy
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+func TestEvpBytesToKey(t *testing.T) {
+	key := evpBytesToKey("foobar", 32)
+	want := "3858f62230ac3c915f300c664312c63f568378529614d22ddb49237d2f60bfdf"
+	if hex.EncodeToString(key) != want {
+		t.Errorf("key is %x, want %s", key, want)
+	}
+}
+
+// request stream can be read by the same cipher, payload larger than one chunk is split
+func TestSsConnStream(t *testing.T) {
+	for _, method := range []string{ssAes128Gcm, ssAes256Gcm, ssChacha20} {
+		c, err := newSsCipher(method, "", "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, server := net.Pipe()
+		rAddr := &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 443}
+		payload := bytes.Repeat([]byte("shadowsocks"), 4000)
+		go func() {
+			conn := newSsConn(client, c)
+			_ = conn.writeHeader(rAddr)
+			_, _ = conn.Write(payload)
+			_ = client.Close()
+		}()
+		buf, err := ioutil.ReadAll(newSsConn(server, c))
+		if err != nil {
+			t.Fatalf("%s read stream failed, err: %v", method, err)
+		}
+		addr, _ := marshalSocksAddr(rAddr)
+		if !bytes.Equal(buf, append(addr, payload...)) {
+			t.Errorf("%s stream dont match, len %v", method, len(buf))
+		}
+	}
+}
+
+// sequential bytes from start, as key and salt of vectors
+func seqBytes(start byte, size int) []byte {
+	buf := make([]byte, size)
+	for i := range buf {
+		buf[i] = start + byte(i)
+	}
+	return buf
+}
+
+func newTestSs2022Cipher(t *testing.T, method string, keySize int) *ssCipher {
+	c, err := newSsCipher(method, base64.StdEncoding.EncodeToString(seqBytes(0, keySize)), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// subkey is blake3 derive key of master key and salt, vectors computed by another blake3 implementation
+func TestSs2022SubKey(t *testing.T) {
+	vectors := []struct {
+		method string
+		size   int
+		salt   []byte
+		want   string
+	}{
+		{ss2022Aes256Gcm, 32, seqBytes(0x80, 32), "11289b9d205255930f83932405c2b0a38ec32be703fe33f290ff25ffeff402f9"},
+		{ss2022Aes128Gcm, 16, seqBytes(0x80, 16), "722b3033c5d021365a8521bfb41157a3"},
+		// udp session id as salt
+		{ss2022Aes128Gcm, 16, seqBytes(1, 8), "b8473b44792f673ee36a405dfa755cc4"},
+	}
+	for _, vector := range vectors {
+		c := newTestSs2022Cipher(t, vector.method, vector.size)
+		if subKey := hex.EncodeToString(c.subKey(vector.salt)); subKey != vector.want {
+			t.Errorf("%s subkey is %s, want %s", vector.method, subKey, vector.want)
+		}
+	}
+}
+
+// server side of 2022 tcp stream, open chunks in order
+type ss2022Reader struct {
+	t      *testing.T
+	reader io.Reader
+	aead   cipher.AEAD
+	nonce  []byte
+}
+
+func (r *ss2022Reader) open(size int) []byte {
+	buf := make([]byte, size+ssTagSize)
+	if _, err := io.ReadFull(r.reader, buf); err != nil {
+		r.t.Fatal(err)
+	}
+	plain, err := r.aead.Open(nil, r.nonce, buf, nil)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	increaseNonce(r.nonce)
+	return plain
+}
+
+// request header is read as server, response header with request salt is accepted by client
+func TestSs2022TcpHeader(t *testing.T) {
+	c := newTestSs2022Cipher(t, ss2022Aes256Gcm, 32)
+	client, server := net.Pipe()
+	defer server.Close()
+	rAddr := &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 443}
+	conn := newSsConn(client, c)
+	reply := make(chan []byte)
+	go func() {
+		_ = conn.writeHeader(rAddr)
+		_, _ = conn.Write([]byte("hello"))
+		buf := make([]byte, 16)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Error(err)
+		}
+		reply <- buf[:n]
+	}()
+
+	salt := make([]byte, 32)
+	if _, err := io.ReadFull(server, salt); err != nil {
+		t.Fatal(err)
+	}
+	aead, _ := c.sessionAead(salt)
+	reader := &ss2022Reader{t: t, reader: server, aead: aead, nonce: make([]byte, aead.NonceSize())}
+	fixed := reader.open(11)
+	if fixed[0] != ss2022ClientType {
+		t.Errorf("request type is %v", fixed[0])
+	}
+	if err := check2022Timestamp(binary.BigEndian.Uint64(fixed[1:9])); err != nil {
+		t.Error(err)
+	}
+	variable := reader.open(int(binary.BigEndian.Uint16(fixed[9:11])))
+	addr, _ := marshalSocksAddr(rAddr)
+	if !bytes.HasPrefix(variable, addr) {
+		t.Fatalf("request addr is %x, want %x", variable, addr)
+	}
+	padding := variable[len(addr)+2:]
+	if paddingLen := int(binary.BigEndian.Uint16(variable[len(addr):])); paddingLen == 0 ||
+		paddingLen != len(padding) || !bytes.Equal(padding, make([]byte, paddingLen)) {
+		t.Errorf("request padding length is %v, padding %x", paddingLen, padding)
+	}
+	length := reader.open(2)
+	if payload := reader.open(int(binary.BigEndian.Uint16(length))); string(payload) != "hello" {
+		t.Errorf("request payload is %q", payload)
+	}
+
+	// TYPE(1) TIMESTAMP(8) REQUEST_SALT LENGTH(2), then payload without length chunk
+	respSalt := seqBytes(0x40, 32)
+	respAead, _ := c.sessionAead(respSalt)
+	nonce := make([]byte, respAead.NonceSize())
+	header := make([]byte, 9, 11+len(salt))
+	header[0] = ss2022ServerType
+	binary.BigEndian.PutUint64(header[1:], uint64(time.Now().Unix()))
+	header = append(header, salt...)
+	header = append(header, 0, 5)
+	resp := respAead.Seal(respSalt, nonce, header, nil)
+	increaseNonce(nonce)
+	resp = respAead.Seal(resp, nonce, []byte("world"), nil)
+	if _, err := server.Write(resp); err != nil {
+		t.Fatal(err)
+	}
+	if buf := <-reply; string(buf) != "world" {
+		t.Errorf("response payload is %q", buf)
+	}
+}
+
+// 2022 udp packet with aes separate header, header is aes block of master key
+func TestSs2022UdpSeparateHeader(t *testing.T) {
+	c := newTestSs2022Cipher(t, ss2022Aes128Gcm, 16)
+	handler := &UdpShadowsocksHandler{cipher: c, sessionID: seqBytes(1, 8)}
+	handler.block, _ = aes.NewCipher(c.key)
+	handler.wAead, _ = c.sessionAead(handler.sessionID)
+	rAddr := &net.UDPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 53}
+	msg, err := handler.pack(rAddr, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// SESSION_ID 0102030405060708 PACKET_ID 1, encrypted by openssl aes-128-ecb
+	if header := hex.EncodeToString(msg[:16]); header != "cf91ad9eddf9ce645b515e2382d1c8cc" {
+		t.Errorf("separate header is %s", header)
+	}
+	// body is sealed by session subkey from vector, nonce is last 12 bytes of plain header
+	subKey, _ := hex.DecodeString("b8473b44792f673ee36a405dfa755cc4")
+	block, _ := aes.NewCipher(subKey)
+	gcm, _ := cipher.NewGCM(block)
+	header, _ := hex.DecodeString("01020304050607080000000000000001")
+	body, err := gcm.Open(nil, header[4:], msg[16:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, _ := marshalSocksAddr(rAddr)
+	if body[0] != ss2022ClientType || !bytes.Equal(body[9:], append([]byte{0, 0}, append(addr, "hello"...)...)) {
+		t.Errorf("packet body is %x", body)
+	}
+
+	// server packet
+	serverSession := seqBytes(0x11, 8)
+	header = append(serverSession, 0, 0, 0, 0, 0, 0, 0, 1)
+	body = make([]byte, 9)
+	body[0] = ss2022ServerType
+	binary.BigEndian.PutUint64(body[1:], uint64(time.Now().Unix()))
+	body = append(body, handler.sessionID...)
+	body = append(body, 0, 0)
+	body = append(body, addr...)
+	body = append(body, "world"...)
+	serverAead, _ := c.sessionAead(serverSession)
+	msg = make([]byte, 16)
+	handler.block.Encrypt(msg, header)
+	msg = serverAead.Seal(msg, header[4:], body, nil)
+	pkg, err := handler.unpack(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkg.Addr.String() != rAddr.String() || string(pkg.Data) != "world" {
+		t.Errorf("unpack packet from %v, data %q", pkg.Addr, pkg.Data)
+	}
+}
+
+// 2022 udp packet with chacha, whole packet is sealed by xchacha20 of master key
+func TestSs2022UdpXChacha(t *testing.T) {
+	c := newTestSs2022Cipher(t, ss2022Chacha20, 32)
+	handler := &UdpShadowsocksHandler{cipher: c, sessionID: seqBytes(1, 8)}
+	handler.xAead, _ = chacha20poly1305.NewX(c.key)
+	rAddr := &net.UDPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 53}
+	msg, err := handler.pack(rAddr, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, _ := chacha20poly1305.NewX(seqBytes(0, 32))
+	plain, err := aead.Open(nil, msg[:chacha20poly1305.NonceSizeX], msg[chacha20poly1305.NonceSizeX:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, _ := marshalSocksAddr(rAddr)
+	if !bytes.Equal(plain[:16], []byte{1, 2, 3, 4, 5, 6, 7, 8, 0, 0, 0, 0, 0, 0, 0, 1}) ||
+		plain[16] != ss2022ClientType || !bytes.Equal(plain[25:], append([]byte{0, 0}, append(addr, "hello"...)...)) {
+		t.Errorf("packet is %x", plain)
+	}
+
+	// server packet, with padding
+	plain = append(seqBytes(0x11, 8), 0, 0, 0, 0, 0, 0, 0, 1, ss2022ServerType)
+	plain = append(plain, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(plain[17:], uint64(time.Now().Unix()))
+	plain = append(plain, handler.sessionID...)
+	plain = append(plain, 0, 3, 0, 0, 0)
+	plain = append(plain, addr...)
+	plain = append(plain, "world"...)
+	nonce := seqBytes(0x20, chacha20poly1305.NonceSizeX)
+	pkg, err := handler.unpack(aead.Seal(nonce, nonce, plain, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkg.Addr.String() != rAddr.String() || string(pkg.Data) != "world" {
+		t.Errorf("unpack packet from %v, data %q", pkg.Addr, pkg.Data)
+	}
+}
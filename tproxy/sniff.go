@@ -0,0 +1,194 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package tproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+	sniff domain from first bytes sent by local, tls client hello sni or http host header,
+	data is peeked by MSG_PEEK and not consumed, connection is still relayed by splice
+*/
+
+// max bytes peeked, client hello with post quantum key share is about 2k
+const sniffBufferSize = 4096
+
+var (
+	errSniffNeedMore = errors.New("sniff need more data")
+	errSniffNotMatch = errors.New("sniff protocol not match")
+)
+
+// http methods, request line start with one of them
+var sniffHttpMethods = []string{"GET ", "POST ", "PUT ", "HEAD ", "DELETE ", "OPTIONS ", "PATCH ", "TRACE "}
+
+// sniff domain from data of local, server speak first protocol wait until timeout
+func SniffDomain(conn net.Conn, timeout time.Duration) (string, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return "", errors.New("sniff only support tcp connection")
+	}
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	_ = tcpConn.SetReadDeadline(time.Now().Add(timeout))
+	defer tcpConn.SetReadDeadline(time.Time{})
+	buf := make([]byte, sniffBufferSize)
+	var n int
+	var domain string
+	sniffErr := errSniffNeedMore
+	err = rawConn.Read(func(fd uintptr) bool {
+		size, _, err := unix.Recvfrom(int(fd), buf, unix.MSG_PEEK|unix.MSG_DONTWAIT)
+		if err == unix.EAGAIN || err == unix.EINTR {
+			return false
+		}
+		if err != nil || size <= 0 {
+			return true
+		}
+		n = size
+		domain, sniffErr = sniff(buf[:n])
+		// all data is peeked again when more data arrived
+		return sniffErr != errSniffNeedMore || n == len(buf)
+	})
+	if sniffErr != errSniffNeedMore {
+		return domain, sniffErr
+	}
+	if err != nil {
+		return "", err
+	}
+	return "", sniffErr
+}
+
+// sniff tls and http
+func sniff(buf []byte) (string, error) {
+	domain, err := sniffTLS(buf)
+	if err != errSniffNotMatch {
+		return domain, err
+	}
+	return sniffHttp(buf)
+}
+
+// server name of tls client hello
+func sniffTLS(buf []byte) (string, error) {
+	/*
+		record: TYPE(1) 0x16 VERSION(2) LENGTH(2)
+		handshake: TYPE(1) 0x01 LENGTH(3) VERSION(2) RANDOM(32) SESSION_ID CIPHER_SUITES COMPRESSION EXTENSIONS
+	*/
+	if len(buf) < 1 {
+		return "", errSniffNeedMore
+	}
+	if buf[0] != 0x16 {
+		return "", errSniffNotMatch
+	}
+	if len(buf) < 9 {
+		return "", errSniffNeedMore
+	}
+	if buf[1] != 0x03 || buf[5] != 0x01 {
+		return "", errSniffNotMatch
+	}
+	// client hello larger than one record is rare, dont sniff it
+	recLen := int(binary.BigEndian.Uint16(buf[3:5]))
+	hsLen := int(buf[6])<<16 | int(buf[7])<<8 | int(buf[8])
+	if hsLen+4 > recLen {
+		return "", errSniffNotMatch
+	}
+	msg := buf[9:]
+	if len(msg) < hsLen {
+		return "", errSniffNeedMore
+	}
+	msg = msg[:hsLen]
+	// version and random
+	offset := 2 + 32
+	// session id, cipher suites, compression methods
+	for _, lenSize := range []int{1, 2, 1} {
+		if len(msg) < offset+lenSize {
+			return "", errSniffNotMatch
+		}
+		size := int(msg[offset])
+		if lenSize == 2 {
+			size = int(binary.BigEndian.Uint16(msg[offset:]))
+		}
+		offset += lenSize + size
+	}
+	if len(msg) < offset+2 {
+		// no extension
+		return "", errSniffNotMatch
+	}
+	exts := msg[offset+2:]
+	for len(exts) >= 4 {
+		extTyp := binary.BigEndian.Uint16(exts)
+		extLen := int(binary.BigEndian.Uint16(exts[2:]))
+		if len(exts) < 4+extLen {
+			return "", errSniffNotMatch
+		}
+		ext := exts[4 : 4+extLen]
+		exts = exts[4+extLen:]
+		if extTyp != 0 {
+			continue
+		}
+		// server name list: LENGTH(2) TYPE(1) 0x00 NAME_LENGTH(2) NAME
+		if len(ext) < 5 || ext[2] != 0 {
+			return "", errSniffNotMatch
+		}
+		nameLen := int(binary.BigEndian.Uint16(ext[3:]))
+		if len(ext) < 5+nameLen {
+			return "", errSniffNotMatch
+		}
+		return checkSniffDomain(string(ext[5 : 5+nameLen]))
+	}
+	return "", errSniffNotMatch
+}
+
+// host header of http request
+func sniffHttp(buf []byte) (string, error) {
+	matched := false
+	for _, method := range sniffHttpMethods {
+		size := len(method)
+		if len(buf) < size {
+			size = len(buf)
+		}
+		if string(buf[:size]) == method[:size] {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return "", errSniffNotMatch
+	}
+	end := bytes.Index(buf, []byte("\r\n\r\n"))
+	if end < 0 {
+		return "", errSniffNeedMore
+	}
+	lines := strings.Split(string(buf[:end]), "\r\n")
+	for _, line := range lines[1:] {
+		index := strings.IndexByte(line, ':')
+		if index < 0 || !strings.EqualFold(strings.TrimSpace(line[:index]), "host") {
+			continue
+		}
+		host := strings.TrimSpace(line[index+1:])
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return checkSniffDomain(host)
+	}
+	return "", errSniffNotMatch
+}
+
+// ip is not a domain, and domain must fit in socks addr
+func checkSniffDomain(domain string) (string, error) {
+	domain = strings.TrimSuffix(strings.Trim(domain, "[]"), ".")
+	if domain == "" || len(domain) > 255 || net.ParseIP(domain) != nil {
+		return "", errSniffNotMatch
+	}
+	return strings.ToLower(domain), nil
+}
@@ -0,0 +1,88 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package tproxy
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// client hello of crypto/tls, sent to one end of pipe
+func clientHello(t *testing.T, serverName string) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		conn := tls.Client(client, &tls.Config{ServerName: serverName})
+		_ = conn.Handshake()
+	}()
+	buf := make([]byte, sniffBufferSize)
+	n, err := server.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = client.Close()
+	return buf[:n]
+}
+
+func TestSniff(t *testing.T) {
+	hello := clientHello(t, "www.Deepin.org")
+	tests := []struct {
+		data   string
+		domain string
+		err    error
+	}{
+		{string(hello), "www.deepin.org", nil},
+		{string(hello[:len(hello)/2]), "", errSniffNeedMore},
+		{"GET / HTTP/1.1\r\nUser-Agent: curl\r\nHost: example.com:8080\r\n\r\n", "example.com", nil},
+		{"POST /upload HTTP/1.0\r\nhost:Example.COM\r\n\r\nbody", "example.com", nil},
+		{"GET / HTTP/1.1\r\nHost: 1.2.3.4\r\n\r\n", "", errSniffNotMatch},
+		{"GET / HTTP/1.1\r\nHost: example.com\r\n", "", errSniffNeedMore},
+		{"PU", "", errSniffNeedMore},
+		{"SSH-2.0-OpenSSH_9.0\r\n", "", errSniffNotMatch},
+	}
+	for _, test := range tests {
+		domain, err := sniff([]byte(test.data))
+		if domain != test.domain || err != test.err {
+			t.Errorf("sniff %q, got %q %v, want %q %v", test.data, domain, err, test.domain, test.err)
+		}
+	}
+}
+
+// data is peeked, the same data can be read after sniff
+func TestSniffDomain(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	request := "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	// request is split, sniff wait for the rest
+	go func() {
+		_, _ = client.Write([]byte(request[:10]))
+		time.Sleep(50 * time.Millisecond)
+		_, _ = client.Write([]byte(request[10:]))
+		_ = client.Close()
+	}()
+	domain, err := SniffDomain(conn, time.Second)
+	if err != nil || domain != "example.com" {
+		t.Fatalf("sniff domain got %q, err: %v", domain, err)
+	}
+	data, err := ioutil.ReadAll(conn)
+	if err != nil || string(data) != request {
+		t.Errorf("read after sniff got %q, err: %v", data, err)
+	}
+}
@@ -0,0 +1,269 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package tproxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/linuxdeepin/deepin-network-proxy/config"
+	"github.com/linuxdeepin/deepin-network-proxy/define"
+)
+
+/*
+	pool of pre-dialed and pre-authenticated sock5 connections, ready to send connect request.
+	pool size is adaptive, it grows when a connection is wanted but pool is empty,
+	and shrinks when pooled connection expires without being used
+*/
+
+const (
+	// server may close connection which sent no request for a while
+	sock5PoolIdle = 30 * time.Second
+	// interval to expire and refill connections
+	sock5PoolInterval = 5 * time.Second
+	// pool is removed if not used in this duration
+	sock5PoolUnused = 5 * time.Minute
+)
+
+// pool is shared by handlers of the same proxy in scope
+type sock5PoolKey struct {
+	scope    define.Scope
+	name     string
+	server   string
+	port     int
+	user     string
+	password string
+	// tls, transport and pool size, pool is created again when they changed
+	ident string
+}
+
+type sock5PoolConn struct {
+	conn  net.Conn
+	ready time.Time
+}
+
+type sock5Pool struct {
+	key sock5PoolKey
+	// dial and auth new connection, dont keep handler itself
+	dialer *handlerPrv
+
+	lock    sync.Mutex
+	conns   []sock5PoolConn
+	target  int // connections wanted in pool
+	max     int
+	dialing int
+	lastUse time.Time
+	closed  bool
+
+	refill chan struct{}
+}
+
+var sock5PoolMap = make(map[sock5PoolKey]*sock5Pool)
+var sock5PoolLock sync.Mutex
+
+// get pool of proxy, create if not exist
+func getSock5Pool(pr *handlerPrv) *sock5Pool {
+	key := sock5PoolKey{
+		scope:    pr.scope,
+		name:     pr.proxy.Name,
+		server:   pr.proxy.Server,
+		port:     pr.proxy.Port,
+		user:     pr.proxy.UserName,
+		password: pr.proxy.Password,
+		ident:    sock5PoolIdent(pr.proxy),
+	}
+	sock5PoolLock.Lock()
+	defer sock5PoolLock.Unlock()
+	if pool, ok := sock5PoolMap[key]; ok {
+		return pool
+	}
+	pool := &sock5Pool{
+		key:     key,
+		dialer:  &handlerPrv{typ: pr.typ, scope: pr.scope, proxy: pr.proxy},
+		max:     pr.proxy.PoolSize,
+		lastUse: time.Now(),
+		refill:  make(chan struct{}, 1),
+	}
+	sock5PoolMap[key] = pool
+	go pool.maintain()
+	logger.Debugf("[%s] sock5 pool created, server [%s:%v], max: %v", pr.scope, key.server, key.port, pool.max)
+	return pool
+}
+
+// close all pools of scope
+func CloseSock5Pool(scope define.Scope) {
+	var pools []*sock5Pool
+	sock5PoolLock.Lock()
+	for key, pool := range sock5PoolMap {
+		if key.scope != scope {
+			continue
+		}
+		pools = append(pools, pool)
+		delete(sock5PoolMap, key)
+	}
+	sock5PoolLock.Unlock()
+	for _, pool := range pools {
+		pool.close()
+	}
+}
+
+// get ready connection, nil if pool is empty
+func (pool *sock5Pool) get() net.Conn {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	if pool.closed {
+		return nil
+	}
+	pool.lastUse = time.Now()
+	var conn net.Conn
+	// newest connection is least likely closed by server
+	for len(pool.conns) != 0 && conn == nil {
+		last := pool.conns[len(pool.conns)-1]
+		pool.conns = pool.conns[:len(pool.conns)-1]
+		if time.Since(last.ready) < sock5PoolIdle {
+			conn = last.conn
+			continue
+		}
+		_ = last.conn.Close()
+	}
+	if conn == nil && pool.target < pool.max {
+		// demand is more than pool, grow fast as browser open many connections at once
+		pool.target = pool.target*2 + 1
+		if pool.target > pool.max {
+			pool.target = pool.max
+		}
+	}
+	pool.notify()
+	return conn
+}
+
+// wake up maintain loop to refill
+func (pool *sock5Pool) notify() {
+	select {
+	case pool.refill <- struct{}{}:
+	default:
+	}
+}
+
+// expire idle connections and refill until target
+func (pool *sock5Pool) maintain() {
+	ticker := time.NewTicker(sock5PoolInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-pool.refill:
+		}
+		if !pool.expire() {
+			return
+		}
+		pool.fill()
+	}
+}
+
+// close expired connections, return false if pool is closed or removed
+func (pool *sock5Pool) expire() bool {
+	pool.lock.Lock()
+	if pool.closed {
+		pool.lock.Unlock()
+		return false
+	}
+	conns := pool.conns[:0]
+	for _, elem := range pool.conns {
+		if time.Since(elem.ready) < sock5PoolIdle {
+			conns = append(conns, elem)
+			continue
+		}
+		_ = elem.conn.Close()
+		// connection is not used, pool is larger than demand
+		if pool.target > 0 {
+			pool.target--
+		}
+	}
+	pool.conns = conns
+	unused := len(pool.conns) == 0 && pool.dialing == 0 && time.Since(pool.lastUse) > sock5PoolUnused
+	pool.closed = unused
+	pool.lock.Unlock()
+	if !unused {
+		return true
+	}
+	// map lock is not held with pool lock
+	sock5PoolLock.Lock()
+	if sock5PoolMap[pool.key] == pool {
+		delete(sock5PoolMap, pool.key)
+	}
+	sock5PoolLock.Unlock()
+	logger.Debugf("[%s] sock5 pool is unused, removed", pool.key.scope)
+	return false
+}
+
+// dial connections until target
+func (pool *sock5Pool) fill() {
+	pool.lock.Lock()
+	count := pool.target - len(pool.conns) - pool.dialing
+	if count > 0 {
+		pool.dialing += count
+	}
+	pool.lock.Unlock()
+	for i := 0; i < count; i++ {
+		go func() {
+			conn, err := pool.dial()
+			pool.lock.Lock()
+			defer pool.lock.Unlock()
+			pool.dialing--
+			if err != nil {
+				logger.Debugf("[%s] sock5 pool dial failed, err: %v", pool.key.scope, err)
+				return
+			}
+			if pool.closed || len(pool.conns) >= pool.target {
+				_ = conn.Close()
+				return
+			}
+			pool.conns = append(pool.conns, sock5PoolConn{conn: conn, ready: time.Now()})
+		}()
+	}
+}
+
+// dial and auth, no deadline is left
+func (pool *sock5Pool) dial() (net.Conn, error) {
+	conn, err := pool.dialer.dialProxy()
+	if err != nil {
+		return nil, err
+	}
+	err = pool.dialer.sock5Handshake(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// config which connections in pool are dialed with
+func sock5PoolIdent(proxy config.Proxy) string {
+	ident := strconv.Itoa(proxy.PoolSize)
+	if proxy.TLS != nil {
+		ident += fmt.Sprintf("|%+v", *proxy.TLS)
+	}
+	if proxy.Transport != nil {
+		ident += fmt.Sprintf("|%+v", *proxy.Transport)
+	}
+	return ident
+}
+
+// close pool and all connections in it
+func (pool *sock5Pool) close() {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	pool.closed = true
+	for _, elem := range pool.conns {
+		_ = elem.conn.Close()
+	}
+	pool.conns = nil
+	pool.notify()
+}
@@ -0,0 +1,114 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package tproxy
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/linuxdeepin/deepin-network-proxy/config"
+	"github.com/linuxdeepin/deepin-network-proxy/define"
+)
+
+// sock5 server without auth, send port of connect request to channel
+func serveSock5(listener net.Listener, ports chan<- int) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			buf := make([]byte, 262)
+			if _, err := io.ReadFull(conn, buf[:3]); err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte{5, 0})
+			// VER CMD RSV ATYP(ipv4) ADDR PORT
+			if _, err := io.ReadFull(conn, buf[:10]); err != nil {
+				return
+			}
+			ports <- int(binary.BigEndian.Uint16(buf[8:10]))
+			_, _ = conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		}()
+	}
+}
+
+// second tunnel use connection authenticated in advance
+func TestSock5Pool(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	ports := make(chan int, 8)
+	go serveSock5(listener, ports)
+	proxy := config.Proxy{
+		Name:     "pool",
+		Server:   "127.0.0.1",
+		Port:     listener.Addr().(*net.TCPAddr).Port,
+		PoolSize: 2,
+	}
+	scope := define.Scope("test")
+	defer CloseSock5Pool(scope)
+	rAddr := &net.TCPAddr{IP: net.IP{1, 2, 3, 4}, Port: 443}
+
+	first := NewTcpSock5Handler(scope, HandlerKey{}, proxy, rAddr, rAddr, nil)
+	if err := first.Tunnel(); err != nil {
+		t.Skipf("dial proxy failed, mark may need privilege, err: %v", err)
+	}
+	defer first.Close()
+	if port := <-ports; port != 443 {
+		t.Errorf("connect port is %v, want 443", port)
+	}
+	// pool grow after miss
+	pool := getSock5Pool(&first.handlerPrv)
+	var pooled net.Addr
+	for i := 0; i < 100 && pooled == nil; i++ {
+		time.Sleep(20 * time.Millisecond)
+		pool.lock.Lock()
+		if len(pool.conns) != 0 {
+			pooled = pool.conns[len(pool.conns)-1].conn.LocalAddr()
+		}
+		pool.lock.Unlock()
+	}
+	if pooled == nil {
+		t.Fatal("pool is not filled")
+	}
+
+	second := NewTcpSock5Handler(scope, HandlerKey{}, proxy, rAddr, rAddr, nil)
+	if err := second.Tunnel(); err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	<-ports
+	if second.rConn.LocalAddr().String() != pooled.String() {
+		t.Errorf("tunnel use [%s], want pooled [%s]", second.rConn.LocalAddr(), pooled)
+	}
+}
+
+// pooled connection is dialed again only when closed by server, not when timeout
+func TestIsStaleConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	_ = client.SetReadDeadline(time.Now().Add(time.Millisecond))
+	_, err := client.Read(make([]byte, 1))
+	if isStaleConn(err) {
+		t.Errorf("timeout error %v is stale", err)
+	}
+	_ = client.SetReadDeadline(time.Time{})
+	_ = server.Close()
+	_, err = client.Read(make([]byte, 1))
+	if !isStaleConn(err) {
+		t.Errorf("error %v of closed connection is not stale", err)
+	}
+	if !isStaleConn(&net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}) {
+		t.Error("connection reset is not stale")
+	}
+}
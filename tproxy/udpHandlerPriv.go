@@ -0,0 +1,432 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package tproxy
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/linuxdeepin/deepin-network-proxy/com"
+	"github.com/linuxdeepin/deepin-network-proxy/config"
+	"github.com/linuxdeepin/deepin-network-proxy/define"
+)
+
+const (
+	// max udp datagram size
+	udpBufferSize = 64 * 1024
+	// max sock5 udp header size, RSV FRAG ATYP LEN DOMAIN PORT
+	udpHeaderSize = 4 + 1 + 255 + 2
+	// session is removed if no data transferred in this duration
+	udpSessionTimeout = 60 * time.Second
+	// interval to check idle session
+	udpCheckInterval = 10 * time.Second
+	// max datagram queued while tunnel is creating, later is dropped
+	udpPendingSize = 64
+)
+
+// datagram is dropped when upload limit reached
+var errUdpLimited = errors.New("udp upload limit reached")
+
+// udp handler, datagram from local is sent by WriteTo,
+// bindAddr is the addr local sent to, rAddr is sent to relay, differ if fake ip mapped to domain
+type UdpHandler interface {
+	BaseHandler
+	WriteTo(bindAddr net.Addr, rAddr net.Addr, buf []byte) error
+	SetSessionHook(hook func(stat UdpSessionStat, reason error))
+}
+
+// traffic of one udp session, reported when session closed
+type UdpSessionStat struct {
+	BindAddr net.Addr // addr local sent to, fake ip if remote is domain
+	RAddr    net.Addr
+	Start    time.Time
+	Upload   int64
+	Download int64
+}
+
+// pack datagram to relay server and unpack reply, differ by proto
+type udpPacker interface {
+	pack(rAddr net.Addr, data []byte) ([]byte, error)
+	unpack(msg []byte) (com.DataPackage, error)
+}
+
+// udp session, one local addr with one remote addr
+type udpSession struct {
+	rAddr    net.Addr
+	bindAddr net.Addr // fake ip if remote is domain
+	lConn    net.Conn // fake conn, bind at bind addr and connect to local addr
+	active   time.Time
+	start    time.Time
+	upload   int64
+	download int64
+}
+
+// datagram sent before tunnel created
+type udpPending struct {
+	bindAddr net.Addr
+	rAddr    net.Addr
+	data     []byte
+}
+
+// udp handler private, all sessions from the same local addr share one relay,
+// so that remote addr can reply even if local never send to it (full-cone)
+type udpHandlerPrv struct {
+	handlerPrv
+	packer udpPacker
+
+	// session table, key is remote addr
+	sessions    map[string]*udpSession
+	sessionLock sync.Mutex
+	closed      bool
+	sessionHook func(stat UdpSessionStat, reason error)
+
+	// datagram queued in order until tunnel created or failed
+	pending     []udpPending
+	pendingLock sync.Mutex
+	ready       bool
+	tunnelErr   error
+}
+
+// new udp handler private
+func createUdpHandlerPrv(typ ProtoTyp, scope define.Scope, key HandlerKey, proxy config.Proxy, lAddr net.Addr, rAddr net.Addr, lConn net.Conn) udpHandlerPrv {
+	return udpHandlerPrv{
+		handlerPrv: createHandlerPrv(typ, scope, key, proxy, lAddr, rAddr, lConn),
+		sessions:   make(map[string]*udpSession),
+	}
+}
+
+// save packer
+func (handler *udpHandlerPrv) savePacker(packer udpPacker) {
+	handler.packer = packer
+}
+
+// rewrite close
+func (handler *udpHandlerPrv) Close() {
+	handler.sessionLock.Lock()
+	handler.closed = true
+	var closed []*udpSession
+	for key, session := range handler.sessions {
+		_ = session.lConn.Close()
+		delete(handler.sessions, key)
+		closed = append(closed, session)
+	}
+	hook := handler.sessionHook
+	handler.sessionLock.Unlock()
+	handler.reportSessions(hook, closed, handler.getReason())
+	handler.handlerPrv.Close()
+}
+
+// save hook called when session closed
+func (handler *udpHandlerPrv) SetSessionHook(hook func(stat UdpSessionStat, reason error)) {
+	handler.sessionLock.Lock()
+	defer handler.sessionLock.Unlock()
+	handler.sessionHook = hook
+}
+
+// call session hook with traffic of closed sessions
+func (handler *udpHandlerPrv) reportSessions(hook func(stat UdpSessionStat, reason error), sessions []*udpSession, reason error) {
+	if hook == nil {
+		return
+	}
+	for _, session := range sessions {
+		hook(UdpSessionStat{
+			BindAddr: session.bindAddr,
+			RAddr:    session.rAddr,
+			Start:    session.start,
+			Upload:   atomic.LoadInt64(&session.upload),
+			Download: atomic.LoadInt64(&session.download),
+		}, reason)
+	}
+}
+
+// check if handler is closed
+func (handler *udpHandlerPrv) isClosed() bool {
+	handler.sessionLock.Lock()
+	defer handler.sessionLock.Unlock()
+	return handler.closed
+}
+
+// remove self from manager, key may be reused by new handler after closed
+func (handler *udpHandlerPrv) remove() {
+	if handler.isClosed() {
+		return
+	}
+	handler.Remove()
+}
+
+// save connection to relay server, handler may be closed while dialing
+func (handler *udpHandlerPrv) saveRemote(rConn net.Conn) error {
+	// stream upstream is captured when dialed
+	if _, ok := rConn.(*net.UDPConn); ok && handler.capture != nil {
+		rConn = handler.capture.wrapRemote(rConn)
+	}
+	handler.sessionLock.Lock()
+	closed := handler.closed
+	if !closed {
+		handler.rConn = rConn
+	}
+	handler.sessionLock.Unlock()
+	if closed {
+		_ = rConn.Close()
+		return errors.New("handler is closed")
+	}
+	return nil
+}
+
+// send datagram waiting for tunnel in order, later datagram is sent directly
+func (handler *udpHandlerPrv) tunnelDone(err error) error {
+	handler.pendingLock.Lock()
+	defer handler.pendingLock.Unlock()
+	handler.ready = true
+	handler.tunnelErr = err
+	pending := handler.pending
+	handler.pending = nil
+	if err != nil {
+		return err
+	}
+	for _, elem := range pending {
+		sendErr := handler.writeTo(elem.bindAddr, elem.rAddr, elem.data)
+		if sendErr != nil {
+			logger.Debugf("[%s] write udp to remote [%s] failed, err: %v", handler.typ, elem.rAddr, sendErr)
+		}
+	}
+	return nil
+}
+
+// get session of remote addr, create if not exist
+func (handler *udpHandlerPrv) getSession(bindAddr net.Addr, rAddr net.Addr) (*udpSession, error) {
+	handler.sessionLock.Lock()
+	defer handler.sessionLock.Unlock()
+	if handler.closed {
+		return nil, errors.New("handler is closed")
+	}
+	session, ok := handler.sessions[rAddr.String()]
+	if ok {
+		session.active = time.Now()
+		return session, nil
+	}
+	// make a fake udp dial to cheat socket, reply seems to be sent from addr local sent to
+	lConn, err := com.MegaDial("udp", bindAddr, handler.lAddr)
+	if err != nil {
+		logger.Warningf("[%s] fake dial udp rAddr [%s] to lAddr [%s] failed, err: %v", handler.typ, bindAddr, handler.lAddr, err)
+		return nil, err
+	}
+	session = &udpSession{
+		rAddr:    rAddr,
+		bindAddr: bindAddr,
+		lConn:    lConn,
+		active:   time.Now(),
+		start:    time.Now(),
+	}
+	handler.sessions[rAddr.String()] = session
+	logger.Debugf("[%s] create session, local [%s] -> remote [%s]", handler.typ, handler.lAddr, rAddr)
+	// later datagram from local to remote is delivered to fake conn
+	go handler.readLocal(session)
+	return session, nil
+}
+
+// get session of reply, relay reply domain session with resolved ip,
+// which is matched by port if only one domain session use it
+func (handler *udpHandlerPrv) getReplySession(addr net.Addr) (*udpSession, error) {
+	handler.sessionLock.Lock()
+	session, ok := handler.sessions[addr.String()]
+	if !ok {
+		port := getAddrPort(addr)
+		for _, elem := range handler.sessions {
+			if _, isDomain := elem.rAddr.(*DomainAddr); !isDomain || getAddrPort(elem.rAddr) != port {
+				continue
+			}
+			if session != nil {
+				// cant tell which domain reply
+				session = nil
+				break
+			}
+			session = elem
+		}
+	}
+	if session != nil {
+		session.active = time.Now()
+		handler.sessionLock.Unlock()
+		return session, nil
+	}
+	handler.sessionLock.Unlock()
+	// full-cone, new remote addr reply to local
+	return handler.getSession(addr, addr)
+}
+
+// remove session from table, session removed by others is already reported
+func (handler *udpHandlerPrv) closeSession(session *udpSession, reason error) {
+	handler.sessionLock.Lock()
+	key := session.rAddr.String()
+	if handler.sessions[key] != session {
+		handler.sessionLock.Unlock()
+		return
+	}
+	_ = session.lConn.Close()
+	delete(handler.sessions, key)
+	hook := handler.sessionHook
+	handler.sessionLock.Unlock()
+	logger.Debugf("[%s] close session, local [%s] -> remote [%s]", handler.typ, handler.lAddr, session.rAddr)
+	handler.reportSessions(hook, []*udpSession{session}, reason)
+}
+
+// remove idle sessions, return count of sessions left
+func (handler *udpHandlerPrv) closeIdleSessions() int {
+	handler.sessionLock.Lock()
+	var closed []*udpSession
+	for key, session := range handler.sessions {
+		if time.Since(session.active) < udpSessionTimeout {
+			continue
+		}
+		_ = session.lConn.Close()
+		delete(handler.sessions, key)
+		closed = append(closed, session)
+		logger.Debugf("[%s] session timeout, local [%s] -> remote [%s]", handler.typ, handler.lAddr, session.rAddr)
+	}
+	left := len(handler.sessions)
+	hook := handler.sessionHook
+	handler.sessionLock.Unlock()
+	handler.reportSessions(hook, closed, errIdleTimeout)
+	return left
+}
+
+// send datagram from local to remote addr, queued until tunnel created
+func (handler *udpHandlerPrv) WriteTo(bindAddr net.Addr, rAddr net.Addr, buf []byte) error {
+	handler.pendingLock.Lock()
+	if !handler.ready {
+		defer handler.pendingLock.Unlock()
+		if len(handler.pending) >= udpPendingSize {
+			return errors.New("too many datagram wait for tunnel")
+		}
+		// buf is reused by caller
+		data := make([]byte, len(buf))
+		copy(data, buf)
+		handler.pending = append(handler.pending, udpPending{bindAddr: bindAddr, rAddr: rAddr, data: data})
+		return nil
+	}
+	err := handler.tunnelErr
+	handler.pendingLock.Unlock()
+	if err != nil {
+		return err
+	}
+	return handler.writeTo(bindAddr, rAddr, buf)
+}
+
+// send datagram after tunnel created
+func (handler *udpHandlerPrv) writeTo(bindAddr net.Addr, rAddr net.Addr, buf []byte) error {
+	session, err := handler.getSession(bindAddr, rAddr)
+	if err != nil {
+		return err
+	}
+	return handler.writeRemote(session, buf)
+}
+
+// pack datagram and send to udp relay server
+func (handler *udpHandlerPrv) writeRemote(session *udpSession, buf []byte) error {
+	if !admitBuckets(uploadBuckets(handler.getLimiters()), len(buf)) {
+		return errUdpLimited
+	}
+	msg, err := handler.packer.pack(session.rAddr, buf)
+	if err != nil {
+		return err
+	}
+	if handler.capture != nil {
+		handler.capture.writeDatagram(handler.lAddr, session.rAddr, false, buf)
+	}
+	_, err = handler.rConn.Write(msg)
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&handler.upload, int64(len(buf)))
+	atomic.AddInt64(&session.upload, int64(len(buf)))
+	return nil
+}
+
+// copy datagram from fake conn to remote
+func (handler *udpHandlerPrv) readLocal(session *udpSession) {
+	bufPtr := udpBufferPool.Get()
+	defer udpBufferPool.Put(bufPtr)
+	buf := *bufPtr
+	for {
+		n, err := session.lConn.Read(buf)
+		if err != nil {
+			logger.Debugf("[%s] stop copy data, local [%s] -x- remote [%s], reason: %v",
+				handler.typ, handler.lAddr, session.rAddr, err)
+			handler.closeSession(session, err)
+			return
+		}
+		handler.sessionLock.Lock()
+		session.active = time.Now()
+		handler.sessionLock.Unlock()
+		err = handler.writeRemote(session, buf[:n])
+		if err != nil {
+			logger.Debugf("[%s] write remote failed, remote [%s], err: %v", handler.typ, session.rAddr, err)
+		}
+	}
+}
+
+// copy datagram from udp relay server to local, reply may come from any remote addr
+func (handler *udpHandlerPrv) readRemote() {
+	bufPtr := udpBufferPool.Get()
+	defer udpBufferPool.Put(bufPtr)
+	buf := *bufPtr
+	for {
+		n, err := handler.rConn.Read(buf)
+		if err != nil {
+			logger.Debugf("[%s] stop read udp relay, local [%s], reason: %v", handler.typ, handler.lAddr, err)
+			handler.remove()
+			return
+		}
+		pkgData, err := handler.packer.unpack(buf[:n])
+		if err != nil {
+			logger.Debugf("[%s] drop invalid udp package, err: %v", handler.typ, err)
+			continue
+		}
+		if !admitBuckets(downloadBuckets(handler.getLimiters()), len(pkgData.Data)) {
+			logger.Debugf("[%s] drop udp package over download limit, local [%s]", handler.typ, handler.lAddr)
+			continue
+		}
+		session, err := handler.getReplySession(pkgData.Addr)
+		if err != nil {
+			continue
+		}
+		if handler.capture != nil {
+			handler.capture.writeDatagram(handler.lAddr, session.rAddr, true, pkgData.Data)
+		}
+		_, err = session.lConn.Write(pkgData.Data)
+		if err != nil {
+			logger.Debugf("[%s] write local failed, remote [%s], err: %v", handler.typ, session.rAddr, err)
+			continue
+		}
+		atomic.AddInt64(&handler.download, int64(len(pkgData.Data)))
+		atomic.AddInt64(&session.download, int64(len(pkgData.Data)))
+	}
+}
+
+// rewrite communication
+func (handler *udpHandlerPrv) Communicate() {
+	// handshake is done
+	_ = handler.rConn.SetDeadline(time.Time{})
+	// remote -> local
+	go handler.readRemote()
+
+	// remove idle session, relay is released when all sessions removed
+	go func() {
+		ticker := time.NewTicker(udpCheckInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if handler.isClosed() {
+				return
+			}
+			if handler.closeIdleSessions() == 0 {
+				handler.remove()
+				return
+			}
+		}
+	}()
+}